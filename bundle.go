@@ -0,0 +1,420 @@
+package pip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// A bundle is a single .tar, .tar.gz (or .tgz) or .zip file containing WOF
+// GeoJSON files. The first time a bundle is opened we walk every member and
+// record where it lives so that any record can be read by ID without having
+// to extract anything to disk. Member paths don't matter, only filenames so
+// data/101/736/545/101736545.geojson and 101736545.geojson are the same thing.
+
+// Note that gzip doesn't support random access so reading a single record
+// from a .tar.gz bundle means decompressing everything that comes before it.
+// That's fine for indexing (which reads the bundle sequentially) but it is
+// very slow for cache misses so you should probably use a plain .tar or .zip
+// bundle for anything that needs to answer requests, or cache everything.
+
+type WOFBundleMember struct {
+	Name   string
+	Offset int64
+	Size   int64
+	zip    *zip.File
+}
+
+type WOFBundle struct {
+	Path    string
+	Format  string
+	Members map[int]*WOFBundleMember
+	order   []int
+	fh      *os.File
+	zip     *zip.ReadCloser
+}
+
+func IsBundle(path string) bool {
+
+	_, ok := bundleFormat(path)
+	return ok
+}
+
+func bundleFormat(path string) (string, bool) {
+
+	lower := strings.ToLower(path)
+
+	if strings.HasSuffix(lower, ".tar") {
+		return "tar", true
+	}
+
+	if strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz") {
+		return "tar.gz", true
+	}
+
+	if strings.HasSuffix(lower, ".zip") {
+		return "zip", true
+	}
+
+	return "", false
+}
+
+func OpenBundle(path string) (*WOFBundle, error) {
+
+	format, ok := bundleFormat(path)
+
+	if !ok {
+		return nil, errors.New("unknown bundle format, expected .tar, .tar.gz, .tgz or .zip")
+	}
+
+	b := WOFBundle{
+		Path:    path,
+		Format:  format,
+		Members: make(map[int]*WOFBundleMember),
+		order:   make([]int, 0),
+	}
+
+	var err error
+
+	if format == "zip" {
+		err = b.indexZip()
+	} else {
+		err = b.indexTar()
+	}
+
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+func (b *WOFBundle) Count() int {
+	return len(b.Members)
+}
+
+func (b *WOFBundle) String() string {
+	return b.Path
+}
+
+func (b *WOFBundle) Close() error {
+
+	if b.zip != nil {
+		return b.zip.Close()
+	}
+
+	if b.fh != nil {
+		return b.fh.Close()
+	}
+
+	return nil
+}
+
+func (b *WOFBundle) Read(id int) ([]byte, error) {
+
+	m, ok := b.Members[id]
+
+	if !ok {
+		return nil, notFound(id)
+	}
+
+	switch b.Format {
+
+	case "zip":
+
+		fh, err := m.zip.Open()
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer fh.Close()
+		return ioutil.ReadAll(fh)
+
+	case "tar":
+
+		body := make([]byte, m.Size)
+
+		_, err := b.fh.ReadAt(body, m.Offset)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return body, nil
+
+	default:
+
+		fh, err := os.Open(b.Path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer fh.Close()
+
+		gz, err := gzip.NewReader(fh)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer gz.Close()
+
+		_, err = io.CopyN(ioutil.Discard, gz, m.Offset)
+
+		if err != nil {
+			return nil, err
+		}
+
+		body := make([]byte, m.Size)
+
+		_, err = io.ReadFull(gz, body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return body, nil
+	}
+}
+
+// Walk reads every record in the bundle in the order they are stored, which is
+// the only efficient way to read a compressed bundle.
+
+func (b *WOFBundle) Walk(cb func(id int, body []byte) error) error {
+
+	if b.Format == "zip" || b.Format == "tar" {
+
+		for _, id := range b.order {
+
+			body, err := b.Read(id)
+
+			if err != nil {
+				return err
+			}
+
+			err = cb(id, body)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	fh, err := os.Open(b.Path)
+
+	if err != nil {
+		return err
+	}
+
+	defer fh.Close()
+
+	gz, err := gzip.NewReader(fh)
+
+	if err != nil {
+		return err
+	}
+
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	for {
+
+		hdr, err := tr.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		id, ok := IdFromPath(hdr.Name)
+
+		if !ok {
+			continue
+		}
+
+		// if a record appears more than once the last one wins, same as the index
+
+		m, ok := b.Members[id]
+
+		if !ok || m.Name != hdr.Name {
+			continue
+		}
+
+		body, err := ioutil.ReadAll(tr)
+
+		if err != nil {
+			return err
+		}
+
+		err = cb(id, body)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *WOFBundle) add(id int, m *WOFBundleMember) {
+
+	_, exists := b.Members[id]
+
+	if !exists {
+		b.order = append(b.order, id)
+	}
+
+	b.Members[id] = m
+}
+
+func (b *WOFBundle) indexZip() error {
+
+	z, err := zip.OpenReader(b.Path)
+
+	if err != nil {
+		return err
+	}
+
+	b.zip = z
+
+	for _, f := range z.File {
+
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		id, ok := IdFromPath(f.Name)
+
+		if !ok {
+			continue
+		}
+
+		b.add(id, &WOFBundleMember{Name: f.Name, Offset: -1, Size: int64(f.UncompressedSize64), zip: f})
+	}
+
+	return nil
+}
+
+func (b *WOFBundle) indexTar() error {
+
+	fh, err := os.Open(b.Path)
+
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader
+	r = fh
+
+	if b.Format == "tar" {
+
+		// keep the filehandle around for ReadAt
+
+		b.fh = fh
+
+	} else {
+
+		defer fh.Close()
+
+		gz, err := gzip.NewReader(fh)
+
+		if err != nil {
+			return err
+		}
+
+		defer gz.Close()
+		r = gz
+	}
+
+	// For plain tar files we can seek past the contents of each member instead of reading
+	// them; the offsets we record are always relative to the (uncompressed) tar stream
+
+	cr := &countingReader{reader: r}
+
+	var tr *tar.Reader
+
+	if b.Format == "tar" {
+		tr = tar.NewReader(&countingSeeker{countingReader: cr, seeker: fh})
+	} else {
+		tr = tar.NewReader(cr)
+	}
+
+	for {
+
+		hdr, err := tr.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		id, ok := IdFromPath(hdr.Name)
+
+		if !ok {
+			continue
+		}
+
+		b.add(id, &WOFBundleMember{Name: hdr.Name, Offset: cr.offset, Size: hdr.Size})
+	}
+
+	return nil
+}
+
+// countingReader keeps track of how far in to a stream we are so that we know where
+// each tar member starts.
+
+type countingReader struct {
+	reader io.Reader
+	offset int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+
+	n, err := c.reader.Read(p)
+	c.offset += int64(n)
+
+	return n, err
+}
+
+// countingSeeker is a countingReader that implements io.Seeker so that archive/tar can
+// skip over file contents rather than reading them. It's only used for plain tar files;
+// a gzip stream can't seek, and archive/tar would (quietly) read everything if we
+// pretended that it could.
+
+type countingSeeker struct {
+	*countingReader
+	seeker io.Seeker
+}
+
+func (c *countingSeeker) Seek(offset int64, whence int) (int64, error) {
+
+	pos, err := c.seeker.Seek(offset, whence)
+
+	if err != nil {
+		return pos, err
+	}
+
+	c.offset = pos
+	return pos, nil
+}
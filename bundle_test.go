@@ -0,0 +1,190 @@
+package pip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type bundleMember struct {
+	Name string
+	Body string
+}
+
+// one record is bigger than a tar block (512 bytes) so that reading it by offset has
+// to get past the end of its first block, and there's an alternate geometry for it
+// that comes afterwards and mustn't replace it
+
+var bundleMembers = []bundleMember{
+	{"data/", ""},
+	{"data/README.md", "not a record"},
+	{"data/859/225/83/85922583.geojson", `{"id":85922583}`},
+	{"data/101/736/545/101736545.geojson", `{"id":101736545,"padding":"` + strings.Repeat("x", 2000) + `"}`},
+	{"data/101/736/545/101736545-alt-quattroshapes.geojson", `{"id":101736545,"alt":true}`},
+	{"data/102/087/579/102087579.geojson", `{"id":102087579}`},
+}
+
+var bundleRecords = map[int]string{
+	85922583:  bundleMembers[2].Body,
+	101736545: bundleMembers[3].Body,
+	102087579: bundleMembers[5].Body,
+}
+
+func writeTestTar(t *testing.T, w io.Writer) {
+
+	tw := tar.NewWriter(w)
+
+	for _, m := range bundleMembers {
+
+		hdr := tar.Header{Name: m.Name, Mode: 0644, Size: int64(len(m.Body)), Typeflag: tar.TypeReg}
+
+		if strings.HasSuffix(m.Name, "/") {
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+		}
+
+		err := tw.WriteHeader(&hdr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tw.Write([]byte(m.Body))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := tw.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestBundle(t *testing.T, fname string) string {
+
+	var buf bytes.Buffer
+
+	switch {
+
+	case strings.HasSuffix(fname, ".zip"):
+
+		zw := zip.NewWriter(&buf)
+
+		for _, m := range bundleMembers {
+
+			fh, err := zw.Create(m.Name)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = fh.Write([]byte(m.Body))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := zw.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case strings.HasSuffix(fname, ".tar"):
+
+		writeTestTar(t, &buf)
+
+	default:
+
+		gz := gzip.NewWriter(&buf)
+		writeTestTar(t, gz)
+
+		err := gz.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), fname)
+
+	err := ioutil.WriteFile(path, buf.Bytes(), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestBundle(t *testing.T) {
+
+	for _, fname := range []string{"bundle.tar", "bundle.tar.gz", "bundle.tgz", "bundle.zip"} {
+
+		b, err := OpenBundle(writeTestBundle(t, fname))
+
+		if err != nil {
+			t.Fatalf("%s: %s", fname, err)
+		}
+
+		defer b.Close()
+
+		if b.Count() != len(bundleRecords) {
+			t.Errorf("%s: expected %d records, got %d", fname, len(bundleRecords), b.Count())
+		}
+
+		for id, expected := range bundleRecords {
+
+			body, err := b.Read(id)
+
+			if err != nil {
+				t.Errorf("%s: failed to read %d, because %s", fname, id, err)
+				continue
+			}
+
+			if string(body) != expected {
+				t.Errorf("%s: expected %d to be %.40s..., got %.40s...", fname, id, expected, body)
+			}
+		}
+
+		_, err = b.Read(404)
+
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: expected a missing record not to exist, got %v", fname, err)
+		}
+
+		walked := make([]int, 0)
+
+		err = b.Walk(func(id int, body []byte) error {
+
+			if string(body) != bundleRecords[id] {
+				t.Errorf("%s: walked %d and got %.40s...", fname, id, body)
+			}
+
+			walked = append(walked, id)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatalf("%s: %s", fname, err)
+		}
+
+		sort.Ints(walked)
+
+		if len(walked) != 3 || walked[0] != 85922583 || walked[1] != 101736545 || walked[2] != 102087579 {
+			t.Errorf("%s: expected to walk every record once, got %v", fname, walked)
+		}
+	}
+}
@@ -0,0 +1,709 @@
+package pip
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	metrics "github.com/rcrowley/go-metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WOFPolygonCache is a cache of compact polygons bounded by the total (approximate)
+// number of bytes or vertices it holds rather than the number of records, since a
+// single country can be bigger than a thousand neighbourhoods.
+//
+// Eviction uses the GreedyDual-Size algorithm: every record is given a priority of
+// L + (cost / size) where cost is how long the record took to load, size is how much
+// of the budget it uses and L is an "inflation" value that starts at zero. When we
+// need to make room the record with the lowest priority is evicted and L is set to
+// that record's priority. Records that are hit get their priority recalculated using
+// the current value of L. The end result is that big records that are cheap to load
+// are evicted first, and records that haven't been used for a while eventually fall
+// behind everything else.
+
+type WOFCacheMeasure int
+
+const (
+	CacheMeasureBytes WOFCacheMeasure = iota
+	CacheMeasureVertices
+)
+
+func (m WOFCacheMeasure) String() string {
+
+	if m == CacheMeasureVertices {
+		return "vertices"
+	}
+
+	return "bytes"
+}
+
+// WOFCachePolicy decides whether (and how) the polygons for a record should be cached:
+//
+//	pinned placetypes are always cached, don't count against the cache budget and are
+//	never evicted. They are loaded as they are indexed so the very first lookup is fast.
+//	They are bounded by the cache's PinBudget instead; once that's used up records are
+//	cached as if they weren't pinned
+//	excluded placetypes are never cached
+//	everything else is cached, and may be evicted, if it has at least as many points
+//	as the trigger for its placetype (or the default Trigger if it doesn't have one)
+
+type WOFCacheDecision int
+
+const (
+	CacheNever WOFCacheDecision = iota
+	CacheEvictable
+	CachePinned
+)
+
+type WOFCachePolicy struct {
+	Trigger  int
+	Triggers map[string]int
+	Pinned   map[string]bool
+	Excluded map[string]bool
+}
+
+func NewCachePolicy(trigger int) *WOFCachePolicy {
+
+	c := WOFCachePolicy{
+		Trigger:  trigger,
+		Triggers: make(map[string]int),
+		Pinned:   make(map[string]bool),
+		Excluded: make(map[string]bool),
+	}
+
+	return &c
+}
+
+func (c *WOFCachePolicy) Pin(placetypes ...string) {
+
+	for _, pt := range placetypes {
+		c.Pinned[pt] = true
+	}
+}
+
+func (c *WOFCachePolicy) Exclude(placetypes ...string) {
+
+	for _, pt := range placetypes {
+		c.Excluded[pt] = true
+	}
+}
+
+func (c *WOFCachePolicy) SetTrigger(placetype string, points int) {
+	c.Triggers[placetype] = points
+}
+
+// SetTriggers parses a comma-separated list of placetype:points pairs, like
+// "locality:500,county:1000"
+
+func (c *WOFCachePolicy) SetTriggers(spec string) error {
+
+	for _, pair := range splitList(spec) {
+
+		parts := strings.Split(pair, ":")
+
+		if len(parts) != 2 {
+			return errors.New(fmt.Sprintf("invalid cache trigger '%s', expected placetype:points", pair))
+		}
+
+		points, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid cache trigger '%s', because %s", pair, err))
+		}
+
+		c.SetTrigger(strings.TrimSpace(parts[0]), points)
+	}
+
+	return nil
+}
+
+func (c *WOFCachePolicy) Validate() error {
+
+	for pt, _ := range c.Pinned {
+
+		if c.Excluded[pt] {
+			return errors.New(fmt.Sprintf("placetype '%s' can not be both pinned and excluded", pt))
+		}
+	}
+
+	return nil
+}
+
+func (c *WOFCachePolicy) IsPinned(placetype string) bool {
+	return c.Pinned[placetype]
+}
+
+func (c *WOFCachePolicy) Decide(placetype string, points int) WOFCacheDecision {
+
+	if c.Pinned[placetype] {
+		return CachePinned
+	}
+
+	if c.Excluded[placetype] {
+		return CacheNever
+	}
+
+	trigger, ok := c.Triggers[placetype]
+
+	if !ok {
+		trigger = c.Trigger
+	}
+
+	if points >= trigger {
+		return CacheEvictable
+	}
+
+	return CacheNever
+}
+
+func splitList(list string) []string {
+
+	items := make([]string, 0)
+
+	for _, item := range strings.Split(list, ",") {
+
+		item = strings.TrimSpace(item)
+
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// SplitPlacetypes turns a comma-separated list of placetypes in to a list
+
+func SplitPlacetypes(list string) []string {
+	return splitList(list)
+}
+
+type WOFPlacetypeCacheStats struct {
+	Records   int
+	Pinned    int
+	Used      int64
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	counters  map[string]metrics.Counter
+}
+
+// DefaultPinBudget is the maximum number of bytes that pinned records can use
+
+const DefaultPinBudget = 1024 * 1024 * 1024
+
+type WOFPolygonCache struct {
+	Measure   WOFCacheMeasure
+	Budget    int64
+	PinBudget int64
+	used      int64
+	pin_used  int64
+	inflation float64
+	items     map[int]*wofPolygonCacheItem
+	pinned    map[int]*wofPolygonCacheItem
+	queue     wofPolygonCacheQueue
+	stats     map[string]*WOFPlacetypeCacheStats
+	metrics   *WOFPointInPolygonMetrics
+	mu        *sync.Mutex
+}
+
+type wofPolygonCacheItem struct {
+	id        int
+	placetype string
+	polygons  []*WOFCompactPolygon
+	size      int64
+	bytes     int64
+	cost      float64
+	priority  float64
+	hits      int64
+	index     int
+}
+
+// WOFPolygonCacheEntry describes (but doesn't contain) a record in the cache
+
+type WOFPolygonCacheEntry struct {
+	Id        int
+	Placetype string
+	Hits      int64
+	Pinned    bool
+}
+
+func NewPolygonCache(measure WOFCacheMeasure, budget int64, m *WOFPointInPolygonMetrics) (*WOFPolygonCache, error) {
+
+	if budget <= 0 {
+		return nil, errors.New("cache budget must be greater than zero")
+	}
+
+	c := WOFPolygonCache{
+		Measure:   measure,
+		Budget:    budget,
+		PinBudget: DefaultPinBudget,
+		items:     make(map[int]*wofPolygonCacheItem),
+		pinned:    make(map[int]*wofPolygonCacheItem),
+		queue:     make(wofPolygonCacheQueue, 0),
+		stats:     make(map[string]*WOFPlacetypeCacheStats),
+		metrics:   m,
+		mu:        new(sync.Mutex),
+	}
+
+	return &c, nil
+}
+
+func (c *WOFPolygonCache) Len() int {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.items) + len(c.pinned)
+}
+
+// Used returns how much of the budget is in use, in whatever Measure is. Pinned
+// records don't count against the budget, see Pinned
+
+func (c *WOFPolygonCache) Used() int64 {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.used
+}
+
+// Pinned returns the number of pinned records and how much space (in whatever
+// Measure is) they are using
+
+func (c *WOFPolygonCache) Pinned() (int, int64) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var used int64
+
+	for _, item := range c.pinned {
+		used += item.size
+	}
+
+	return len(c.pinned), used
+}
+
+func (c *WOFPolygonCache) Contains(id int) bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.items[id]
+
+	if !ok {
+		_, ok = c.pinned[id]
+	}
+
+	return ok
+}
+
+// Keys returns the IDs of everything in the cache, pinned records first and then
+// the most valuable evictable ones
+
+func (c *WOFPolygonCache) Keys() []int {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]int, 0)
+
+	for id, _ := range c.pinned {
+		keys = append(keys, id)
+	}
+
+	sort.Ints(keys)
+
+	items := make([]*wofPolygonCacheItem, 0)
+
+	for _, item := range c.items {
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].priority > items[j].priority
+	})
+
+	for _, item := range items {
+		keys = append(keys, item.id)
+	}
+
+	return keys
+}
+
+// Entries describes everything in the cache, pinned records first and then the
+// rest ordered by how many times they've been hit
+
+func (c *WOFPolygonCache) Entries() []WOFPolygonCacheEntry {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]WOFPolygonCacheEntry, 0)
+
+	for _, item := range c.pinned {
+		entries = append(entries, WOFPolygonCacheEntry{item.id, item.placetype, item.hits, true})
+	}
+
+	for _, item := range c.items {
+		entries = append(entries, WOFPolygonCacheEntry{item.id, item.placetype, item.hits, false})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+
+		if entries[i].Pinned != entries[j].Pinned {
+			return entries[i].Pinned
+		}
+
+		if entries[i].Hits != entries[j].Hits {
+			return entries[i].Hits > entries[j].Hits
+		}
+
+		return entries[i].Id < entries[j].Id
+	})
+
+	return entries
+}
+
+// Peek returns the polygons for a record without counting it as a hit or a miss
+
+func (c *WOFPolygonCache) Peek(id int) ([]*WOFCompactPolygon, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.pinned[id]
+
+	if !ok {
+		item, ok = c.items[id]
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	return item.polygons, true
+}
+
+func (c *WOFPolygonCache) Get(id int, placetype string) ([]*WOFCompactPolygon, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pinned, ok := c.pinned[id]
+
+	if ok {
+		pinned.hits += 1
+		c.count(placetype, "hit")
+		return pinned.polygons, true
+	}
+
+	item, ok := c.items[id]
+
+	if !ok {
+		c.count(placetype, "miss")
+		return nil, false
+	}
+
+	item.hits += 1
+	item.priority = c.inflation + (item.cost / float64(item.size))
+	heap.Fix(&c.queue, item.index)
+
+	c.count(placetype, "hit")
+	return item.polygons, true
+}
+
+// Add adds (or replaces) a record in the cache and returns the number of records
+// that were evicted to make room for it. Records that are bigger than the entire
+// budget aren't cached at all.
+
+func (c *WOFPolygonCache) Add(id int, placetype string, polygons []*WOFCompactPolygon, load_time time.Duration) (int, error) {
+
+	bytes, size := c.measure(polygons)
+
+	if size > c.Budget {
+		return 0, errors.New(fmt.Sprintf("%d is too big to cache (%d %s)", id, size, c.Measure))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(id)
+
+	evicted := 0
+
+	for c.used+size > c.Budget && len(c.queue) > 0 {
+
+		victim := c.queue[0]
+
+		c.inflation = victim.priority
+		c.remove(victim.id)
+		c.count(victim.placetype, "evict")
+
+		evicted += 1
+	}
+
+	cost := load_time.Seconds()
+
+	item := wofPolygonCacheItem{
+		id:        id,
+		placetype: placetype,
+		polygons:  polygons,
+		size:      size,
+		bytes:     bytes,
+		cost:      cost,
+		priority:  c.inflation + (cost / float64(size)),
+	}
+
+	heap.Push(&c.queue, &item)
+	c.items[id] = &item
+	c.used += size
+
+	stats := c.placetypeStats(placetype)
+	stats.Records += 1
+	stats.Used += size
+
+	c.countBytes(bytes)
+
+	return evicted, nil
+}
+
+// Pin adds (or replaces) a record that will never be evicted and doesn't count
+// against the budget. Pinned records have a budget of their own, PinBudget, which
+// is always in bytes whatever Measure is; records that would take more than what's
+// left of it aren't pinned and an error is returned.
+
+func (c *WOFPolygonCache) Pin(id int, placetype string, polygons []*WOFCompactPolygon) error {
+
+	bytes, size := c.measure(polygons)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pin_used := c.pin_used
+
+	current, ok := c.pinned[id]
+
+	if ok {
+		pin_used -= current.bytes
+	}
+
+	if pin_used+bytes > c.PinBudget {
+		return errors.New(fmt.Sprintf("%d is too big to pin (%d bytes, with %d of %d bytes already pinned)", id, bytes, pin_used, c.PinBudget))
+	}
+
+	c.remove(id)
+
+	item := wofPolygonCacheItem{
+		id:        id,
+		placetype: placetype,
+		polygons:  polygons,
+		size:      size,
+		bytes:     bytes,
+		index:     -1,
+	}
+
+	c.pinned[id] = &item
+	c.pin_used += bytes
+
+	stats := c.placetypeStats(placetype)
+	stats.Pinned += 1
+
+	c.countBytes(bytes)
+	return nil
+}
+
+func (c *WOFPolygonCache) Remove(id int) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(id)
+}
+
+// Stats returns a copy of the per-placetype statistics for the cache
+
+func (c *WOFPolygonCache) Stats() map[string]WOFPlacetypeCacheStats {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := make(map[string]WOFPlacetypeCacheStats)
+
+	for pt, s := range c.stats {
+		pt_stats := *s
+		pt_stats.counters = nil
+		stats[pt] = pt_stats
+	}
+
+	return stats
+}
+
+// these assume that c.mu has already been locked by the caller
+
+func (c *WOFPolygonCache) remove(id int) {
+
+	pinned, ok := c.pinned[id]
+
+	if ok {
+
+		delete(c.pinned, id)
+		c.pin_used -= pinned.bytes
+
+		stats := c.placetypeStats(pinned.placetype)
+		stats.Pinned -= 1
+
+		c.countBytes(-pinned.bytes)
+		return
+	}
+
+	item, ok := c.items[id]
+
+	if !ok {
+		return
+	}
+
+	heap.Remove(&c.queue, item.index)
+	delete(c.items, id)
+	c.used -= item.size
+
+	stats := c.placetypeStats(item.placetype)
+	stats.Records -= 1
+	stats.Used -= item.size
+
+	c.countBytes(-item.bytes)
+}
+
+// measure returns the size of a list of polygons in bytes and in whatever Measure is
+
+func (c *WOFPolygonCache) measure(polygons []*WOFCompactPolygon) (int64, int64) {
+
+	bytes := int64(CompactPolygonsSize(polygons))
+	size := bytes
+
+	if c.Measure == CacheMeasureVertices {
+
+		size = 0
+
+		for _, poly := range polygons {
+			size += int64(poly.CountPoints())
+		}
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	return bytes, size
+}
+
+func (c *WOFPolygonCache) countBytes(bytes int64) {
+
+	if c.metrics == nil {
+		return
+	}
+
+	var b metrics.Counter
+	b = *c.metrics.CountCacheBytes
+	b.Inc(bytes)
+}
+
+// placetypeStats returns the stats for a placetype, creating them (and registering
+// its per-placetype counters in the metrics registry, for example pip.cache.hit.country)
+// the first time we see it
+
+func (c *WOFPolygonCache) placetypeStats(placetype string) *WOFPlacetypeCacheStats {
+
+	stats, ok := c.stats[placetype]
+
+	if ok {
+		return stats
+	}
+
+	stats = &WOFPlacetypeCacheStats{}
+
+	if c.metrics != nil {
+
+		name := placetype
+
+		if name == "" {
+			name = "unknown"
+		}
+
+		stats.counters = make(map[string]metrics.Counter)
+
+		for _, event := range []string{"hit", "miss", "evict"} {
+			stats.counters[event] = metrics.GetOrRegisterCounter(fmt.Sprintf("pip.cache.%s.%s", event, name), *c.metrics.Registry)
+		}
+	}
+
+	c.stats[placetype] = stats
+	return stats
+}
+
+// count updates both our own stats and the per-placetype counter in the metrics
+// registry
+
+func (c *WOFPolygonCache) count(placetype string, event string) {
+
+	stats := c.placetypeStats(placetype)
+
+	switch event {
+	case "hit":
+		stats.Hits += 1
+	case "miss":
+		stats.Misses += 1
+	case "evict":
+		stats.Evictions += 1
+	}
+
+	counter, ok := stats.counters[event]
+
+	if ok {
+		counter.Inc(1)
+	}
+}
+
+// wofPolygonCacheQueue is a container/heap of cache items, lowest priority first
+
+type wofPolygonCacheQueue []*wofPolygonCacheItem
+
+func (q wofPolygonCacheQueue) Len() int {
+	return len(q)
+}
+
+func (q wofPolygonCacheQueue) Less(i, j int) bool {
+	return q[i].priority < q[j].priority
+}
+
+func (q wofPolygonCacheQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *wofPolygonCacheQueue) Push(x interface{}) {
+
+	item := x.(*wofPolygonCacheItem)
+	item.index = len(*q)
+
+	*q = append(*q, item)
+}
+
+func (q *wofPolygonCacheQueue) Pop() interface{} {
+
+	old := *q
+	n := len(old)
+
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+
+	*q = old[0 : n-1]
+	return item
+}
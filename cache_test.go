@@ -0,0 +1,139 @@
+package pip
+
+import (
+	metrics "github.com/rcrowley/go-metrics"
+	"testing"
+	"time"
+)
+
+func testCachePolygons(size float64) []*WOFCompactPolygon {
+	return []*WOFCompactPolygon{NewCompactPolygon([][]float64{testSquare(0, 0, size, size)}, CompactFloat64)}
+}
+
+func TestPolygonCacheCounters(t *testing.T) {
+
+	m := NewPointInPolygonMetrics()
+
+	c, err := NewPolygonCache(CacheMeasureVertices, 10, m)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Get(1, "country")
+
+	c.Add(1, "country", testCachePolygons(1), time.Millisecond)
+	c.Get(1, "country")
+	c.Get(1, "country")
+
+	// five vertices each so the third one pushes the first one out
+
+	c.Add(2, "locality", testCachePolygons(1), time.Millisecond)
+	c.Add(3, "", testCachePolygons(1), time.Millisecond)
+
+	expected := map[string]int64{
+		"pip.cache.hit.country":    2,
+		"pip.cache.miss.country":   1,
+		"pip.cache.evict.country":  1,
+		"pip.cache.hit.locality":   0,
+		"pip.cache.evict.locality": 0,
+		"pip.cache.miss.unknown":   0,
+	}
+
+	for name, count := range expected {
+
+		counter, ok := (*m.Registry).Get(name).(metrics.Counter)
+
+		if !ok {
+			t.Errorf("expected %s to be registered", name)
+			continue
+		}
+
+		if counter.Count() != count {
+			t.Errorf("%s is %d, expected %d", name, counter.Count(), count)
+		}
+	}
+
+	stats := c.Stats()["country"]
+
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Evictions != 1 || stats.Records != 0 {
+		t.Errorf("unexpected stats for country: %+v", stats)
+	}
+}
+
+func TestPolygonCachePinBudget(t *testing.T) {
+
+	c, err := NewPolygonCache(CacheMeasureBytes, 1024*1024, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	polygons := testCachePolygons(1)
+	bytes := int64(CompactPolygonsSize(polygons))
+
+	c.PinBudget = bytes * 2
+
+	for _, id := range []int{1, 2} {
+
+		err := c.Pin(id, "country", polygons)
+
+		if err != nil {
+			t.Fatalf("failed to pin %d, because %s", id, err)
+		}
+	}
+
+	err = c.Pin(3, "country", polygons)
+
+	if err == nil {
+		t.Errorf("expected pinning a third record to fail")
+	}
+
+	if c.Contains(3) {
+		t.Errorf("didn't expect a record that failed to pin to be cached")
+	}
+
+	// replacing a pinned record doesn't count it twice
+
+	err = c.Pin(2, "country", polygons)
+
+	if err != nil {
+		t.Errorf("failed to replace a pinned record, because %s", err)
+	}
+
+	// and removing one makes room
+
+	c.Remove(1)
+
+	err = c.Pin(3, "country", polygons)
+
+	if err != nil {
+		t.Errorf("failed to pin a record after making room, because %s", err)
+	}
+
+	count, _ := c.Pinned()
+
+	if count != 2 || c.Used() != 0 {
+		t.Errorf("expected 2 pinned records and nothing else, got %d and %d", count, c.Used())
+	}
+}
+
+// once the pin budget is used up pinned placetypes are cached like everything else
+
+func TestCachePolygonsPinBudget(t *testing.T) {
+
+	p := newTestPointInPolygon(t, NewMemoryReader())
+	p.CachePolicy.Pin("country")
+
+	polygons := testCachePolygons(1)
+	p.Cache.PinBudget = int64(CompactPolygonsSize(polygons))
+
+	p.cachePolygons(1, "country", testCachePolygons(1), time.Millisecond)
+	p.cachePolygons(2, "country", testCachePolygons(1), time.Millisecond)
+
+	count, _ := p.Cache.Pinned()
+
+	if count != 1 || !p.Cache.Contains(2) || p.Cache.Used() == 0 {
+		t.Errorf("expected 1 to be pinned and 2 to be cached, got %d pinned and %d bytes used", count, p.Cache.Used())
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-geojson"
+	log "github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-pip"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Index some meta files, pick a bunch of random points and then check the candidates
+// for every point for containment, from a number of goroutines at once, using:
+//
+//	fanout - the way EnsureContained used to do it, one goroutine per candidate and
+//	         another one per polygon
+//	serial - every candidate one after the other in the calling goroutine (which is
+//	         what EnsureContained does if p.Containment is nil)
+//	pool   - the shared pool of -workers workers
+//
+// reporting how long each one took and whether they all found the same things.
+
+type lookup struct {
+	Lat        float64
+	Lon        float64
+	Candidates []*geojson.WOFSpatial
+}
+
+func ids(results []*geojson.WOFSpatial) string {
+
+	ids := make([]int, 0)
+
+	for _, r := range results {
+		ids = append(ids, r.Id)
+	}
+
+	sort.Ints(ids)
+	return fmt.Sprintf("%v", ids)
+}
+
+// this is EnsureContained as it was before there was a pool (minus the metrics),
+// except that 'is_contained' is set under a lock
+
+func fanout(p *pip.WOFPointInPolygon, lat float64, lon float64, results []*geojson.WOFSpatial) []*geojson.WOFSpatial {
+
+	wg := new(sync.WaitGroup)
+	mu := new(sync.Mutex)
+
+	contained := make([]*geojson.WOFSpatial, 0)
+
+	for _, wof := range results {
+
+		wg.Add(1)
+
+		go func(wof *geojson.WOFSpatial) {
+
+			defer wg.Done()
+
+			polygons, err := p.LoadCompactPolygons(wof)
+
+			if err != nil {
+				return
+			}
+
+			wg2 := new(sync.WaitGroup)
+			mu2 := new(sync.Mutex)
+
+			is_contained := false
+
+			for _, poly := range polygons {
+
+				wg2.Add(1)
+
+				go func(poly *pip.WOFCompactPolygon) {
+
+					defer wg2.Done()
+
+					if poly.ContainsWithRule(lat, lon, p.Boundary) {
+						mu2.Lock()
+						is_contained = true
+						mu2.Unlock()
+					}
+				}(poly)
+			}
+
+			wg2.Wait()
+
+			if is_contained {
+				mu.Lock()
+				contained = append(contained, wof)
+				mu.Unlock()
+			}
+		}(wof)
+	}
+
+	wg.Wait()
+
+	return contained
+}
+
+func main() {
+
+	var data = flag.String("data", "", "The data directory where WOF data lives, or a .tar, .tar.gz or .zip bundle of WOF records, required")
+	var points = flag.Int("points", 10000, "The number of random points to look up. Points are picked inside the bounding box of a randomly chosen record so they end up where the data is")
+	var concurrency = flag.Int("concurrency", 32, "The number of goroutines looking up points at the same time, like concurrent requests to wof-pip-server")
+	var workers = flag.Int("workers", runtime.NumCPU(), "The number of workers in the pool")
+	var cache_trigger = flag.Int("cache_trigger", 1, "The minimum number of coordinates in a WOF record that will trigger caching. The default caches everything so that reading files doesn't swamp the difference")
+	var rounds = flag.Int("rounds", 3, "The number of times to run each method, the fastest of which is reported")
+	var seed = flag.Int64("seed", 0, "The seed for picking random points. If 0 the current time is used")
+
+	flag.Parse()
+	args := flag.Args()
+
+	if *data == "" {
+		panic("missing data")
+	}
+
+	logger := log.NewWOFLogger("[wof-pip-contain-bench] ")
+	logger.AddLogger(os.Stdout, "status")
+
+	p, err := pip.NewPointInPolygon(*data, 1024, *cache_trigger, logger)
+
+	if err != nil {
+		panic(err)
+	}
+
+	for _, path := range args {
+		p.IndexMetaFile(path)
+	}
+
+	spatials := make([]*geojson.WOFSpatial, 0)
+
+	for id := range p.Spatials {
+		spatials = append(spatials, p.Spatials[id])
+	}
+
+	if len(spatials) == 0 {
+		panic("nothing was indexed")
+	}
+
+	// map iteration order is random so sort things for the sake of -seed
+
+	sort.Slice(spatials, func(i int, j int) bool {
+		return spatials[i].Id < spatials[j].Id
+	})
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	rnd := rand.New(rand.NewSource(*seed))
+
+	lookups := make([]lookup, *points)
+	candidates := 0
+
+	for i := range lookups {
+
+		bounds := spatials[rnd.Intn(len(spatials))].Bounds()
+
+		lon := bounds.PointCoord(0) + rnd.Float64()*bounds.LengthsCoord(0)
+		lat := bounds.PointCoord(1) + rnd.Float64()*bounds.LengthsCoord(1)
+
+		intersects, _ := p.GetIntersectsByLatLon(lat, lon)
+		inflated, _ := p.InflateSpatialResults(intersects)
+
+		lookups[i] = lookup{lat, lon, inflated}
+		candidates += len(inflated)
+	}
+
+	fmt.Printf("indexed %d records, looking up %d points (seed %d) with %d candidates (%.2f per point) from %d goroutines\n", len(spatials), *points, *seed, candidates, float64(candidates)/float64(*points), *concurrency)
+
+	pool := pip.NewContainmentPool(*workers)
+
+	methods := []struct {
+		Name   string
+		Ensure func(lat float64, lon float64, results []*geojson.WOFSpatial) []*geojson.WOFSpatial
+	}{
+		{"fanout", func(lat float64, lon float64, results []*geojson.WOFSpatial) []*geojson.WOFSpatial {
+			return fanout(p, lat, lon, results)
+		}},
+		{"serial", func(lat float64, lon float64, results []*geojson.WOFSpatial) []*geojson.WOFSpatial {
+			q := *p
+			q.Containment = nil
+			contained, _ := q.EnsureContained(lat, lon, results)
+			return contained
+		}},
+		{fmt.Sprintf("pool (%d workers)", *workers), func(lat float64, lon float64, results []*geojson.WOFSpatial) []*geojson.WOFSpatial {
+			q := *p
+			q.Containment = pool
+			contained, _ := q.EnsureContained(lat, lon, results)
+			return contained
+		}},
+	}
+
+	// load (and cache) everything first so the first method doesn't pay for it
+
+	for _, l := range lookups {
+		p.EnsureContained(l.Lat, l.Lon, l.Candidates)
+	}
+
+	var expected []string
+
+	for _, m := range methods {
+
+		answers := make([]string, len(lookups))
+
+		var best time.Duration
+
+		for r := 0; r < *rounds; r++ {
+
+			var next int64 = -1
+
+			wg := new(sync.WaitGroup)
+
+			t := time.Now()
+
+			for c := 0; c < *concurrency; c++ {
+
+				wg.Add(1)
+
+				go func() {
+
+					defer wg.Done()
+
+					for {
+
+						i := int(atomic.AddInt64(&next, 1))
+
+						if i >= len(lookups) {
+							return
+						}
+
+						l := lookups[i]
+						answers[i] = ids(m.Ensure(l.Lat, l.Lon, l.Candidates))
+					}
+				}()
+			}
+
+			wg.Wait()
+
+			d := time.Since(t)
+
+			if r == 0 || d < best {
+				best = d
+			}
+		}
+
+		fmt.Printf("%-20s %v (%v per point)\n", m.Name, best, best/time.Duration(len(lookups)))
+
+		if expected == nil {
+			expected = answers
+			continue
+		}
+
+		different := 0
+
+		for i, a := range answers {
+
+			if a != expected[i] {
+				different += 1
+			}
+		}
+
+		fmt.Printf("%-20s %d of %d points found something different to %s\n", "", different, len(lookups), methods[0].Name)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-pip"
+	"math"
+	"time"
+)
+
+// How far apart planar and geodesic edges get for some long borders, and how much
+// slower geodesic edges are. Whether they give the right answers is checked by the
+// tests in edges_test.go.
+
+// the latitude of a great circle at a given longitude, worked out a different way
+// to the one edges.go uses: by interpolating between the two points as 3D vectors
+
+func greatCircle(x1 float64, y1 float64, x2 float64, y2 float64, lon float64) float64 {
+
+	rad := math.Pi / 180.0
+
+	vector := func(x float64, y float64) [3]float64 {
+		return [3]float64{math.Cos(y*rad) * math.Cos(x*rad), math.Cos(y*rad) * math.Sin(x*rad), math.Sin(y * rad)}
+	}
+
+	a := vector(x1, y1)
+	b := vector(x2, y2)
+
+	// bisect along the arc until we get to the right longitude
+
+	lo := 0.0
+	hi := 1.0
+
+	var lat float64
+
+	for i := 0; i < 60; i++ {
+
+		f := (lo + hi) / 2
+
+		v := [3]float64{a[0] + (b[0]-a[0])*f, a[1] + (b[1]-a[1])*f, a[2] + (b[2]-a[2])*f}
+
+		x := math.Atan2(v[1], v[0]) / rad
+		lat = math.Atan2(v[2], math.Hypot(v[0], v[1])) / rad
+
+		if x < lon {
+			lo = f
+		} else {
+			hi = f
+		}
+	}
+
+	return lat
+}
+
+func main() {
+
+	var iterations = flag.Int("iterations", 100000, "The number of times to check a point against a big polygon when timing things")
+
+	flag.Parse()
+
+	// how far apart planar and geodesic edges get
+
+	edges := []struct {
+		Name           string
+		X1, Y1, X2, Y2 float64
+	}{
+		{"49th parallel, 10 degrees", -115, 49, -105, 49},
+		{"49th parallel, 28 degrees", -123, 49, -95, 49},
+		{"60th parallel, 10 degrees", -115, 60, -105, 60},
+		{"Tahoe to the Colorado River", -120, 39, -114.6, 35},
+		{"40 degrees south, 40 degrees", 100, -40, 140, -40},
+	}
+
+	for _, e := range edges {
+
+		worst := 0.0
+
+		for i := 1; i < 100; i++ {
+
+			lon := e.X1 + (e.X2-e.X1)*float64(i)/100
+			planar := e.Y1 + (e.Y2-e.Y1)*(lon-e.X1)/(e.X2-e.X1)
+
+			worst = math.Max(worst, math.Abs(greatCircle(e.X1, e.Y1, e.X2, e.Y2, lon)-planar))
+		}
+
+		fmt.Printf("%-30s planar and geodesic edges are up to %.1f km apart\n", e.Name, worst*111.2)
+	}
+
+	// and how much slower geodesic edges are, for a circle with lots of vertices
+
+	circle := make([]float64, 0)
+
+	for i := 0; i <= 10000; i++ {
+		a := 2 * math.Pi * float64(i) / 10000
+		circle = append(circle, 10*math.Cos(a), 45+10*math.Sin(a))
+	}
+
+	timings := []struct {
+		Name    string
+		Prepare bool
+		Edges   pip.WOFEdgeMode
+	}{
+		{"planar", false, pip.EdgePlanar},
+		{"planar (prepared)", true, pip.EdgePlanar},
+		{"geodesic", false, pip.EdgeGeodesic},
+	}
+
+	for _, tm := range timings {
+
+		poly := pip.NewCompactPolygon([][]float64{circle}, pip.CompactFloat64)
+
+		if tm.Prepare {
+			poly.Prepare(1)
+		}
+
+		t := time.Now()
+
+		for i := 0; i < *iterations; i++ {
+			poly.ContainsWithEdges(45+float64(i%100)/10, float64(i%37)/5, pip.BoundaryHalfOpen, tm.Edges)
+		}
+
+		d := time.Since(t)
+
+		fmt.Printf("%-30s %v per check of a 10,000 vertex polygon\n", tm.Name, d/time.Duration(*iterations))
+	}
+}
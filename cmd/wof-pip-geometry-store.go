@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-csv"
+	"github.com/whosonfirst/go-whosonfirst-pip"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func main() {
+
+	var source = flag.String("data", "", "The data directory where WOF data lives, or a .tar, .tar.gz or .zip bundle of WOF records, required")
+	var store = flag.String("store", "", "Where to write the geometry store, required")
+	var verbose = flag.Bool("verbose", false, "Be chatty about what's happening")
+
+	flag.Parse()
+	args := flag.Args()
+
+	if *source == "" {
+		panic("missing data")
+	}
+
+	if *store == "" {
+		panic("missing store")
+	}
+
+	reader, err := pip.NewReader(*source)
+
+	if err != nil {
+		panic(err)
+	}
+
+	writer, err := pip.CreateGeometryStore(*store)
+
+	if err != nil {
+		panic(err)
+	}
+
+	t1 := time.Now()
+
+	seen := make(map[int]bool)
+	errors := 0
+
+	add := func(label string, body []byte) {
+
+		id, err := writer.AddGeoJSON(body)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to add %s, because %s\n", label, err)
+			errors += 1
+			return
+		}
+
+		if id == -1 {
+
+			if *verbose {
+				fmt.Printf("skipping %s because it has no polygons\n", label)
+			}
+
+			return
+		}
+
+		seen[id] = true
+
+		if *verbose {
+			fmt.Printf("added %s\n", label)
+		}
+	}
+
+	// If we've been handed meta files use those to decide what goes in the store,
+	// otherwise just take everything in the data directory (or bundle)
+
+	if len(args) > 0 {
+
+		for _, path := range args {
+
+			meta, err := csv.NewDictReaderFromPath(path)
+
+			if err != nil {
+				panic(err)
+			}
+
+			for {
+				row, err := meta.Read()
+
+				if err == io.EOF {
+					break
+				}
+
+				if err != nil {
+					panic(err)
+				}
+
+				id, ok := pip.IdFromMetaRow(row)
+
+				if !ok || seen[id] || pip.IsAltGeometryPath(row["path"]) {
+					continue
+				}
+
+				body, err := reader.Read(id)
+
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "failed to read %d, because %s\n", id, err)
+					errors += 1
+					continue
+				}
+
+				add(row["path"], body)
+			}
+		}
+
+	} else if seq, ok := reader.(pip.WOFSequentialReader); ok {
+
+		err = seq.Walk(func(id int, body []byte) error {
+
+			if !seen[id] {
+				add(fmt.Sprintf("%d", id), body)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			panic(err)
+		}
+
+	} else if fs, ok := reader.(*pip.WOFFilesystemReader); ok {
+
+		err = filepath.Walk(fs.Root, func(path string, info os.FileInfo, err error) error {
+
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				return nil
+			}
+
+			id, ok := pip.IdFromPath(path)
+
+			if !ok || seen[id] {
+				return nil
+			}
+
+			body, err := reader.Read(id)
+
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read %s, because %s\n", path, err)
+				errors += 1
+				return nil
+			}
+
+			add(path, body)
+			return nil
+		})
+
+		if err != nil {
+			panic(err)
+		}
+
+	} else {
+		panic("can only build a store without meta files from a data directory or a bundle")
+	}
+
+	err = writer.Close()
+
+	if err != nil {
+		panic(err)
+	}
+
+	t2 := float64(time.Since(t1)) / 1e9
+
+	fmt.Printf("wrote %d records to %s in %.3f seconds (%d errors)\n", len(seen), *store, t2, errors)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/whosonfirst/go-whosonfirst-geojson"
+	log "github.com/whosonfirst/go-whosonfirst-log"
+	"github.com/whosonfirst/go-whosonfirst-pip"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// Index some meta files and then look up a bunch of random points using both the
+// flat and hierarchy strategies, reporting how many candidates each one checked
+// and any points where they don't agree (which will be places whose polygons poke
+// out past their parent's).
+
+func ids(results []*geojson.WOFSpatial) []int {
+
+	ids := make([]int, 0)
+
+	for _, r := range results {
+		ids = append(ids, r.Id)
+	}
+
+	sort.Ints(ids)
+	return ids
+}
+
+func main() {
+
+	var data = flag.String("data", "", "The data directory where WOF data lives, or a .tar, .tar.gz or .zip bundle of WOF records, required")
+	var points = flag.Int("points", 1000, "The number of random points to look up. Points are picked inside the bounding box of a randomly chosen record so they end up where the data is")
+	var seed = flag.Int64("seed", 0, "The seed for picking random points. If 0 the current time is used")
+	var index_from_meta = flag.Bool("index_from_meta", false, "Build the index straight from the meta files, in which case nothing has a hierarchy and nothing is pruned")
+	var verbose = flag.Bool("verbose", false, "Be chatty about what's happening")
+
+	flag.Parse()
+	args := flag.Args()
+
+	if *data == "" {
+		panic("missing data")
+	}
+
+	logger := log.NewWOFLogger("[wof-pip-hierarchy-check] ")
+	logger.AddLogger(os.Stdout, "status")
+
+	p, err := pip.NewPointInPolygon(*data, 1024, 1, logger)
+
+	if err != nil {
+		panic(err)
+	}
+
+	p.IndexFromMeta = *index_from_meta
+
+	for _, path := range args {
+		p.IndexMetaFile(path)
+	}
+
+	spatials := make([]*geojson.WOFSpatial, 0)
+	with_hierarchy := 0
+
+	for id := range p.Spatials {
+
+		spatials = append(spatials, p.Spatials[id])
+
+		_, ok := p.GetAncestors(id)
+
+		if ok {
+			with_hierarchy += 1
+		}
+	}
+
+	if len(spatials) == 0 {
+		panic("nothing was indexed")
+	}
+
+	// map iteration order is random so sort things for the sake of -seed
+
+	sort.Slice(spatials, func(i int, j int) bool {
+		return spatials[i].Id < spatials[j].Id
+	})
+
+	fmt.Printf("indexed %d records, %d of them with a hierarchy\n", len(spatials), with_hierarchy)
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	rnd := rand.New(rand.NewSource(*seed))
+
+	type point struct {
+		lat        float64
+		lon        float64
+		candidates []*geojson.WOFSpatial
+	}
+
+	lookups := make([]point, 0)
+
+	for i := 0; i < *points; i++ {
+
+		bounds := spatials[rnd.Intn(len(spatials))].Bounds()
+
+		lon := bounds.PointCoord(0) + rnd.Float64()*bounds.LengthsCoord(0)
+		lat := bounds.PointCoord(1) + rnd.Float64()*bounds.LengthsCoord(1)
+
+		intersects, _ := p.GetIntersectsByLatLon(lat, lon)
+		candidates, _ := p.InflateSpatialResults(intersects)
+
+		lookups = append(lookups, point{lat, lon, candidates})
+	}
+
+	// load every candidate's polygons before timing anything so that both
+	// strategies run against the same warm cache, otherwise whichever one runs
+	// first pays for parsing everything
+
+	for _, pt := range lookups {
+
+		for _, wof := range pt.candidates {
+			p.LoadCompactPolygons(wof)
+		}
+	}
+
+	flat_checked := 0
+	hier_checked := 0
+	found := 0
+	different := 0
+
+	var flat_time time.Duration
+	var hier_time time.Duration
+
+	flat_results := make([][]*geojson.WOFSpatial, len(lookups))
+
+	for i, pt := range lookups {
+
+		flat, d := p.EnsureContained(pt.lat, pt.lon, pt.candidates)
+		flat_checked += len(pt.candidates)
+		flat_time += d
+
+		flat_results[i] = flat
+		found += len(flat)
+	}
+
+	for i, pt := range lookups {
+
+		hier, count, d := p.EnsureContainedHierarchy(pt.lat, pt.lon, pt.candidates, nil)
+		hier_checked += count
+		hier_time += d
+
+		a := fmt.Sprintf("%v", ids(flat_results[i]))
+		b := fmt.Sprintf("%v", ids(hier))
+
+		if a != b {
+			different += 1
+			fmt.Printf("%f, %f: flat found %s, hierarchy found %s\n", pt.lat, pt.lon, a, b)
+		} else if *verbose {
+			fmt.Printf("%f, %f: %d candidates (flat), %d candidates (hierarchy), found %s\n", pt.lat, pt.lon, len(pt.candidates), count, a)
+		}
+	}
+
+	fmt.Printf("looked up %d points (seed %d), finding %d records\n", *points, *seed, found)
+	fmt.Printf("flat checked %d candidates (%.2f per point) in %v\n", flat_checked, float64(flat_checked)/float64(*points), flat_time)
+	fmt.Printf("hierarchy checked %d candidates (%.2f per point) in %v\n", hier_checked, float64(hier_checked)/float64(*points), hier_time)
+	fmt.Printf("%d points had different results\n", different)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	rtreego "github.com/dhconnelly/rtreego"
+	csv "github.com/whosonfirst/go-whosonfirst-csv"
+	"github.com/whosonfirst/go-whosonfirst-geojson"
+	"github.com/whosonfirst/go-whosonfirst-pip"
+	"io"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// Build every kind of spatial index from the same meta files (using the bbox columns,
+// so no GeoJSON files are opened) and compare how long it takes to build them, how
+// much memory they use, how fast they are to search and to delete things from, and
+// whether they all find the same things.
+
+type backend struct {
+	Name  string
+	Index func() pip.WOFSpatialIndex
+}
+
+type query struct {
+	Rect *rtreego.Rect
+}
+
+func heapAlloc() uint64 {
+
+	runtime.GC()
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return m.HeapAlloc
+}
+
+func ids(results []rtreego.Spatial) string {
+
+	ids := make([]int, 0)
+
+	for _, r := range results {
+		ids = append(ids, r.(*geojson.WOFSpatial).Id)
+	}
+
+	sort.Ints(ids)
+	return fmt.Sprintf("%v", ids)
+}
+
+func main() {
+
+	var points = flag.Int("points", 100000, "The number of random point lookups to time. Points are picked inside the bounding box of a randomly chosen record so they end up where the data is")
+	var boxes = flag.Int("boxes", 1000, "The number of random bounding box searches to time")
+	var box_size = flag.Float64("box_size", 1.0, "The size of the random bounding boxes, in degrees")
+	var cell_size = flag.Float64("grid_cell_size", pip.DefaultGridCellSize, "The size of the cells of the grid index, in degrees")
+	var max_cells = flag.Int("grid_max_cells", pip.DefaultGridMaxCells, "The maximum number of cells a record can be listed in before the grid index puts it in the list of records that are checked for every search")
+	var seed = flag.Int64("seed", 0, "The seed for picking random points. If 0 the current time is used")
+
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) == 0 {
+		panic("missing meta files")
+	}
+
+	spatials := make([]*geojson.WOFSpatial, 0)
+	skipped := 0
+
+	for _, path := range args {
+
+		reader, err := csv.NewDictReaderFromPath(path)
+
+		if err != nil {
+			panic(err)
+		}
+
+		for {
+			row, err := reader.Read()
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				panic(err)
+			}
+
+			spatial, err := pip.SpatialFromMetaRow(row)
+
+			if err != nil {
+				skipped += 1
+				continue
+			}
+
+			spatials = append(spatials, spatial)
+		}
+	}
+
+	if len(spatials) == 0 {
+		panic("nothing to index")
+	}
+
+	fmt.Printf("read %d records (skipped %d rows without a usable bounding box)\n", len(spatials), skipped)
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	rnd := rand.New(rand.NewSource(*seed))
+
+	point_queries := make([]query, *points)
+
+	for i := range point_queries {
+
+		bounds := spatials[rnd.Intn(len(spatials))].Bounds()
+
+		lon := bounds.PointCoord(0) + rnd.Float64()*bounds.LengthsCoord(0)
+		lat := bounds.PointCoord(1) + rnd.Float64()*bounds.LengthsCoord(1)
+
+		// the same as GetIntersectsByLatLon
+
+		rect, _ := rtreego.NewRect(rtreego.Point{lon, lat}, []float64{0.0001, 0.0001})
+		point_queries[i] = query{rect}
+	}
+
+	box_queries := make([]query, *boxes)
+
+	for i := range box_queries {
+
+		bounds := spatials[rnd.Intn(len(spatials))].Bounds()
+
+		lon := bounds.PointCoord(0) + rnd.Float64()*bounds.LengthsCoord(0) - (*box_size / 2)
+		lat := bounds.PointCoord(1) + rnd.Float64()*bounds.LengthsCoord(1) - (*box_size / 2)
+
+		rect, _ := rtreego.NewRect(rtreego.Point{lon, lat}, []float64{*box_size, *box_size})
+		box_queries[i] = query{rect}
+	}
+
+	backends := []backend{
+		{"rtree", func() pip.WOFSpatialIndex { return pip.NewRtreeIndex() }},
+		{"grid", func() pip.WOFSpatialIndex { return pip.NewGridIndex(*cell_size, *max_cells) }},
+	}
+
+	// the answers from the first backend, which everything else is compared with
+
+	var expected []string
+
+	for _, b := range backends {
+
+		fmt.Printf("\n%s\n", b.Name)
+
+		before := heapAlloc()
+
+		t := time.Now()
+
+		index := b.Index()
+
+		for _, spatial := range spatials {
+			index.Insert(spatial)
+		}
+
+		d := time.Since(t)
+		after := heapAlloc()
+
+		fmt.Printf("  insert %d records in %v (%v per record), about %d bytes of memory\n", index.Size(), d, d/time.Duration(len(spatials)), int64(after)-int64(before))
+
+		answers := make([]string, 0)
+
+		for _, set := range []struct {
+			Name    string
+			Queries []query
+		}{{"point", point_queries}, {"bounding box", box_queries}} {
+
+			if len(set.Queries) == 0 {
+				continue
+			}
+
+			found := 0
+
+			t = time.Now()
+
+			for _, q := range set.Queries {
+				found += len(index.SearchIntersect(q.Rect))
+			}
+
+			d = time.Since(t)
+
+			fmt.Printf("  %d %s searches in %v (%v per search), finding %d records\n", len(set.Queries), set.Name, d, d/time.Duration(len(set.Queries)), found)
+
+			for _, q := range set.Queries {
+				answers = append(answers, ids(index.SearchIntersect(q.Rect)))
+			}
+		}
+
+		if expected == nil {
+
+			expected = answers
+
+		} else {
+
+			different := 0
+
+			for i, a := range answers {
+
+				if a != expected[i] {
+					different += 1
+				}
+			}
+
+			fmt.Printf("  %d searches found something different to %s\n", different, backends[0].Name)
+		}
+
+		// delete every other record
+
+		t = time.Now()
+		deleted := 0
+
+		for i := 0; i < len(spatials); i += 2 {
+
+			if index.Delete(spatials[i]) {
+				deleted += 1
+			}
+		}
+
+		d = time.Since(t)
+
+		fmt.Printf("  delete %d records in %v (%v per record), %d left\n", deleted, d, d/time.Duration(deleted), index.Size())
+	}
+
+	os.Exit(0)
+}
@@ -11,6 +11,7 @@ import (
 func main() {
 
 	var source = flag.String("source", "", "The source directory where WOF data lives")
+	var from_meta = flag.Bool("from_meta", false, "Build the index from the columns in the meta files rather than opening every GeoJSON file")
 
 	flag.Parse()
 	args := flag.Args()
@@ -31,6 +32,8 @@ func main() {
 		panic(p_err)
 	}
 
+	p.IndexFromMeta = *from_meta
+
 	t1 := time.Now()
 
 	for _, path := range args {
@@ -40,7 +43,7 @@ func main() {
 
 	t2 := float64(time.Since(t1)) / 1e9
 
-	fmt.Printf("indexed %d records in %.3f seconds \n", p.Rtree.Size(), t2)
+	fmt.Printf("indexed %d records in %.3f seconds \n", p.Size(), t2)
 
 	lat := 37.791614
 	lon := -122.392375
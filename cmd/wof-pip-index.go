@@ -35,7 +35,7 @@ func main() {
 		p.IndexGeoJSONFile(path)
 	}
 
-	fmt.Printf("indexed %d records\n", p.Rtree.Size())
+	fmt.Printf("indexed %d records\n", p.Size())
 
 	lat := 37.791614
 	lon := -122.392375
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	geo "github.com/kellydunn/golang-geo"
+	"github.com/whosonfirst/go-whosonfirst-geojson"
+	"github.com/whosonfirst/go-whosonfirst-pip"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Compare the gjson-based geometry-only and properties-only parsers against what
+// geojson.UnmarshalFeature gives us, and time both of them. This is what a cache
+// miss costs (minus reading the file) so it's a decent way to see what the fast
+// path is buying you for a given set of records.
+
+func main() {
+
+	var iterations = flag.Int("iterations", 10, "The number of times to parse each file when timing things")
+	var verbose = flag.Bool("verbose", false, "Be chatty about what's happening")
+
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) == 0 {
+		panic("missing GeoJSON files")
+	}
+
+	var full_geom time.Duration
+	var fast_geom time.Duration
+	var full_props time.Duration
+	var fast_props time.Duration
+
+	checked := 0
+	errors := 0
+
+	for _, path := range args {
+
+		body, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read %s, because %s\n", path, err)
+			errors += 1
+			continue
+		}
+
+		full, err := geojson.UnmarshalFeature(body)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to unmarshal %s, because %s\n", path, err)
+			errors += 1
+			continue
+		}
+
+		fast, err := pip.UnmarshalFeatureGeometry(body)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to unmarshal geometry for %s, because %s\n", path, err)
+			errors += 1
+			continue
+		}
+
+		props, err := pip.UnmarshalFeatureProperties(body)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to unmarshal properties for %s, because %s\n", path, err)
+			errors += 1
+			continue
+		}
+
+		err = comparePolygons(full.GeomToPolygons(), fast)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "geometry for %s does not match, because %s\n", path, err)
+			errors += 1
+			continue
+		}
+
+		err = compareSpatial(full, props)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "properties for %s do not match, because %s\n", path, err)
+			errors += 1
+			continue
+		}
+
+		checked += 1
+
+		t1 := time.Now()
+
+		for i := 0; i < *iterations; i++ {
+			f, _ := geojson.UnmarshalFeature(body)
+			pip.CompactPolygons(f.GeomToPolygons(), pip.CompactFloat64)
+		}
+
+		t2 := time.Now()
+
+		for i := 0; i < *iterations; i++ {
+			pip.CompactPolygonsFromGeoJSON(body, pip.CompactFloat64)
+		}
+
+		t3 := time.Now()
+
+		for i := 0; i < *iterations; i++ {
+			f, _ := geojson.UnmarshalFeature(body)
+			f.EnSpatialize()
+		}
+
+		t4 := time.Now()
+
+		for i := 0; i < *iterations; i++ {
+			f, _ := pip.UnmarshalFeatureProperties(body)
+			f.EnSpatialize()
+		}
+
+		t5 := time.Now()
+
+		full_geom += t2.Sub(t1)
+		fast_geom += t3.Sub(t2)
+		full_props += t4.Sub(t3)
+		fast_props += t5.Sub(t4)
+
+		if *verbose {
+			fmt.Printf("%s geometry %s vs %s, properties %s vs %s\n", path, t2.Sub(t1)/time.Duration(*iterations), t3.Sub(t2)/time.Duration(*iterations), t4.Sub(t3)/time.Duration(*iterations), t5.Sub(t4)/time.Duration(*iterations))
+		}
+	}
+
+	fmt.Printf("checked %d records (%d errors)\n", checked, errors)
+
+	if checked == 0 {
+		os.Exit(1)
+	}
+
+	n := time.Duration(checked * *iterations)
+
+	fmt.Printf("geometry: %s per record with geojson.UnmarshalFeature, %s with the fast path (%.1fx)\n", full_geom/n, fast_geom/n, speedup(full_geom, fast_geom))
+	fmt.Printf("properties: %s per record with geojson.UnmarshalFeature, %s with the fast path (%.1fx)\n", full_props/n, fast_props/n, speedup(full_props, fast_props))
+
+	if errors > 0 {
+		os.Exit(1)
+	}
+}
+
+func speedup(slow time.Duration, fast time.Duration) float64 {
+
+	if fast == 0 {
+		return 0.0
+	}
+
+	return float64(slow) / float64(fast)
+}
+
+func comparePolygons(expected []*geojson.WOFPolygon, got []*geojson.WOFPolygon) error {
+
+	if len(expected) != len(got) {
+		return fmt.Errorf("expected %d polygons but got %d", len(expected), len(got))
+	}
+
+	for i, poly := range expected {
+
+		if len(poly.InteriorRings) != len(got[i].InteriorRings) {
+			return fmt.Errorf("expected %d interior rings for polygon %d but got %d", len(poly.InteriorRings), i, len(got[i].InteriorRings))
+		}
+
+		err := compareRing(poly.OuterRing.Points(), got[i].OuterRing.Points())
+
+		if err != nil {
+			return fmt.Errorf("outer ring for polygon %d: %s", i, err)
+		}
+
+		for j, ring := range poly.InteriorRings {
+
+			err := compareRing(ring.Points(), got[i].InteriorRings[j].Points())
+
+			if err != nil {
+				return fmt.Errorf("interior ring %d for polygon %d: %s", j, i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func compareRing(expected []*geo.Point, got []*geo.Point) error {
+
+	if len(expected) != len(got) {
+		return fmt.Errorf("expected %d points but got %d", len(expected), len(got))
+	}
+
+	for i, pt := range expected {
+
+		if pt.Lat() != got[i].Lat() || pt.Lng() != got[i].Lng() {
+			return fmt.Errorf("point %d is %f,%f but should be %f,%f", i, got[i].Lat(), got[i].Lng(), pt.Lat(), pt.Lng())
+		}
+	}
+
+	return nil
+}
+
+func compareSpatial(full *geojson.WOFFeature, props *geojson.WOFFeature) error {
+
+	expected, err := full.EnSpatialize()
+
+	if err != nil {
+		return err
+	}
+
+	got, err := props.EnSpatialize()
+
+	if err != nil {
+		return err
+	}
+
+	if expected.Id != got.Id || expected.Name != got.Name || expected.Placetype != got.Placetype {
+		return fmt.Errorf("expected %d (%s, %s) but got %d (%s, %s)", expected.Id, expected.Name, expected.Placetype, got.Id, got.Name, got.Placetype)
+	}
+
+	if expected.Deprecated != got.Deprecated || expected.Superseded != got.Superseded {
+		return fmt.Errorf("deprecated/superseded flags differ")
+	}
+
+	if expected.Bounds().String() != got.Bounds().String() {
+		return fmt.Errorf("expected bounds %s but got %s", expected.Bounds(), got.Bounds())
+	}
+
+	if len(full.Hierarchy()) != len(props.Hierarchy()) {
+		return fmt.Errorf("expected %d hierarchies but got %d", len(full.Hierarchy()), len(props.Hierarchy()))
+	}
+
+	return nil
+}
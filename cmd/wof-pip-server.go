@@ -1,54 +1,137 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/facebookgo/grace/gracehttp"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
 	log "github.com/whosonfirst/go-whosonfirst-log"
 	pip "github.com/whosonfirst/go-whosonfirst-pip"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
+// so that -data can be passed more than once
+
+type dataSources []string
+
+func (d *dataSources) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *dataSources) Set(value string) error {
+	*d = append(*d, value)
+	return nil
+}
+
+// shapeResult is what a result looks like when the shape parameter is set: the same
+// as usual plus a Shape property (which is left out if it couldn't be worked out)
+
+type shapeResult struct {
+	*geojson.WOFSpatial
+	Shape *pip.WOFRecordShape `json:",omitempty"`
+}
+
 func main() {
 
+	var data dataSources
+
 	var host = flag.String("host", "localhost", "The hostname to listen for requests on")
 	var port = flag.Int("port", 8080, "The port number to listen for requests on")
-	var data = flag.String("data", "", "The data directory where WOF data lives, required")
+	flag.Var(&data, "data", "The data directory where WOF data lives, or a .tar, .tar.gz or .zip bundle of WOF records, required. May be passed multiple times in which case each source is searched in order")
 	var cache_all = flag.Bool("cache_all", false, "Just cache everything, regardless of size")
-	var cache_size = flag.Int("cache_size", 1024, "The number of WOF records with large geometries to cache")
+	var cache_mb = flag.Int("cache_mb", 1024, "The maximum amount of memory to use for caching WOF records with large geometries, in megabytes")
+	flag.Int("cache_size", 0, "No longer supported, since it used to be a number of records rather than megabytes. Use -cache_mb instead")
+	var cache_vertices = flag.Int64("cache_vertices", 0, "If greater than 0 limit the cache by the total number of vertices it holds rather than -cache_mb")
 	var cache_trigger = flag.Int("cache_trigger", 2000, "The minimum number of coordinates in a WOF record that will trigger caching")
+	var cache_triggers = flag.String("cache_triggers", "", "A comma-separated list of placetype:points pairs to use instead of -cache_trigger for specific placetypes, for example \"locality:500,county:1000\"")
+	var cache_pin = flag.String("cache_pin", "", "A comma-separated list of placetypes whose polygons are always kept in memory, regardless of size, for example \"country,region\"")
+	var cache_pin_mb = flag.Int("cache_pin_mb", 1024, "The maximum amount of memory that records in -cache_pin placetypes can use, in megabytes. Once it's used up they are cached like everything else")
+	var cache_exclude = flag.String("cache_exclude", "", "A comma-separated list of placetypes that are never cached")
+	var cache_encoding = flag.String("cache_encoding", "float64", "How to store the coordinates of cached polygons. Valid options are \"float64\", \"float32\" (half the size, accurate to about a metre) and \"delta\" (smallest, accurate to about a centimetre but slower)")
+	var simplify = flag.Float64("simplify", 0, "The tolerance, in metres, to simplify polygons with before they are cached. Points within that distance of a simplified polygon's edges are checked against the original polygon, so answers don't change. If 0 polygons are not simplified")
+	var simplify_cache = flag.Int("simplify_cache", 64, "The maximum amount of memory to use for keeping the original polygons for points near the edges of -simplify'd ones, in megabytes")
+	var prepare_threshold = flag.Int("prepare_threshold", pip.DefaultPrepareThreshold, "The minimum number of vertices in a ring of a cached polygon that will trigger building an index of its edges to speed up containment checks. If 0 rings are never indexed")
+	var boundary = flag.String("boundary", "half-open", "What to do with points that are exactly on the edge of a polygon. Valid options are \"half-open\" (a point on an edge shared by two polygons belongs to exactly one of them), \"inclusive\" and \"exclusive\"")
+	var edges = flag.String("edges", "planar", "What shape the edges of polygons are. Valid options are \"planar\" (straight lines in longitude/latitude space) and \"geodesic\" (great circle arcs, which only matters for long edges and is several times slower)")
+	var edge_placetypes = flag.String("edge_placetypes", "", "A comma-separated list of placetype:mode pairs to use instead of -edges for specific placetypes, for example \"marinearea:geodesic\"")
+	var strategy = flag.String("strategy", "flat", "How to decide which of the candidates for a lookup to check. Valid options are \"flat\" (check all of them) and \"hierarchy\" (check countries and regions first, then only the records whose wof:hierarchy says they might be inside one of them). Lookups filtered by placetype always use \"flat\"")
 	var strict = flag.Bool("strict", false, "Enable strict placetype checking")
 	var loglevel = flag.String("loglevel", "info", "Log level for reporting")
 	var logs = flag.String("logs", "", "Where to write logs to disk")
 	var metrics = flag.String("metrics", "", "Where to write (@rcrowley go-metrics style) metrics to disk")
 	var format = flag.String("metrics-as", "plain", "Format metrics as... ? Valid options are \"json\" and \"plain\"")
 	var cors = flag.Bool("cors", false, "Enable CORS headers")
-	var procs = flag.Int("procs", (runtime.NumCPU() * 2), "The number of concurrent processes to clone data with")
+	var procs = flag.Int("procs", (runtime.NumCPU() * 2), "The number of concurrent processes to clone data with, which is also the number of workers used to check candidates for containment")
 	var pidfile = flag.String("pidfile", "", "Where to write a PID file for wof-pip-server. If empty the PID file will be written to wof-pip-server.pid in the current directory")
 	var nopid = flag.Bool("nopid", false, "Do not try to write a PID file")
+	var remote_cache = flag.String("remote_cache", "", "A directory in which to cache records fetched from remote (http or https) -data sources")
+	var remote_cache_size = flag.Int64("remote_cache_size", 1024, "The maximum size of the -remote_cache directory, in megabytes")
+	var remote_timeout = flag.Duration("remote_timeout", 30*time.Second, "How long to wait for a remote -data source to respond")
+	var remote_retries = flag.Int("remote_retries", 3, "How many times to retry a request to a remote -data source that fails")
+	var remote_maxage = flag.Duration("remote_maxage", 0, "How long records in the -remote_cache are considered fresh before being revalidated. If 0 they are always revalidated")
+	var geometry_store = flag.String("geometry_store", "", "A geometry store (created with wof-pip-geometry-store) to load polygons from before trying -data")
+	var index_backend = flag.String("index_backend", "rtree", "The spatial index used to find candidates for a lookup. Valid options are \"rtree\" and \"grid\" (a uniform grid, see wof-pip-index-bench)")
+	var index_from_meta = flag.Bool("index_from_meta", false, "Build the index from the columns in the meta files rather than opening every GeoJSON file. Polygons are loaded the first time they are needed and records whose meta file rows are missing a column are read like always")
+	var precache_workers = flag.Int("precache_workers", 4, "The number of workers used to pre-cache polygons in the background")
+	var precache_queue = flag.Int("precache_queue", 100000, "The maximum number of records waiting to be pre-cached. Records (other than pinned ones) added once the queue is full are dropped")
+	var precache_from = flag.String("precache_from", "", "A file containing a list of WOF IDs, one per line, to pre-cache once indexing is complete. For example yesterday's most popular records")
+	var cache_persist = flag.String("cache_persist", "", "Where to save a list of the records in the cache when the server shuts down. If it exists when the server starts the records it lists are pre-cached once indexing is complete")
+	var cache_persist_polygons = flag.Bool("cache_persist_polygons", false, "Save the polygons for cached records (in a geometry store next to -cache_persist) as well as their IDs, so they don't need to be read again when the cache is restored")
+	var coverage = flag.Bool("coverage", false, "Precompute which records fully or partly cover each cell of a fixed grid once indexing is complete, so that lookups only need to check the records that partly cover the point's cell")
+	var coverage_level = flag.Int("coverage_level", pip.DefaultCoverageLevel, "The level of the -coverage grid. At level L the world is split in to 2^(L+1) by 2^L cells; each level is four times as many cells (and roughly four times the memory) as the one before")
+	var coverage_file = flag.String("coverage_file", "", "Where to save -coverage once it has been built. If it exists when the server starts, and was built from the same index at the same level, it is loaded instead of being built again")
+	var result_cache = flag.Int("result_cache", 0, "The maximum number of lookup results to cache, keyed by the point (snapped to -result_precision) and the filters. Results for points near the edge of a polygon are never cached. Unless -cache_trigger is passed too this sets it to 1, since results are only cached if the polygons for every record that could be a result are. If 0 results are not cached")
+	var result_precision = flag.Float64("result_precision", pip.DefaultResultCachePrecision, "The size, in degrees, of the cells that points are snapped to for -result_cache. The default is about a metre")
+	var watch = flag.Bool("watch", false, "Poll the meta files (and the files they point to) for changes and apply them to the index")
+	var watch_interval = flag.Duration("watch_interval", 5*time.Minute, "How often to poll for changes when -watch is enabled")
+	var watch_dryrun = flag.Bool("watch_dryrun", false, "Report changes found by -watch but do not apply them to the index")
 
 	flag.Parse()
 	args := flag.Args()
 
-	if *data == "" {
+	// -cache_size used to be the number of records to cache and quietly
+	// treating an old value as megabytes is a good way to run out of memory
+
+	trigger_set := false
+
+	flag.Visit(func(f *flag.Flag) {
+
+		if f.Name == "cache_size" {
+			panic("-cache_size is no longer supported, use -cache_mb (which is in megabytes) instead")
+		}
+
+		if f.Name == "cache_trigger" {
+			trigger_set = true
+		}
+	})
+
+	if len(data) == 0 {
 		panic("missing data")
 	}
 
-	_, err := os.Stat(*data)
+	for _, source := range data {
+
+		if pip.IsRemote(source) {
+			continue
+		}
+
+		_, err := os.Stat(source)
 
-	if os.IsNotExist(err) {
-		panic("data does not exist")
+		if os.IsNotExist(err) {
+			panic("data does not exist")
+		}
 	}
 
 	runtime.GOMAXPROCS(*procs)
@@ -74,52 +157,191 @@ func main() {
 
 	if *cache_all {
 
-		*cache_size = 0
 		*cache_trigger = 1
+		logger.Status("caching everything, ignoring -cache_mb, -cache_pin_mb, -cache_vertices, -cache_trigger and -cache_triggers")
 
-		mu := new(sync.Mutex)
-		wg := new(sync.WaitGroup)
+	} else if *result_cache > 0 && !trigger_set {
 
-		for _, path := range args {
+		// results are only cached once every record that might be a result
+		// is in the polygon cache (see results.go) and with the default
+		// trigger most localities and neighbourhoods never are
 
-			wg.Add(1)
+		*cache_trigger = 1
+		logger.Status("-result_cache is set so caching records of any size (up to -cache_mb), pass -cache_trigger to change that")
+	}
 
-			go func(path string) {
-				defer wg.Done()
+	var disk_cache *pip.WOFDiskCache
 
-				count := 0
+	if *remote_cache != "" {
 
-				fh, err := os.Open(path)
+		c, c_err := pip.NewDiskCache(*remote_cache, *remote_cache_size*1024*1024)
 
-				if err != nil {
-					logger.Error("failed to open %s for reading, because %v", path, err)
-					os.Exit(1)
-				}
+		if c_err != nil {
+			panic(c_err)
+		}
 
-				scanner := bufio.NewScanner(fh)
+		logger.Status("remote cache %s contains %d records (%d bytes)", *remote_cache, c.Len(), c.Size())
+		disk_cache = c
+	}
 
-				for scanner.Scan() {
-					count += 1
-				}
+	readers := make([]pip.WOFReader, 0)
+
+	for _, source := range data {
 
-				mu.Lock()
-				*cache_size += count
-				mu.Unlock()
+		var r pip.WOFReader
+		var r_err error
 
-			}(path)
+		if pip.IsRemote(source) {
+
+			remote, remote_err := pip.NewRemoteReader(source, *remote_timeout, *remote_retries, disk_cache)
+
+			if remote_err == nil {
+				remote.MaxAge = *remote_maxage
+			}
+
+			r = remote
+			r_err = remote_err
+
+		} else {
+			r, r_err = pip.NewReader(source)
 		}
 
-		wg.Wait()
+		if r_err != nil {
+			panic(r_err)
+		}
 
-		logger.Status("set cache_size to %d and cache_trigger to %d", *cache_size, *cache_trigger)
+		readers = append(readers, r)
 	}
 
-	p, p_err := pip.NewPointInPolygon(*data, *cache_size, *cache_trigger, logger)
+	var reader pip.WOFReader
+
+	if len(readers) == 1 {
+		reader = readers[0]
+	} else {
+		reader = pip.NewMultiReader(readers...)
+	}
+
+	encoding, e_err := pip.CompactEncodingFromString(*cache_encoding)
+
+	if e_err != nil {
+		panic(e_err)
+	}
+
+	p, p_err := pip.NewPointInPolygonWithReader(reader, *cache_mb, *cache_trigger, logger)
 
 	if p_err != nil {
 		panic(p_err)
 	}
 
+	p.CacheEncoding = encoding
+
+	backend, i_err := pip.IndexBackendFromString(*index_backend)
+
+	if i_err != nil {
+		panic(i_err)
+	}
+
+	p.IndexBackend = backend
+	p.Index = pip.NewSpatialIndex(backend)
+	p.PrepareThreshold = *prepare_threshold
+	p.SimplifyTolerance = *simplify
+
+	if *simplify > 0 {
+
+		originals, o_err := pip.NewPolygonCache(pip.CacheMeasureBytes, int64(*simplify_cache)*1024*1024, nil)
+
+		if o_err != nil {
+			panic(o_err)
+		}
+
+		p.Originals = originals
+	}
+
+	rule, b_err := pip.BoundaryRuleFromString(*boundary)
+
+	if b_err != nil {
+		panic(b_err)
+	}
+
+	p.Boundary = rule
+
+	lookup_strategy, s_err := pip.LookupStrategyFromString(*strategy)
+
+	if s_err != nil {
+		panic(s_err)
+	}
+
+	p.Strategy = lookup_strategy
+
+	edge_mode, e_err := pip.EdgeModeFromString(*edges)
+
+	if e_err != nil {
+		panic(e_err)
+	}
+
+	p.Edges = pip.NewEdgePolicy(edge_mode)
+
+	e_err = p.Edges.SetPlacetypes(*edge_placetypes)
+
+	if e_err != nil {
+		panic(e_err)
+	}
+
+	if !*cache_all {
+
+		t_err := p.CachePolicy.SetTriggers(*cache_triggers)
+
+		if t_err != nil {
+			panic(t_err)
+		}
+	}
+
+	p.CachePolicy.Pin(pip.SplitPlacetypes(*cache_pin)...)
+	p.CachePolicy.Exclude(pip.SplitPlacetypes(*cache_exclude)...)
+
+	policy_err := p.CachePolicy.Validate()
+
+	if policy_err != nil {
+		panic(policy_err)
+	}
+
+	if *cache_all || *cache_vertices > 0 {
+
+		measure := pip.CacheMeasureVertices
+		budget := *cache_vertices
+
+		if *cache_all {
+			measure = pip.CacheMeasureBytes
+			budget = math.MaxInt64
+		}
+
+		c, c_err := pip.NewPolygonCache(measure, budget, p.Metrics)
+
+		if c_err != nil {
+			panic(c_err)
+		}
+
+		p.Cache = c
+	}
+
+	if *cache_all {
+		p.Cache.PinBudget = math.MaxInt64
+	} else {
+		p.Cache.PinBudget = int64(*cache_pin_mb) * 1024 * 1024
+	}
+
+	if *geometry_store != "" {
+
+		g, g_err := pip.OpenGeometryStore(*geometry_store)
+
+		if g_err != nil {
+			panic(g_err)
+		}
+
+		logger.Status("geometry store %s contains %d records", *geometry_store, g.Count())
+		p.Geometries = g
+	}
+
 	if *metrics != "" {
 
 		m_file, m_err := os.OpenFile(*metrics, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
@@ -132,6 +354,131 @@ func main() {
 		_ = p.SendMetricsTo(m_writer, 60e9, *format)
 	}
 
+	p.IndexFromMeta = *index_from_meta
+
+	if *result_cache > 0 {
+
+		r, r_err := pip.NewResultCache(*result_precision, *result_cache)
+
+		if r_err != nil {
+			panic(r_err)
+		}
+
+		p.Results = r
+	}
+
+	if *coverage {
+
+		c, c_err := pip.NewCoverage(*coverage_level)
+
+		if c_err != nil {
+			panic(c_err)
+		}
+
+		p.Coverage = c
+	}
+
+	p.Precache.MaxPending = *precache_queue
+	p.Precache.SetWorkers(*precache_workers)
+
+	p.Containment.SetWorkers(*procs)
+
+	var watcher *pip.WOFPointInPolygonWatcher
+
+	if *watch {
+
+		w, w_err := pip.NewPointInPolygonWatcher(p, args, *watch_interval, *watch_dryrun)
+
+		if w_err != nil {
+			panic(w_err)
+		}
+
+		// prime the watcher before we start indexing so that anything that
+		// changes while we're indexing gets picked up by the first sync
+
+		w_err = w.Prime()
+
+		if w_err != nil {
+			panic(w_err)
+		}
+
+		watcher = w
+	}
+
+	// things to do once everything has been indexed
+
+	indexed := func() {
+
+		if watcher != nil {
+			watcher.Start()
+		}
+
+		if p.Coverage != nil {
+
+			// lookups use the Rtree until this is done
+
+			go func() {
+
+				if *coverage_file != "" {
+
+					_, err := os.Stat(*coverage_file)
+
+					if err == nil {
+
+						err = p.LoadCoverage(*coverage_file)
+
+						if err == nil {
+							return
+						}
+
+						p.Logger.Warning("failed to load coverage from %s, building it again, because %s", *coverage_file, err)
+					}
+				}
+
+				_, err := p.BuildCoverage()
+
+				if err != nil {
+					p.Logger.Error("failed to build coverage, because %s", err)
+					return
+				}
+
+				if *coverage_file != "" {
+
+					err = p.SaveCoverage(*coverage_file)
+
+					if err != nil {
+						p.Logger.Error("failed to save coverage to %s, because %s", *coverage_file, err)
+					}
+				}
+			}()
+		}
+
+		if *cache_persist != "" {
+
+			_, err := os.Stat(*cache_persist)
+
+			if err == nil {
+
+				_, err = p.RestoreCache(*cache_persist)
+
+				if err != nil {
+					p.Logger.Error("failed to restore cache from %s, because %s", *cache_persist, err)
+				}
+			}
+		}
+
+		if *precache_from != "" {
+
+			count, err := p.Precache.WarmFromFile(*precache_from)
+
+			if err != nil {
+				p.Logger.Error("failed to read %s, because %s", *precache_from, err)
+			} else {
+				p.Logger.Status("scheduled %d records from %s for pre-caching", count, *precache_from)
+			}
+		}
+	}
+
 	indexing := true
 	ch := make(chan bool)
 
@@ -140,6 +487,54 @@ func main() {
 		indexing = false
 	}()
 
+	// things to do when we're shutting down, which may be triggered by our own signal
+	// handler (below) or by gracehttp so make sure it only happens once
+
+	shutdown := new(sync.Once)
+
+	stopped := func() {
+
+		shutdown.Do(func() {
+
+			// a half-full cache isn't worth overwriting the last snapshot with
+
+			if *cache_persist == "" || indexing {
+				return
+			}
+
+			_, err := p.SaveCache(*cache_persist, *cache_persist_polygons)
+
+			if err != nil {
+				p.Logger.Error("failed to save cache to %s, because %s", *cache_persist, err)
+			}
+		})
+	}
+
+	// Reindexing only touches records whose geometry or properties have changed
+	// so we keep serving requests while it happens
+
+	reindex := make(chan os.Signal, 1)
+	signal.Notify(reindex, syscall.SIGUSR2)
+
+	go func() {
+
+		for range reindex {
+
+			if indexing {
+				p.Logger.Warning("received a request to reindex but we are still indexing, ignoring")
+				continue
+			}
+
+			p.Logger.Status("received a request to reindex")
+
+			_, err := p.Reindex(args...)
+
+			if err != nil {
+				p.Logger.Error("failed to reindex, because %s", err)
+			}
+		}
+	}()
+
 	go func() {
 
 		if *nopid {
@@ -152,7 +547,9 @@ func main() {
 			}
 
 			t2 := float64(time.Since(t1)) / 1e9
-			p.Logger.Status("indexed %d records in %.3f seconds", p.Rtree.Size(), t2)
+			p.Logger.Status("indexed %d records in %.3f seconds", p.Size(), t2)
+
+			indexed()
 
 			ch <- true
 			return
@@ -187,7 +584,9 @@ func main() {
 		}
 
 		t2 := float64(time.Since(t1)) / 1e9
-		p.Logger.Status("indexed %d records in %.3f seconds", p.Rtree.Size(), t2)
+		p.Logger.Status("indexed %d records in %.3f seconds", p.Size(), t2)
+
+		indexed()
 
 		pid := os.Getpid()
 		strpid := strconv.Itoa(pid)
@@ -202,6 +601,8 @@ func main() {
 		go func() {
 			<-sigs
 
+			stopped()
+
 			p.Logger.Status("remove PID file %s", *pidfile)
 
 			os.Remove(*pidfile)
@@ -224,6 +625,8 @@ func main() {
 		str_lon := query.Get("longitude")
 		placetype := query.Get("placetype")
 		excluded := query["exclude"] // see the way we're accessing the map directly to get a list? yeah, that
+		str_shape := query.Get("shape")
+		sort_by := query.Get("sort")
 
 		if str_lat == "" {
 			http.Error(rsp, "Missing latitude parameter", http.StatusBadRequest)
@@ -258,6 +661,25 @@ func main() {
 			return
 		}
 
+		with_shape := false
+
+		if str_shape != "" {
+
+			b, err := strconv.ParseBool(str_shape)
+
+			if err != nil {
+				http.Error(rsp, "Invalid shape parameter", http.StatusBadRequest)
+				return
+			}
+
+			with_shape = b
+		}
+
+		if sort_by != "" && sort_by != "area" && sort_by != "-area" {
+			http.Error(rsp, "Invalid sort parameter", http.StatusBadRequest)
+			return
+		}
+
 		filters := pip.WOFPointInPolygonFilters{}
 
 		if placetype != "" {
@@ -292,7 +714,29 @@ func main() {
 			p.Logger.Debug("time to reverse geocode %f, %f: %d results in %f seconds ", lat, lon, count, ttp)
 		}
 
-		js, err := json.Marshal(results)
+		var shapes []*pip.WOFRecordShape
+
+		if sort_by != "" {
+			results, shapes = p.SortByArea(results, sort_by == "-area")
+		} else if with_shape {
+			shapes = p.GetShapes(results)
+		}
+
+		var rsp_results interface{}
+		rsp_results = results
+
+		if with_shape {
+
+			with_shapes := make([]shapeResult, len(results))
+
+			for i, wof := range results {
+				with_shapes[i] = shapeResult{wof, shapes[i]}
+			}
+
+			rsp_results = with_shapes
+		}
+
+		js, err := json.Marshal(rsp_results)
 
 		if err != nil {
 			http.Error(rsp, err.Error(), http.StatusInternalServerError)
@@ -311,12 +755,43 @@ func main() {
 		rsp.Write(js)
 	}
 
+	sync_handler := func(rsp http.ResponseWriter, req *http.Request) {
+
+		if watcher == nil {
+			http.Error(rsp, "Watching for changes is not enabled", http.StatusNotFound)
+			return
+		}
+
+		status := watcher.Status()
+
+		if status == nil {
+			http.Error(rsp, "No sync has completed yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		js, err := json.Marshal(status)
+
+		if err != nil {
+			http.Error(rsp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if *cors {
+			rsp.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+
+		rsp.Header().Set("Content-Type", "application/json")
+		rsp.Write(js)
+	}
+
 	endpoint := fmt.Sprintf("%s:%d", *host, *port)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", handler)
+	mux.HandleFunc("/sync", sync_handler)
 
 	gracehttp.Serve(&http.Server{Addr: endpoint, Handler: mux})
 
+	stopped()
 	os.Exit(0)
 }
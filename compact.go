@@ -0,0 +1,465 @@
+package pip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	geo "github.com/kellydunn/golang-geo"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"math"
+	"unsafe"
+)
+
+// geojson.WOFPolygon is a list of geo.Polygon rings which are in turn lists of
+// *geo.Point thingies which means one heap allocation per vertex and a lot of
+// pointers for the garbage collector to chase. That adds up quickly for the large
+// polygons we most want to cache. WOFCompactPolygon stores each ring as a single
+// flat array of (longitude, latitude) pairs instead, using one of:
+//
+//	float64 - exactly the same coordinates as the source, 16 bytes per vertex
+//	float32 - 8 bytes per vertex, good to about a metre (worse near the antimeridian)
+//	delta   - coordinates rounded to 1e-7 degrees (about a centimetre) and stored as
+//	          varint encoded differences from the previous vertex, typically 2-6
+//	          bytes per vertex. Slower to test than the other two since every
+//	          vertex has to be decoded.
+
+type WOFCompactEncoding int
+
+const (
+	CompactFloat64 WOFCompactEncoding = iota
+	CompactFloat32
+	CompactDelta
+)
+
+const compactDeltaScale = 1e7
+
+func (e WOFCompactEncoding) String() string {
+
+	switch e {
+	case CompactFloat32:
+		return "float32"
+	case CompactDelta:
+		return "delta"
+	default:
+		return "float64"
+	}
+}
+
+func CompactEncodingFromString(name string) (WOFCompactEncoding, error) {
+
+	switch name {
+	case "", "float64":
+		return CompactFloat64, nil
+	case "float32":
+		return CompactFloat32, nil
+	case "delta":
+		return CompactDelta, nil
+	default:
+		return CompactFloat64, errors.New(fmt.Sprintf("unknown compact encoding '%s', expected float64, float32 or delta", name))
+	}
+}
+
+type WOFCompactRing struct {
+	Encoding WOFCompactEncoding
+	Count    int
+	MinX     float64
+	MinY     float64
+	MaxX     float64
+	MaxY     float64
+	f64      []float64
+	f32      []float32
+	delta    []byte
+	grid     *wofEdgeGrid
+}
+
+type WOFCompactPolygon struct {
+	OuterRing     *WOFCompactRing
+	InteriorRings []*WOFCompactRing
+	interior      []wofInteriorRect
+	tolerance     float64
+}
+
+// NewCompactRing takes a flat list of (longitude, latitude) pairs
+
+func NewCompactRing(coords []float64, encoding WOFCompactEncoding) *WOFCompactRing {
+
+	r := WOFCompactRing{
+		Encoding: encoding,
+		Count:    len(coords) / 2,
+		MinX:     math.Inf(1),
+		MinY:     math.Inf(1),
+		MaxX:     math.Inf(-1),
+		MaxY:     math.Inf(-1),
+	}
+
+	for i := 0; i+1 < len(coords); i += 2 {
+		r.MinX = math.Min(r.MinX, coords[i])
+		r.MaxX = math.Max(r.MaxX, coords[i])
+		r.MinY = math.Min(r.MinY, coords[i+1])
+		r.MaxY = math.Max(r.MaxY, coords[i+1])
+	}
+
+	switch encoding {
+
+	case CompactFloat32:
+
+		r.f32 = make([]float32, r.Count*2)
+
+		for i := 0; i < r.Count*2; i++ {
+			r.f32[i] = float32(coords[i])
+		}
+
+	case CompactDelta:
+
+		buf := make([]byte, 0, r.Count*4)
+		tmp := make([]byte, binary.MaxVarintLen64)
+
+		var last_x, last_y int64
+
+		for i := 0; i < r.Count*2; i += 2 {
+
+			x := int64(math.Round(coords[i] * compactDeltaScale))
+			y := int64(math.Round(coords[i+1] * compactDeltaScale))
+
+			n := binary.PutVarint(tmp, x-last_x)
+			buf = append(buf, tmp[:n]...)
+
+			n = binary.PutVarint(tmp, y-last_y)
+			buf = append(buf, tmp[:n]...)
+
+			last_x = x
+			last_y = y
+		}
+
+		// don't hang on to any spare capacity, that's the whole point
+
+		r.delta = make([]byte, len(buf))
+		copy(r.delta, buf)
+
+	default:
+
+		r.f64 = make([]float64, r.Count*2)
+		copy(r.f64, coords)
+	}
+
+	return &r
+}
+
+func NewCompactPolygon(rings [][]float64, encoding WOFCompactEncoding) *WOFCompactPolygon {
+
+	if len(rings) == 0 {
+		return nil
+	}
+
+	inner := make([]*WOFCompactRing, 0)
+
+	for _, coords := range rings[1:] {
+		inner = append(inner, NewCompactRing(coords, encoding))
+	}
+
+	poly := WOFCompactPolygon{
+		OuterRing:     NewCompactRing(rings[0], encoding),
+		InteriorRings: inner,
+	}
+
+	return &poly
+}
+
+func CompactPolygonsFromRings(rings [][][]float64, encoding WOFCompactEncoding) []*WOFCompactPolygon {
+
+	polygons := make([]*WOFCompactPolygon, 0)
+
+	for _, poly := range rings {
+
+		c := NewCompactPolygon(poly, encoding)
+
+		if c != nil {
+			polygons = append(polygons, c)
+		}
+	}
+
+	return polygons
+}
+
+func CompactPolygons(polygons []*geojson.WOFPolygon, encoding WOFCompactEncoding) []*WOFCompactPolygon {
+
+	compact := make([]*WOFCompactPolygon, 0)
+
+	for _, poly := range polygons {
+
+		rings := make([][]float64, 0)
+		rings = append(rings, flattenRing(poly.OuterRing))
+
+		for _, r := range poly.InteriorRings {
+			rings = append(rings, flattenRing(r))
+		}
+
+		compact = append(compact, NewCompactPolygon(rings, encoding))
+	}
+
+	return compact
+}
+
+// Coords returns the ring as a flat list of (longitude, latitude) pairs, decoding
+// it if necessary
+
+func (r *WOFCompactRing) Coords() []float64 {
+
+	coords := make([]float64, r.Count*2)
+
+	switch r.Encoding {
+
+	case CompactFloat32:
+
+		for i, c := range r.f32 {
+			coords[i] = float64(c)
+		}
+
+	case CompactDelta:
+
+		var x, y int64
+		offset := 0
+
+		for i := 0; i < r.Count*2; i += 2 {
+
+			dx, n := binary.Varint(r.delta[offset:])
+			offset += n
+
+			dy, n := binary.Varint(r.delta[offset:])
+			offset += n
+
+			x += dx
+			y += dy
+
+			coords[i] = float64(x) / compactDeltaScale
+			coords[i+1] = float64(y) / compactDeltaScale
+		}
+
+	default:
+		copy(coords, r.f64)
+	}
+
+	return coords
+}
+
+// Contains returns true if the point is inside the ring using the half-open rule
+// (see contains.go); longitude is X and latitude is Y
+
+func (r *WOFCompactRing) Contains(lat float64, lon float64) bool {
+
+	inside, _ := r.Locate(lat, lon, false)
+	return inside
+}
+
+// Locate runs the even-odd ray casting test for a point, returning whether it is
+// inside the ring according to the half-open rule and, if check_boundary is true,
+// whether it is exactly on one of the ring's edges.
+
+func (r *WOFCompactRing) Locate(lat float64, lon float64, check_boundary bool) (bool, bool) {
+
+	if r.Count < 3 {
+		return false, false
+	}
+
+	if lon < r.MinX || lon > r.MaxX || lat < r.MinY || lat > r.MaxY {
+		return false, false
+	}
+
+	t := ringTest{
+		lat:            lat,
+		lon:            lon,
+		check_boundary: check_boundary,
+	}
+
+	if r.grid != nil {
+		r.locatePrepared(&t)
+		return t.inside, t.boundary
+	}
+
+	switch r.Encoding {
+
+	case CompactFloat32:
+
+		c := r.f32
+		j := r.Count - 1
+
+		for i := 0; i < r.Count; i++ {
+			t.edge(float64(c[i*2]), float64(c[i*2+1]), float64(c[j*2]), float64(c[j*2+1]))
+			j = i
+		}
+
+	case CompactDelta:
+
+		// we don't know what the last vertex is until we get there so
+		// the closing edge is checked after the loop
+
+		var x, y int64
+		var first_x, first_y, prev_x, prev_y float64
+
+		offset := 0
+
+		for i := 0; i < r.Count; i++ {
+
+			dx, n := binary.Varint(r.delta[offset:])
+			offset += n
+
+			dy, n := binary.Varint(r.delta[offset:])
+			offset += n
+
+			x += dx
+			y += dy
+
+			cur_x := float64(x) / compactDeltaScale
+			cur_y := float64(y) / compactDeltaScale
+
+			if i == 0 {
+				first_x = cur_x
+				first_y = cur_y
+			} else {
+				t.edge(cur_x, cur_y, prev_x, prev_y)
+			}
+
+			prev_x = cur_x
+			prev_y = cur_y
+		}
+
+		t.edge(first_x, first_y, prev_x, prev_y)
+
+	default:
+
+		c := r.f64
+		j := r.Count - 1
+
+		for i := 0; i < r.Count; i++ {
+			t.edge(c[i*2], c[i*2+1], c[j*2], c[j*2+1])
+			j = i
+		}
+	}
+
+	return t.inside, t.boundary
+}
+
+// Size returns the (approximate) number of bytes used by the ring
+
+func (r *WOFCompactRing) Size() int {
+
+	size := int(unsafe.Sizeof(*r))
+
+	size += cap(r.f64) * 8
+	size += cap(r.f32) * 4
+	size += cap(r.delta)
+
+	if r.grid != nil {
+		size += r.grid.size()
+	}
+
+	return size
+}
+
+// Contains returns true if the point is inside the polygon, and not inside any of
+// its holes, using the half-open rule
+
+func (p *WOFCompactPolygon) Contains(lat float64, lon float64) bool {
+	return p.ContainsWithRule(lat, lon, BoundaryHalfOpen)
+}
+
+func (p *WOFCompactPolygon) ContainsWithRule(lat float64, lon float64, rule WOFBoundaryRule) bool {
+	return p.ContainsWithEdges(lat, lon, rule, EdgePlanar)
+}
+
+// ContainsWithEdges is ContainsWithRule for polygons whose edges are the given shape,
+// see edges.go
+
+func (p *WOFCompactPolygon) ContainsWithEdges(lat float64, lon float64, rule WOFBoundaryRule, edges WOFEdgeMode) bool {
+
+	check_boundary := rule != BoundaryHalfOpen
+
+	inside, boundary := p.OuterRing.LocateWithEdges(lat, lon, check_boundary, edges)
+
+	if boundary {
+		return rule == BoundaryInclusive
+	}
+
+	if !inside {
+		return false
+	}
+
+	for _, r := range p.InteriorRings {
+
+		inside, boundary := r.LocateWithEdges(lat, lon, check_boundary, edges)
+
+		if boundary {
+			return rule == BoundaryInclusive
+		}
+
+		if inside {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *WOFCompactPolygon) CountPoints() int {
+
+	count := p.OuterRing.Count
+
+	for _, r := range p.InteriorRings {
+		count += r.Count
+	}
+
+	return count
+}
+
+func (p *WOFCompactPolygon) Size() int {
+
+	size := int(unsafe.Sizeof(*p)) + p.OuterRing.Size()
+
+	for _, r := range p.InteriorRings {
+		size += int(unsafe.Sizeof(r)) + r.Size()
+	}
+
+	size += p.interiorSize()
+
+	return size
+}
+
+// ToPolygon converts a compact polygon back in to a geojson.WOFPolygon, for things
+// that still want one of those
+
+func (p *WOFCompactPolygon) ToPolygon() *geojson.WOFPolygon {
+
+	to_ring := func(r *WOFCompactRing) geo.Polygon {
+
+		ring := geo.Polygon{}
+		coords := r.Coords()
+
+		for i := 0; i < len(coords); i += 2 {
+			ring.Add(geo.NewPoint(coords[i+1], coords[i]))
+		}
+
+		return ring
+	}
+
+	inner := make([]geo.Polygon, 0)
+
+	for _, r := range p.InteriorRings {
+		inner = append(inner, to_ring(r))
+	}
+
+	return &geojson.WOFPolygon{
+		OuterRing:     to_ring(p.OuterRing),
+		InteriorRings: inner,
+	}
+}
+
+func CompactPolygonsSize(polygons []*WOFCompactPolygon) int {
+
+	size := 0
+
+	for _, poly := range polygons {
+		size += int(unsafe.Sizeof(poly)) + poly.Size()
+	}
+
+	return size
+}
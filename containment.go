@@ -0,0 +1,244 @@
+package pip
+
+import (
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// WOFContainmentPool is a fixed number of workers shared by every lookup for checking
+// candidates in parallel. EnsureContained used to start a goroutine for every
+// candidate (and before that another one for every polygon) which, with enough
+// concurrent requests, meant thousands of goroutines all competing for the same few
+// CPUs; see the note about WaitGroups in EnsureContained.
+//
+// A lookup doesn't queue its candidates and wait for them. Instead the goroutine
+// doing the lookup works its way through them and hands the same list to as many
+// idle workers as there are, which take the next unchecked candidate until there
+// aren't any left. If every worker is busy the lookup just checks everything itself,
+// so a lookup never waits for a worker and at most Workers() + the number of
+// concurrent lookups goroutines are ever checking polygons.
+
+type WOFContainmentPool struct {
+	workers int
+	running int
+	jobs    chan *wofContainmentJob
+	mu      *sync.Mutex
+}
+
+type wofContainmentJob struct {
+	next  int64
+	count int
+	check func(i int)
+	wg    *sync.WaitGroup
+}
+
+func NewContainmentPool(workers int) *WOFContainmentPool {
+
+	q := WOFContainmentPool{
+		jobs: make(chan *wofContainmentJob),
+		mu:   new(sync.Mutex),
+	}
+
+	q.SetWorkers(workers)
+	return &q
+}
+
+// SetWorkers changes the number of workers, starting new ones or telling extra ones
+// to exit once they've finished whatever they are doing
+
+func (q *WOFContainmentPool) SetWorkers(workers int) {
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.workers = workers
+
+	for q.running < q.workers {
+		q.running += 1
+		go q.work()
+	}
+
+	for q.running > q.workers {
+		q.running -= 1
+		go func() { q.jobs <- nil }()
+	}
+}
+
+func (q *WOFContainmentPool) Workers() int {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.workers
+}
+
+func (q *WOFContainmentPool) work() {
+
+	for job := range q.jobs {
+
+		if job == nil {
+			return
+		}
+
+		job.run()
+		job.wg.Done()
+	}
+}
+
+func (j *wofContainmentJob) run() {
+
+	for {
+
+		i := int(atomic.AddInt64(&j.next, 1) - 1)
+
+		if i >= j.count {
+			return
+		}
+
+		j.check(i)
+	}
+}
+
+// Run calls check(i) exactly once for every i from 0 to count - 1, roughly in that
+// order, using any idle workers, and returns once they've all finished. A nil pool
+// calls them one after the other.
+
+func (q *WOFContainmentPool) Run(count int, check func(i int)) {
+
+	job := wofContainmentJob{
+		count: count,
+		check: check,
+		wg:    new(sync.WaitGroup),
+	}
+
+	if q != nil && count > 1 {
+
+		helpers := count - 1
+		workers := q.Workers()
+
+		if helpers > workers {
+			helpers = workers
+		}
+
+		for h := 0; h < helpers; h++ {
+
+			job.wg.Add(1)
+
+			select {
+			case q.jobs <- &job:
+				continue
+			default:
+				job.wg.Done()
+			}
+
+			// nobody is waiting so there's no point asking again
+			break
+		}
+	}
+
+	job.run()
+	job.wg.Wait()
+}
+
+// orderCandidates returns the order in which to check a set of candidates: the ones
+// whose polygons are already in the cache first, fewest vertices first, and then the
+// ones that need to be read. Loading a record can evict others from the cache so it's
+// better to check the cached ones before that happens than to read them again.
+
+func (p WOFPointInPolygon) orderCandidates(results []*geojson.WOFSpatial) []int {
+
+	order := make([]int, len(results))
+	costs := make([]int, len(results))
+
+	for i, wof := range results {
+
+		order[i] = i
+		costs[i] = math.MaxInt32
+
+		if p.Cache == nil {
+			continue
+		}
+
+		polygons, ok := p.Cache.Peek(wof.Id)
+
+		if !ok {
+			continue
+		}
+
+		cost := 0
+
+		for _, poly := range polygons {
+			cost += poly.CountPoints()
+		}
+
+		costs[i] = cost
+	}
+
+	sort.SliceStable(order, func(a int, b int) bool {
+		return costs[order[a]] < costs[order[b]]
+	})
+
+	return order
+}
+
+// orderPolygons returns the polygons of a record that might contain a point, the ones
+// most likely to contain it first: anything with an interior rectangle around the
+// point and then biggest bounding box first. Polygons whose bounding box doesn't
+// contain the point are left out. Interior rectangles assume planar edges so they're
+// ignored for geodesic ones.
+
+func orderPolygons(polygons []*WOFCompactPolygon, lat float64, lon float64, edges WOFEdgeMode) []*WOFCompactPolygon {
+
+	if len(polygons) < 2 {
+		return polygons
+	}
+
+	ordered := make([]*WOFCompactPolygon, 0, len(polygons))
+	likely := make([]float64, 0, len(polygons))
+
+	for _, poly := range polygons {
+
+		if !poly.MightContain(lat, lon, edges) {
+			continue
+		}
+
+		r := poly.OuterRing
+		area := (r.MaxX - r.MinX) * (r.MaxY - r.MinY)
+
+		if edges == EdgePlanar && poly.HasInteriorRects() && poly.InInteriorRect(lat, lon) {
+			area = math.Inf(1)
+		}
+
+		ordered = append(ordered, poly)
+		likely = append(likely, area)
+	}
+
+	sort.Stable(wofLikelyPolygons{ordered, likely})
+
+	return ordered
+}
+
+type wofLikelyPolygons struct {
+	polygons []*WOFCompactPolygon
+	likely   []float64
+}
+
+func (l wofLikelyPolygons) Len() int {
+	return len(l.polygons)
+}
+
+func (l wofLikelyPolygons) Less(i int, j int) bool {
+	return l.likely[i] > l.likely[j]
+}
+
+func (l wofLikelyPolygons) Swap(i int, j int) {
+	l.polygons[i], l.polygons[j] = l.polygons[j], l.polygons[i]
+	l.likely[i], l.likely[j] = l.likely[j], l.likely[i]
+}
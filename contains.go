@@ -0,0 +1,332 @@
+package pip
+
+import (
+	"errors"
+	"fmt"
+	geo "github.com/kellydunn/golang-geo"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+)
+
+// Points that are exactly on the edge of a polygon (or one of its holes) are a matter
+// of opinion, so WOFBoundaryRule makes that opinion explicit:
+//
+//	half-open - the default. A point on an edge belongs to exactly one of the two
+//	            polygons that share it: roughly speaking the left and bottom edges of
+//	            a polygon are inside it and the right and top edges are not. This is
+//	            what the even-odd ray cast does anyway as long as both polygons work
+//	            out where the edge is in exactly the same way, which crossesRay
+//	            makes sure of. Adjacent polygons never both claim a point.
+//	inclusive - a point on the edge of the polygon, or one of its holes, is inside
+//	exclusive - a point on the edge of the polygon, or one of its holes, is outside
+//
+// "Exactly" means in float64 arithmetic; there is no tolerance, so a point that is a
+// nanometre off an edge is treated like any other point. Note that coordinates in
+// polygons using the float32 or delta encodings have been rounded.
+//
+// A point inside a hole is always outside the polygon, as is anything tested against
+// a ring with fewer than three vertices.
+
+type WOFBoundaryRule int
+
+const (
+	BoundaryHalfOpen WOFBoundaryRule = iota
+	BoundaryInclusive
+	BoundaryExclusive
+)
+
+func (b WOFBoundaryRule) String() string {
+
+	switch b {
+	case BoundaryInclusive:
+		return "inclusive"
+	case BoundaryExclusive:
+		return "exclusive"
+	default:
+		return "half-open"
+	}
+}
+
+func BoundaryRuleFromString(name string) (WOFBoundaryRule, error) {
+
+	switch name {
+	case "", "half-open":
+		return BoundaryHalfOpen, nil
+	case "inclusive":
+		return BoundaryInclusive, nil
+	case "exclusive":
+		return BoundaryExclusive, nil
+	default:
+		return BoundaryHalfOpen, errors.New(fmt.Sprintf("unknown boundary rule '%s', expected half-open, inclusive or exclusive", name))
+	}
+}
+
+// ringTest accumulates the result of testing a point against every edge of a ring;
+// it doesn't care what order the edges are visited in
+
+type ringTest struct {
+	lat            float64
+	lon            float64
+	check_boundary bool
+	inside         bool
+	boundary       bool
+}
+
+func (t *ringTest) edge(x1 float64, y1 float64, x2 float64, y2 float64) {
+
+	if t.check_boundary && !t.boundary && onSegment(t.lat, t.lon, x1, y1, x2, y2) {
+		t.boundary = true
+	}
+
+	if crossesRay(t.lat, t.lon, x1, y1, x2, y2) {
+		t.inside = !t.inside
+	}
+}
+
+// crossesRay returns true if the edge (x1, y1) - (x2, y2) crosses a ray cast from
+// the point (lon, lat) towards positive X. An edge's lower vertex counts as being
+// on the edge and its upper vertex doesn't, so a ray through a vertex is counted
+// once (or not at all, if it just touches it) rather than twice.
+
+func crossesRay(lat float64, lon float64, x1 float64, y1 float64, x2 float64, y2 float64) bool {
+
+	if (y1 > lat) == (y2 > lat) {
+		return false
+	}
+
+	// always work out where the ray crosses from the lower vertex so that an
+	// edge shared by two polygons, and so walked in opposite directions, gives
+	// exactly the same answer for both of them
+
+	if y1 > y2 {
+		x1, y1, x2, y2 = x2, y2, x1, y1
+	}
+
+	return lon < (x2-x1)*(lat-y1)/(y2-y1)+x1
+}
+
+// onSegment returns true if the point (lon, lat) is exactly on the edge
+// (x1, y1) - (x2, y2), including its vertices
+
+func onSegment(lat float64, lon float64, x1 float64, y1 float64, x2 float64, y2 float64) bool {
+
+	if y1 > y2 || (y1 == y2 && x1 > x2) {
+		x1, y1, x2, y2 = x2, y2, x1, y1
+	}
+
+	if lat < y1 || lat > y2 {
+		return false
+	}
+
+	if (lon < x1 && lon < x2) || (lon > x1 && lon > x2) {
+		return false
+	}
+
+	return (x2-x1)*(lat-y1) == (y2-y1)*(lon-x1)
+}
+
+// ContainsPolygon is a replacement for geojson.WOFPolygon.Contains which checks
+// holes in separate goroutines that all write to the same variable, and which
+// doesn't agree with itself about points on an edge. It tests the polygon the same
+// way WOFCompactPolygon does without copying it.
+
+func ContainsPolygon(poly *geojson.WOFPolygon, lat float64, lon float64, rule WOFBoundaryRule) bool {
+
+	check_boundary := rule != BoundaryHalfOpen
+
+	inside, boundary := locateRing(poly.OuterRing.Points(), lat, lon, check_boundary)
+
+	if boundary {
+		return rule == BoundaryInclusive
+	}
+
+	if !inside {
+		return false
+	}
+
+	for _, r := range poly.InteriorRings {
+
+		inside, boundary := locateRing(r.Points(), lat, lon, check_boundary)
+
+		if boundary {
+			return rule == BoundaryInclusive
+		}
+
+		if inside {
+			return false
+		}
+	}
+
+	return true
+}
+
+func locateRing(points []*geo.Point, lat float64, lon float64, check_boundary bool) (bool, bool) {
+
+	count := len(points)
+
+	if count < 3 {
+		return false, false
+	}
+
+	t := ringTest{
+		lat:            lat,
+		lon:            lon,
+		check_boundary: check_boundary,
+	}
+
+	j := count - 1
+
+	for i := 0; i < count; i++ {
+		t.edge(points[i].Lng(), points[i].Lat(), points[j].Lng(), points[j].Lat())
+		j = i
+	}
+
+	return t.inside, t.boundary
+}
+
+// IntersectsBox returns true if any edge of the polygon, or one of its holes, touches
+// the box. If it doesn't then every point in the box is inside the polygon or every
+// point in it is outside, whatever the boundary rule.
+
+func (p *WOFCompactPolygon) IntersectsBox(swlat float64, swlon float64, nelat float64, nelon float64) bool {
+
+	// the original edges of a simplified polygon are somewhere within its
+	// tolerance of the simplified ones
+
+	if p.tolerance > 0 {
+
+		band := p.tolerance * simplifyBandSlack
+
+		swlat -= band
+		swlon -= band
+		nelat += band
+		nelon += band
+	}
+
+	if p.OuterRing.IntersectsBox(swlat, swlon, nelat, nelon) {
+		return true
+	}
+
+	for _, r := range p.InteriorRings {
+
+		if r.IntersectsBox(swlat, swlon, nelat, nelon) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *WOFCompactRing) IntersectsBox(swlat float64, swlon float64, nelat float64, nelon float64) bool {
+
+	if r.Count == 0 {
+		return false
+	}
+
+	if nelon < r.MinX || swlon > r.MaxX || nelat < r.MinY || swlat > r.MaxY {
+		return false
+	}
+
+	edge := func(i int, j int, coords []float64) bool {
+
+		if coords != nil {
+			return segmentIntersectsBox(coords[i*2], coords[i*2+1], coords[j*2], coords[j*2+1], swlat, swlon, nelat, nelon)
+		}
+
+		x1, y1 := r.vertex(i)
+		x2, y2 := r.vertex(j)
+
+		return segmentIntersectsBox(x1, y1, x2, y2, swlat, swlon, nelat, nelon)
+	}
+
+	prev := func(i int) int {
+
+		if i == 0 {
+			return r.Count - 1
+		}
+
+		return i - 1
+	}
+
+	// any edge that touches the box crosses one of the bands the box does
+
+	if r.grid != nil {
+
+		g := r.grid
+
+		for b := g.band(swlat); b <= g.band(nelat); b++ {
+
+			for _, e := range g.edges[g.offsets[b]:g.offsets[b+1]] {
+
+				i := int(e)
+
+				if edge(i, prev(i), nil) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	var coords []float64
+
+	if r.Encoding == CompactDelta {
+		coords = r.Coords()
+	}
+
+	for i := 0; i < r.Count; i++ {
+
+		if edge(i, prev(i), coords) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// segmentIntersectsBox returns true if any part of the segment (x1, y1) - (x2, y2),
+// including its ends, is inside (or on the edge of) the box. It clips the segment
+// against each side of the box in turn (Liang-Barsky).
+
+func segmentIntersectsBox(x1 float64, y1 float64, x2 float64, y2 float64, swlat float64, swlon float64, nelat float64, nelon float64) bool {
+
+	dx := x2 - x1
+	dy := y2 - y1
+
+	t0 := 0.0
+	t1 := 1.0
+
+	clip := func(p float64, q float64) bool {
+
+		if p == 0 {
+			return q >= 0
+		}
+
+		t := q / p
+
+		if p < 0 {
+
+			if t > t1 {
+				return false
+			}
+
+			if t > t0 {
+				t0 = t
+			}
+
+		} else {
+
+			if t < t0 {
+				return false
+			}
+
+			if t < t1 {
+				t1 = t
+			}
+		}
+
+		return true
+	}
+
+	return clip(-dx, x1-swlon) && clip(dx, nelon-x1) && clip(-dy, y1-swlat) && clip(dy, nelat-y1)
+}
@@ -0,0 +1,266 @@
+package pip
+
+import (
+	"strings"
+	"testing"
+)
+
+// A set of awkward points (on edges, on vertices, in holes, lined up with vertices)
+// and awkward polygons (adjacent, degenerate, wound the wrong way) that every way we
+// have of testing containment needs to agree about, for every boundary rule.
+
+type containsPolygon struct {
+	Name  string
+	Rings [][]float64
+}
+
+// a point that we know the answer for, for each rule, in a single polygon
+
+type containsCase struct {
+	Polygon   string
+	Lat       float64
+	Lon       float64
+	Inclusive bool
+	Exclusive bool
+	HalfOpen  bool
+}
+
+// a point on the edge (or corner) of some adjacent polygons, exactly one of which
+// should claim it using the half-open rule
+
+type containsShared struct {
+	Lat      float64
+	Lon      float64
+	Polygons []string
+}
+
+func testSquare(minx float64, miny float64, maxx float64, maxy float64) []float64 {
+	return []float64{minx, miny, maxx, miny, maxx, maxy, minx, maxy, minx, miny}
+}
+
+func testReverse(coords []float64) []float64 {
+
+	rev := make([]float64, 0)
+
+	for i := len(coords) - 2; i >= 0; i -= 2 {
+		rev = append(rev, coords[i], coords[i+1])
+	}
+
+	return rev
+}
+
+var containsPolygons = []containsPolygon{
+	// a 2x2 grid of squares meeting at 10,10; 'a' has a hole and 'hole' fills it
+	{"a", [][]float64{testSquare(0, 0, 10, 10), testSquare(4, 4, 6, 6)}},
+	{"b", [][]float64{testSquare(10, 0, 20, 10)}},
+	{"c", [][]float64{testSquare(0, 10, 10, 20)}},
+	{"d", [][]float64{testSquare(10, 10, 20, 20)}},
+	{"hole", [][]float64{testSquare(4, 4, 6, 6)}},
+	// 'a' again but wound clockwise and without a closing vertex
+	{"a-cw", [][]float64{testReverse(testSquare(0, 0, 10, 10))[2:], testReverse(testSquare(4, 4, 6, 6))}},
+	// 'b' again with duplicate vertices
+	{"b-dupes", [][]float64{{10, 0, 10, 0, 20, 0, 20, 10, 20, 10, 10, 10, 10, 0}}},
+	// a diamond, so rays run through vertices
+	{"diamond", [][]float64{{5, 0, 10, 5, 5, 10, 0, 5, 5, 0}}},
+	// a triangle with a zero-width spike sticking out of the top
+	{"spike", [][]float64{{0, 0, 10, 0, 5, 10, 5, 15, 5, 10, 0, 0}}},
+	// things that aren't really polygons
+	{"line", [][]float64{{0, 0, 5, 0, 10, 0, 0, 0}}},
+	{"two-points", [][]float64{{0, 0, 10, 10}}},
+}
+
+var containsCases = []containsCase{
+	// somewhere in the middle, nothing to see here
+	{"a", 2, 2, true, true, true},
+	{"a-cw", 2, 2, true, true, true},
+	// in the hole
+	{"a", 5, 5, false, false, false},
+	{"a-cw", 5, 5, false, false, false},
+	{"hole", 5, 5, true, true, true},
+	// outside everything
+	{"a", -1, -1, false, false, false},
+	{"a", 5, 21, false, false, false},
+	// on the outer edges (left, bottom, right, top) of 'a'
+	{"a", 5, 0, true, false, true},
+	{"a", 0, 5, true, false, true},
+	{"a", 5, 10, true, false, false},
+	{"a", 10, 5, true, false, false},
+	{"a-cw", 5, 0, true, false, true},
+	{"a-cw", 10, 5, true, false, false},
+	// on the edges of the hole, which are the opposite way round
+	{"a", 5, 4, true, false, false},
+	{"a", 5, 6, true, false, true},
+	{"a", 4, 5, true, false, false},
+	{"a", 6, 5, true, false, true},
+	// rays that run along a horizontal edge, before and after it
+	{"a", 0, -1, false, false, false},
+	{"a", 10, -1, false, false, false},
+	{"a", 0, 11, false, false, false},
+	{"a", 4, 2, true, true, true},
+	{"a", 6, 8, true, true, true},
+	// on the corners of 'a' and its hole
+	{"a", 0, 0, true, false, true},
+	{"a", 10, 10, true, false, false},
+	{"a", 4, 4, true, false, false},
+	{"a", 6, 6, true, false, true},
+	// duplicate vertices shouldn't make a difference
+	{"b-dupes", 5, 15, true, true, true},
+	{"b-dupes", 0, 15, true, false, true},
+	{"b-dupes", 10, 15, true, false, false},
+	// rays that run through a vertex (or two)
+	{"diamond", 5, 2, true, true, true},
+	{"diamond", 5, 8, true, true, true},
+	{"diamond", 5, -1, false, false, false},
+	{"diamond", 5, 11, false, false, false},
+	{"diamond", 0, 5, true, false, false},
+	{"diamond", 10, 5, true, false, false},
+	{"diamond", 5, 0, true, false, true},
+	// the spike is a zero-width part of the polygon so points on it are only
+	// ever inside if they're on its boundary
+	{"spike", 12, 5, true, false, false},
+	{"spike", 12, 4, false, false, false},
+	{"spike", 2, 3, true, true, true},
+	{"spike", 6, 4, true, true, true},
+	// degenerate rings have no inside, only (maybe) an edge
+	{"line", 0, 5, true, false, false},
+	{"line", 1, 5, false, false, false},
+	{"two-points", 5, 5, false, false, false},
+}
+
+var containsSharedCases = []containsShared{
+	{5, 10, []string{"a", "b"}},
+	{10, 5, []string{"a", "c"}},
+	{10, 15, []string{"b", "d"}},
+	{15, 10, []string{"c", "d"}},
+	{10, 10, []string{"a", "b", "c", "d"}},
+	{0, 10, []string{"a", "b"}},
+	{10, 0, []string{"a", "c"}},
+	{5, 4, []string{"a", "hole"}},
+	{4, 5, []string{"a", "hole"}},
+	{4, 4, []string{"a", "hole"}},
+	{6, 6, []string{"a", "hole"}},
+	{5, 10, []string{"a-cw", "b-dupes"}},
+}
+
+// every way we have of asking "is this point in this polygon?"
+
+type containsEngine struct {
+	Name     string
+	Contains func(rings [][]float64, lat float64, lon float64, rule WOFBoundaryRule) bool
+}
+
+func compactEngine(encoding WOFCompactEncoding, prepare bool) func([][]float64, float64, float64, WOFBoundaryRule) bool {
+
+	return func(rings [][]float64, lat float64, lon float64, rule WOFBoundaryRule) bool {
+
+		poly := NewCompactPolygon(rings, encoding)
+
+		if prepare {
+			poly.Prepare(1)
+		}
+
+		return poly.ContainsWithRule(lat, lon, rule)
+	}
+}
+
+var containsEngines = []containsEngine{
+	{"float64", compactEngine(CompactFloat64, false)},
+	{"float32", compactEngine(CompactFloat32, false)},
+	{"delta", compactEngine(CompactDelta, false)},
+	{"float64 (prepared)", compactEngine(CompactFloat64, true)},
+	{"float32 (prepared)", compactEngine(CompactFloat32, true)},
+	{"float64 (interior rectangles)", func(rings [][]float64, lat float64, lon float64, rule WOFBoundaryRule) bool {
+		poly := NewCompactPolygon(rings, CompactFloat64)
+		poly.Prepare(1)
+		return poly.InInteriorRect(lat, lon) || poly.ContainsWithRule(lat, lon, rule)
+	}},
+	{"geojson", func(rings [][]float64, lat float64, lon float64, rule WOFBoundaryRule) bool {
+		poly := NewCompactPolygon(rings, CompactFloat64).ToPolygon()
+		return ContainsPolygon(poly, lat, lon, rule)
+	}},
+}
+
+func containsLookup() map[string][][]float64 {
+
+	lookup := make(map[string][][]float64)
+
+	for _, p := range containsPolygons {
+		lookup[p.Name] = p.Rings
+	}
+
+	return lookup
+}
+
+func TestContainsWithRule(t *testing.T) {
+
+	lookup := containsLookup()
+
+	for _, e := range containsEngines {
+
+		t.Run(e.Name, func(t *testing.T) {
+
+			for _, c := range containsCases {
+
+				expected := map[WOFBoundaryRule]bool{
+					BoundaryInclusive: c.Inclusive,
+					BoundaryExclusive: c.Exclusive,
+					BoundaryHalfOpen:  c.HalfOpen,
+				}
+
+				for rule, want := range expected {
+
+					got := e.Contains(lookup[c.Polygon], c.Lat, c.Lon, rule)
+
+					if got != want {
+						t.Errorf("%f,%f in '%s' (%s) is %t, expected %t", c.Lat, c.Lon, c.Polygon, rule, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestContainsSharedEdges(t *testing.T) {
+
+	lookup := containsLookup()
+
+	for _, e := range containsEngines {
+
+		t.Run(e.Name, func(t *testing.T) {
+
+			for _, s := range containsSharedCases {
+
+				claimed := make([]string, 0)
+
+				for _, name := range s.Polygons {
+
+					if e.Contains(lookup[name], s.Lat, s.Lon, BoundaryHalfOpen) {
+						claimed = append(claimed, name)
+					}
+				}
+
+				if len(claimed) != 1 {
+					t.Errorf("%f,%f is claimed by [%s] out of [%s], expected exactly one", s.Lat, s.Lon, strings.Join(claimed, ","), strings.Join(s.Polygons, ","))
+				}
+			}
+		})
+	}
+}
+
+func TestBoundaryRuleFromString(t *testing.T) {
+
+	for _, rule := range []WOFBoundaryRule{BoundaryHalfOpen, BoundaryInclusive, BoundaryExclusive} {
+
+		got, err := BoundaryRuleFromString(rule.String())
+
+		if err != nil || got != rule {
+			t.Errorf("'%s' parsed as %s (%v)", rule, got, err)
+		}
+	}
+
+	_, err := BoundaryRuleFromString("sideways")
+
+	if err == nil {
+		t.Errorf("an unknown rule should be an error")
+	}
+}
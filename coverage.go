@@ -0,0 +1,865 @@
+package pip
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Coverage is an optional, precomputed answer to "what's here?" for a fixed grid of
+// cells covering the world. At level L the world is split in to 2^(L+1) columns and
+// 2^L rows of square cells (so at level 10 a cell is about 0.18 degrees on a side)
+// and for each cell we record:
+//
+//	full    - the records that entirely cover the cell, which contain every point
+//	          in it whatever the boundary rule
+//	partial - the records with an edge in, or near, the cell which still need to
+//	          be checked with EnsureContained
+//
+// Records whose bounding box touches a cell but which are nowhere near it aren't
+// listed at all. The cells are worked out the same way as interior rectangles (see
+// classifyCells in interior.go) so no cell is ever "full" by mistake.
+//
+// Every level is four times as many cells as the one before and, roughly, four
+// times the memory. Cells with nothing in them aren't stored. Records whose bounding
+// box would cover more than coverageMaxCells cells are kept in a separate list and
+// treated as partial everywhere in their bounding box.
+//
+// When a record is indexed, changed or removed after the coverage has been built the
+// cells its (old and new) bounding box touches are marked as stale and lookups in
+// those cells fall back to the Rtree until the coverage is built again.
+
+const CoverageMinLevel = 1
+const CoverageMaxLevel = 16
+
+const DefaultCoverageLevel = 10
+
+const coverageMaxCells = 1 << 22
+
+const coverageMagic = "WOFCOV01"
+
+type wofCoverageCell struct {
+	Full    []int
+	Partial []int
+}
+
+type wofCoverageWide struct {
+	Id     int
+	MinLat float64
+	MinLon float64
+	MaxLat float64
+	MaxLon float64
+}
+
+type WOFCoverage struct {
+	Level       int
+	Fingerprint string
+	cells       map[uint64]*wofCoverageCell
+	stale       map[uint64]bool
+	wide        []wofCoverageWide
+	built       bool
+	mu          *sync.RWMutex
+}
+
+func NewCoverage(level int) (*WOFCoverage, error) {
+
+	if level < CoverageMinLevel || level > CoverageMaxLevel {
+		return nil, errors.New(fmt.Sprintf("invalid coverage level %d, expected a number between %d and %d", level, CoverageMinLevel, CoverageMaxLevel))
+	}
+
+	c := WOFCoverage{
+		Level: level,
+		cells: make(map[uint64]*wofCoverageCell),
+		stale: make(map[uint64]bool),
+		wide:  make([]wofCoverageWide, 0),
+		mu:    new(sync.RWMutex),
+	}
+
+	return &c, nil
+}
+
+// CellSize returns the width (and height) of a cell in degrees
+
+func (c *WOFCoverage) CellSize() float64 {
+	return 180.0 / float64(int(1)<<uint(c.Level))
+}
+
+func (c *WOFCoverage) columns() int {
+	return 1 << uint(c.Level+1)
+}
+
+func (c *WOFCoverage) rows() int {
+	return 1 << uint(c.Level)
+}
+
+func (c *WOFCoverage) column(lon float64) int {
+	return coverageClamp(int(math.Floor((lon+180.0)/c.CellSize())), c.columns())
+}
+
+func (c *WOFCoverage) row(lat float64) int {
+	return coverageClamp(int(math.Floor((lat+90.0)/c.CellSize())), c.rows())
+}
+
+func coverageClamp(i int, n int) int {
+
+	if i < 0 {
+		return 0
+	}
+
+	if i >= n {
+		return n - 1
+	}
+
+	return i
+}
+
+func coverageKey(cx int, cy int) uint64 {
+	return uint64(cy)<<32 | uint64(cx)
+}
+
+// Lookup returns the records that fully cover, and partly cover, the cell that
+// (lat, lon) falls in. If ok is false the coverage hasn't been built yet or the
+// cell is stale and the caller should do a normal lookup instead.
+
+func (c *WOFCoverage) Lookup(lat float64, lon float64) ([]int, []int, bool) {
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.built {
+		return nil, nil, false
+	}
+
+	key := coverageKey(c.column(lon), c.row(lat))
+
+	if c.stale[key] {
+		return nil, nil, false
+	}
+
+	full := make([]int, 0)
+	partial := make([]int, 0)
+
+	cell, ok := c.cells[key]
+
+	if ok {
+		full = append(full, cell.Full...)
+		partial = append(partial, cell.Partial...)
+	}
+
+	for _, w := range c.wide {
+
+		if lat >= w.MinLat && lat <= w.MaxLat && lon >= w.MinLon && lon <= w.MaxLon {
+			partial = append(partial, w.Id)
+		}
+	}
+
+	return full, partial, true
+}
+
+// Invalidate marks every cell that the bounding box touches as stale
+
+func (c *WOFCoverage) Invalidate(spatial *geojson.WOFSpatial) {
+
+	min_lat, min_lon, max_lat, max_lon := coverageBounds(spatial)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for cy := c.row(min_lat); cy <= c.row(max_lat); cy++ {
+		for cx := c.column(min_lon); cx <= c.column(max_lon); cx++ {
+			c.stale[coverageKey(cx, cy)] = true
+		}
+	}
+}
+
+func (c *WOFCoverage) IsBuilt() bool {
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.built
+}
+
+func (c *WOFCoverage) CountCells() int {
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.cells)
+}
+
+func (c *WOFCoverage) CountStale() int {
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.stale)
+}
+
+func coverageBounds(spatial *geojson.WOFSpatial) (float64, float64, float64, float64) {
+
+	bounds := spatial.Bounds()
+
+	min_lon := bounds.PointCoord(0)
+	min_lat := bounds.PointCoord(1)
+	max_lon := min_lon + bounds.LengthsCoord(0)
+	max_lat := min_lat + bounds.LengthsCoord(1)
+
+	return min_lat, min_lon, max_lat, max_lon
+}
+
+// the cells a single record covers, or the bounding box if there are too many
+
+type wofCoverageRecord struct {
+	Id      int
+	Full    []uint64
+	Partial []uint64
+	Wide    *wofCoverageWide
+}
+
+func (c *WOFCoverage) coverRecord(spatial *geojson.WOFSpatial, polygons []*WOFCompactPolygon) wofCoverageRecord {
+
+	min_lat, min_lon, max_lat, max_lon := coverageBounds(spatial)
+
+	rec := wofCoverageRecord{
+		Id:      spatial.Id,
+		Full:    make([]uint64, 0),
+		Partial: make([]uint64, 0),
+	}
+
+	cx0 := c.column(min_lon)
+	cy0 := c.row(min_lat)
+	nx := c.column(max_lon) - cx0 + 1
+	ny := c.row(max_lat) - cy0 + 1
+
+	if nx*ny > coverageMaxCells {
+
+		rec.Wide = &wofCoverageWide{
+			Id:     spatial.Id,
+			MinLat: min_lat,
+			MinLon: min_lon,
+			MaxLat: max_lat,
+			MaxLon: max_lon,
+		}
+
+		return rec
+	}
+
+	// if we couldn't load the polygons then the best we can do is have them
+	// checked (and fail to load again) at lookup time like they would be anyway
+
+	if polygons == nil {
+
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx < nx; cx++ {
+				rec.Partial = append(rec.Partial, coverageKey(cx0+cx, cy0+cy))
+			}
+		}
+
+		return rec
+	}
+
+	size := c.CellSize()
+
+	x0 := -180.0 + float64(cx0)*size
+	y0 := -90.0 + float64(cy0)*size
+
+	full := make([]bool, nx*ny)
+	partial := make([]bool, nx*ny)
+
+	for _, poly := range polygons {
+
+		inside, dirty := classifyCells(poly.Rings(), x0, y0, size, size, nx, ny)
+
+		for i := range full {
+
+			if inside[i] {
+				full[i] = true
+			} else if dirty[i] {
+				partial[i] = true
+			}
+		}
+	}
+
+	for cy := 0; cy < ny; cy++ {
+
+		for cx := 0; cx < nx; cx++ {
+
+			i := cy*nx + cx
+			key := coverageKey(cx0+cx, cy0+cy)
+
+			if full[i] {
+				rec.Full = append(rec.Full, key)
+			} else if partial[i] {
+				rec.Partial = append(rec.Partial, key)
+			}
+		}
+	}
+
+	return rec
+}
+
+func (c *WOFCoverage) addRecord(rec wofCoverageRecord) {
+
+	if rec.Wide != nil {
+		c.wide = append(c.wide, *rec.Wide)
+		return
+	}
+
+	get := func(key uint64) *wofCoverageCell {
+
+		cell, ok := c.cells[key]
+
+		if !ok {
+			cell = &wofCoverageCell{}
+			c.cells[key] = cell
+		}
+
+		return cell
+	}
+
+	for _, key := range rec.Full {
+		cell := get(key)
+		cell.Full = append(cell.Full, rec.Id)
+	}
+
+	for _, key := range rec.Partial {
+		cell := get(key)
+		cell.Partial = append(cell.Partial, rec.Id)
+	}
+}
+
+// BuildCoverage (re)builds p.Coverage from everything that is currently indexed,
+// reading the polygons for each record from the cache if they're there and from
+// p.Geometries or p.Reader if they aren't (without adding them to the cache). It
+// can take a while so it should be called once indexing is complete; lookups made
+// while it is running use the Rtree. It returns the number of records covered.
+
+func (p WOFPointInPolygon) BuildCoverage() (int, error) {
+
+	c := p.Coverage
+
+	if c == nil {
+		return 0, errors.New("coverage is not enabled")
+	}
+
+	// anything indexed or removed from here on will invalidate the cells it
+	// touches, which is what we want because we're working from a snapshot
+
+	c.mu.Lock()
+	c.cells = make(map[uint64]*wofCoverageCell)
+	c.stale = make(map[uint64]bool)
+	c.wide = make([]wofCoverageWide, 0)
+	c.built = false
+	c.mu.Unlock()
+
+	p.mu.RLock()
+
+	spatials := make([]*geojson.WOFSpatial, 0, len(p.Spatials))
+
+	for _, spatial := range p.Spatials {
+		spatials = append(spatials, spatial)
+	}
+
+	p.mu.RUnlock()
+
+	fingerprint := p.coverageFingerprint(c.Level)
+
+	todo := make(chan *geojson.WOFSpatial)
+	done := make(chan wofCoverageRecord)
+
+	wg := new(sync.WaitGroup)
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+
+			for spatial := range todo {
+
+				// which cells are entirely inside a polygon is worked out
+				// assuming straight edges so records with great circle
+				// edges are only ever listed as partly covering a cell,
+				// the same as if we couldn't load their polygons
+
+				if p.Edges.IsGeodesic(spatial.Placetype) {
+					done <- c.coverRecord(spatial, nil)
+					continue
+				}
+
+				// simplified polygons are only exact away from their
+				// edges so don't use them to decide what a cell covers
+
+				polygons, ok := p.Cache.Peek(spatial.Id)
+
+				if !ok || AnySimplified(polygons) {
+
+					var err error
+					polygons, err = p.readCompactPolygons(spatial.Id)
+
+					if err != nil {
+						p.Logger.Warning("failed to load polygons for %d while building coverage, because %s", spatial.Id, err)
+						polygons = nil
+					}
+				}
+
+				done <- c.coverRecord(spatial, polygons)
+			}
+		}()
+	}
+
+	go func() {
+
+		for _, spatial := range spatials {
+			todo <- spatial
+		}
+
+		close(todo)
+		wg.Wait()
+		close(done)
+	}()
+
+	records := make([]wofCoverageRecord, 0, len(spatials))
+
+	for rec := range done {
+		records = append(records, rec)
+	}
+
+	// sort the records so that the IDs in each cell are always in the same
+	// order, whatever order the workers finished in
+
+	sort.Slice(records, func(i int, j int) bool {
+		return records[i].Id < records[j].Id
+	})
+
+	c.mu.Lock()
+
+	for _, rec := range records {
+		c.addRecord(rec)
+	}
+
+	c.Fingerprint = fingerprint
+	c.built = true
+
+	c.mu.Unlock()
+
+	p.Logger.Status("built level %d coverage for %d records: %d cells, %d stale, %d records too big to grid", c.Level, len(records), c.CountCells(), c.CountStale(), len(c.wide))
+	return len(records), nil
+}
+
+// coverageFingerprint is a hash of the level, every indexed ID and its bounding box
+// and, if we know it, a hash of its geometry. Saved coverage is only loaded if it
+// has the same fingerprint as the current index.
+
+func (p WOFPointInPolygon) coverageFingerprint(level int) string {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ids := make([]int, 0, len(p.Spatials))
+
+	for id := range p.Spatials {
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+
+	h := sha1.New()
+	io.WriteString(h, fmt.Sprintf("level:%d\n", level))
+
+	for _, id := range ids {
+
+		min_lat, min_lon, max_lat, max_lon := coverageBounds(p.Spatials[id])
+
+		geom_hash := ""
+
+		hashes, ok := p.Hashes[id]
+
+		if ok {
+			geom_hash = hashes.Geom
+		}
+
+		io.WriteString(h, fmt.Sprintf("%d,%v,%v,%v,%v,%s\n", id, min_lat, min_lon, max_lat, max_lon, geom_hash))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Saved coverage is a single file that looks like this, all little-endian:
+//
+//	header:  magic (8 bytes) | level (uint32) | fingerprint length (uint32) | fingerprint
+//	cells:   cell count (uint64) then for each cell:
+//	           key (uint64) | full count (uint32) | partial count (uint32) | ids (int64) * (full + partial)
+//	stale:   stale count (uint64) | key (uint64) * stale count
+//	wide:    wide count (uint64) then for each record:
+//	           id (int64) | min lat, min lon, max lat, max lon (float64)
+
+// SaveCoverage writes p.Coverage to path, replacing it atomically
+
+func (p WOFPointInPolygon) SaveCoverage(path string) error {
+
+	c := p.Coverage
+
+	if c == nil || !c.IsBuilt() {
+		return errors.New("coverage has not been built")
+	}
+
+	tmp_path := path + ".tmp"
+
+	fh, err := os.Create(tmp_path)
+
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(fh)
+
+	c.mu.RLock()
+	err = c.write(writer)
+	c.mu.RUnlock()
+
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if err == nil {
+		err = fh.Sync()
+	}
+
+	close_err := fh.Close()
+
+	if err == nil {
+		err = close_err
+	}
+
+	if err != nil {
+		os.Remove(tmp_path)
+		return err
+	}
+
+	err = os.Rename(tmp_path, path)
+
+	if err != nil {
+		return err
+	}
+
+	p.Logger.Status("saved level %d coverage (%d cells) to %s", c.Level, c.CountCells(), path)
+	return nil
+}
+
+// assumes that c.mu has already been (read) locked by the caller
+
+func (c *WOFCoverage) write(w io.Writer) error {
+
+	put := func(v interface{}) error {
+		return binary.Write(w, binary.LittleEndian, v)
+	}
+
+	_, err := io.WriteString(w, coverageMagic)
+
+	if err != nil {
+		return err
+	}
+
+	err = put(uint32(c.Level))
+
+	if err != nil {
+		return err
+	}
+
+	err = put(uint32(len(c.Fingerprint)))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, c.Fingerprint)
+
+	if err != nil {
+		return err
+	}
+
+	// sort the keys so that saving the same coverage twice gives the same file
+
+	keys := make([]uint64, 0, len(c.cells))
+
+	for key := range c.cells {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i int, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	err = put(uint64(len(keys)))
+
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+
+		cell := c.cells[key]
+
+		err = put(key)
+
+		if err == nil {
+			err = put(uint32(len(cell.Full)))
+		}
+
+		if err == nil {
+			err = put(uint32(len(cell.Partial)))
+		}
+
+		for _, ids := range [][]int{cell.Full, cell.Partial} {
+
+			for _, id := range ids {
+
+				if err == nil {
+					err = put(int64(id))
+				}
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = put(uint64(len(c.stale)))
+
+	if err != nil {
+		return err
+	}
+
+	for key := range c.stale {
+
+		err = put(key)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = put(uint64(len(c.wide)))
+
+	if err != nil {
+		return err
+	}
+
+	for _, wide := range c.wide {
+
+		err = put(int64(wide.Id))
+
+		if err == nil {
+			err = put([]float64{wide.MinLat, wide.MinLon, wide.MaxLat, wide.MaxLon})
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadCoverage replaces p.Coverage with the coverage saved in path. It returns an
+// error, and leaves p.Coverage alone, if the saved coverage is for a different level
+// or was built from a different index than the one we have now. Like BuildCoverage
+// it should be called once indexing is complete.
+
+func (p WOFPointInPolygon) LoadCoverage(path string) error {
+
+	c := p.Coverage
+
+	if c == nil {
+		return errors.New("coverage is not enabled")
+	}
+
+	fh, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer fh.Close()
+
+	reader := bufio.NewReader(fh)
+
+	get := func(v interface{}) error {
+		return binary.Read(reader, binary.LittleEndian, v)
+	}
+
+	magic := make([]byte, len(coverageMagic))
+
+	_, err = io.ReadFull(reader, magic)
+
+	if err != nil || string(magic) != coverageMagic {
+		return errors.New(fmt.Sprintf("%s is not a saved coverage file", path))
+	}
+
+	var level uint32
+	var fp_length uint32
+
+	err = get(&level)
+
+	if err == nil {
+		err = get(&fp_length)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if int(level) != c.Level {
+		return errors.New(fmt.Sprintf("%s is level %d coverage, expected level %d", path, level, c.Level))
+	}
+
+	fp := make([]byte, fp_length)
+
+	_, err = io.ReadFull(reader, fp)
+
+	if err != nil {
+		return err
+	}
+
+	fingerprint := p.coverageFingerprint(c.Level)
+
+	if string(fp) != fingerprint {
+		return errors.New(fmt.Sprintf("%s was built from a different index", path))
+	}
+
+	loaded, err := NewCoverage(c.Level)
+
+	if err != nil {
+		return err
+	}
+
+	var count uint64
+
+	err = get(&count)
+
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < count; i++ {
+
+		var key uint64
+		var full_count uint32
+		var partial_count uint32
+
+		err = get(&key)
+
+		if err == nil {
+			err = get(&full_count)
+		}
+
+		if err == nil {
+			err = get(&partial_count)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		ids := make([]int64, full_count+partial_count)
+
+		err = get(ids)
+
+		if err != nil {
+			return err
+		}
+
+		cell := wofCoverageCell{
+			Full:    make([]int, full_count),
+			Partial: make([]int, partial_count),
+		}
+
+		for j, id := range ids {
+
+			if j < int(full_count) {
+				cell.Full[j] = int(id)
+			} else {
+				cell.Partial[j-int(full_count)] = int(id)
+			}
+		}
+
+		loaded.cells[key] = &cell
+	}
+
+	err = get(&count)
+
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < count; i++ {
+
+		var key uint64
+
+		err = get(&key)
+
+		if err != nil {
+			return err
+		}
+
+		loaded.stale[key] = true
+	}
+
+	err = get(&count)
+
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < count; i++ {
+
+		var id int64
+		bounds := make([]float64, 4)
+
+		err = get(&id)
+
+		if err == nil {
+			err = get(bounds)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		loaded.wide = append(loaded.wide, wofCoverageWide{
+			Id:     int(id),
+			MinLat: bounds[0],
+			MinLon: bounds[1],
+			MaxLat: bounds[2],
+			MaxLon: bounds[3],
+		})
+	}
+
+	c.mu.Lock()
+
+	c.cells = loaded.cells
+	c.stale = loaded.stale
+	c.wide = loaded.wide
+	c.Fingerprint = fingerprint
+	c.built = true
+
+	c.mu.Unlock()
+
+	p.Logger.Status("loaded level %d coverage (%d cells) from %s", c.Level, c.CountCells(), path)
+	return nil
+}
@@ -0,0 +1,380 @@
+package pip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	gabs "github.com/jeffail/gabs"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"math"
+	"strings"
+)
+
+// WOFEdgeMode says what shape the edge between two vertices of a polygon is:
+//
+//	planar   - the default. A straight line in longitude/latitude space, which is
+//	           what GeoJSON says it is and what the data was (mostly) drawn as.
+//	geodesic - the shortest path over the surface of a sphere, a great circle arc.
+//
+// The two only disagree about long edges, and then mostly about east-west ones in
+// high latitudes: the great circle between two points on the same parallel bends
+// towards the pole, about 12 km at the middle of a 10 degree edge at 49 degrees
+// north, while north-south edges (meridians) are exactly the same in both modes.
+// Borders that are defined as following a parallel, like most of the 49th
+// parallel, are correct in planar mode and wrong in geodesic mode; geodesic mode is
+// for data whose edges really are the shortest path between vertices, like a lot of
+// maritime boundaries and sparsely drawn marine areas.
+//
+// Checking an edge geodesically is a bit of trigonometry rather than a bit of
+// arithmetic, which makes it about twice as slow as a planar one, and none of the
+// shortcuts that prepared rings, interior rectangles and coverage provide work for
+// it, which makes big polygons hundreds of times slower than prepared planar ones
+// (see the wof-pip-geodesic-check tool).
+//
+// Like the planar test, the geodesic test assumes polygons don't contain a pole and
+// edges don't cross the antimeridian. Edges that span 180 degrees of longitude or
+// more are treated as planar.
+
+type WOFEdgeMode int
+
+const (
+	EdgePlanar WOFEdgeMode = iota
+	EdgeGeodesic
+)
+
+func (m WOFEdgeMode) String() string {
+
+	switch m {
+	case EdgeGeodesic:
+		return "geodesic"
+	default:
+		return "planar"
+	}
+}
+
+func EdgeModeFromString(name string) (WOFEdgeMode, error) {
+
+	switch name {
+	case "", "planar":
+		return EdgePlanar, nil
+	case "geodesic":
+		return EdgeGeodesic, nil
+	default:
+		return EdgePlanar, errors.New(fmt.Sprintf("unknown edge mode '%s', expected planar or geodesic", name))
+	}
+}
+
+// WOFEdgePolicy says which edge mode to use for each placetype. Changing it only
+// affects records indexed afterwards, since geodesic records are indexed with a
+// bigger bounding box (see GeodesicBounds), so set it before indexing anything.
+
+type WOFEdgePolicy struct {
+	Mode       WOFEdgeMode
+	Placetypes map[string]WOFEdgeMode
+}
+
+func NewEdgePolicy(mode WOFEdgeMode) *WOFEdgePolicy {
+
+	e := WOFEdgePolicy{
+		Mode:       mode,
+		Placetypes: make(map[string]WOFEdgeMode),
+	}
+
+	return &e
+}
+
+func (e *WOFEdgePolicy) SetPlacetype(placetype string, mode WOFEdgeMode) {
+	e.Placetypes[placetype] = mode
+}
+
+// SetPlacetypes parses a comma-separated list of placetype:mode pairs, like
+// "marinearea:geodesic,ocean:geodesic"
+
+func (e *WOFEdgePolicy) SetPlacetypes(spec string) error {
+
+	for _, pair := range splitList(spec) {
+
+		parts := strings.Split(pair, ":")
+
+		if len(parts) != 2 {
+			return errors.New(fmt.Sprintf("invalid edge mode '%s', expected placetype:mode", pair))
+		}
+
+		mode, err := EdgeModeFromString(strings.TrimSpace(parts[1]))
+
+		if err != nil {
+			return err
+		}
+
+		e.SetPlacetype(strings.TrimSpace(parts[0]), mode)
+	}
+
+	return nil
+}
+
+// EdgeMode returns the edge mode for a placetype; a nil policy is always planar
+
+func (e *WOFEdgePolicy) EdgeMode(placetype string) WOFEdgeMode {
+
+	if e == nil {
+		return EdgePlanar
+	}
+
+	mode, ok := e.Placetypes[placetype]
+
+	if ok {
+		return mode
+	}
+
+	return e.Mode
+}
+
+func (e *WOFEdgePolicy) IsGeodesic(placetype string) bool {
+	return e.EdgeMode(placetype) == EdgeGeodesic
+}
+
+// GeodesicBounds returns a bounding box that contains every great circle arc between
+// two points in the one it is given. Arcs bend towards the pole so the box only
+// grows polewards: an arc between two points at latitude L that are D degrees of
+// longitude apart reaches atan(tan(L) / cos(D / 2)), and that is as far as any arc
+// in the box can get.
+
+func GeodesicBounds(min_lat float64, min_lon float64, max_lat float64, max_lon float64) (float64, float64, float64, float64) {
+
+	width := max_lon - min_lon
+
+	if width >= 180.0 {
+
+		if max_lat > 0 {
+			max_lat = 90.0
+		}
+
+		if min_lat < 0 {
+			min_lat = -90.0
+		}
+
+		return min_lat, min_lon, max_lat, max_lon
+	}
+
+	half := math.Cos(width / 2 * math.Pi / 180.0)
+
+	bulge := func(lat float64) float64 {
+		return math.Atan(math.Tan(lat*math.Pi/180.0)/half) * 180.0 / math.Pi
+	}
+
+	if max_lat > 0 {
+		max_lat = math.Min(90.0, bulge(max_lat))
+	}
+
+	if min_lat < 0 {
+		min_lat = math.Max(-90.0, bulge(min_lat))
+	}
+
+	return min_lat, min_lon, max_lat, max_lon
+}
+
+// geodesicSpatial returns a copy of a record whose bounding box is big enough for
+// its edges to be great circle arcs, made the same way SpatialFromMetaRow makes
+// records. Since the bounding box is unexported this is the only way to make one.
+
+func geodesicSpatial(spatial *geojson.WOFSpatial) (*geojson.WOFSpatial, error) {
+
+	min_lat, min_lon, max_lat, max_lon := GeodesicBounds(coverageBounds(spatial))
+
+	deprecated := ""
+	superseded := ""
+
+	if spatial.Deprecated {
+		deprecated = "deprecated"
+	}
+
+	if spatial.Superseded {
+		superseded = "superseded"
+	}
+
+	parsed := gabs.New()
+
+	parsed.Set([]interface{}{min_lon, min_lat, max_lon, max_lat}, "bbox")
+	parsed.Set(float64(spatial.Id), "properties", "wof:id")
+	parsed.Set(spatial.Name, "properties", "wof:name")
+	parsed.Set(spatial.Placetype, "properties", "wof:placetype")
+	parsed.Set(deprecated, "properties", "edtf:deprecated")
+	parsed.Set(superseded, "properties", "edtf:superseded")
+	parsed.Set([]interface{}{}, "properties", "wof:superseded_by")
+
+	feature := geojson.WOFFeature{
+		Parsed: parsed,
+	}
+
+	return feature.EnSpatialize()
+}
+
+// geodesicTest is ringTest for great circle edges. The ray goes north from the point
+// along its meridian, which is a great circle too, and an edge crosses it if the
+// edge's longitudes straddle the point's (the western vertex counts as being on the
+// edge, the eastern one doesn't) and the edge is north of the point at its longitude.
+
+type geodesicTest struct {
+	lat            float64
+	lon            float64
+	check_boundary bool
+	inside         bool
+	boundary       bool
+}
+
+func (t *geodesicTest) edge(x1 float64, y1 float64, x2 float64, y2 float64) {
+
+	// always work from the western vertex so that an edge shared by two polygons,
+	// and so walked in opposite directions, gives exactly the same answer for both
+	// of them
+
+	if x1 > x2 || (x1 == x2 && y1 > y2) {
+		x1, y1, x2, y2 = x2, y2, x1, y1
+	}
+
+	if t.check_boundary && !t.boundary {
+
+		if (t.lon == x1 && t.lat == y1) || (t.lon == x2 && t.lat == y2) {
+			t.boundary = true
+		} else if x1 == x2 && t.lon == x1 && t.lat >= y1 && t.lat <= y2 {
+			t.boundary = true
+		}
+	}
+
+	if (x1 > t.lon) == (x2 > t.lon) {
+		return
+	}
+
+	edge_lat := greatCircleLatitude(x1, y1, x2, y2, t.lon)
+
+	if t.check_boundary && t.lat == edge_lat {
+		t.boundary = true
+	}
+
+	if t.lat < edge_lat {
+		t.inside = !t.inside
+	}
+}
+
+// greatCircleLatitude returns the latitude of the great circle through (x1, y1) and
+// (x2, y2) at longitude lon, where x1 < x2. Edges that span 180 degrees or more
+// don't have a shortest path that goes the way the coordinates say they do so
+// they're treated as planar.
+
+func greatCircleLatitude(x1 float64, y1 float64, x2 float64, y2 float64, lon float64) float64 {
+
+	if x2-x1 >= 180.0 {
+		return (y2-y1)*(lon-x1)/(x2-x1) + y1
+	}
+
+	if y1 == y2 && y1 == 0 {
+		return 0
+	}
+
+	rad := math.Pi / 180.0
+
+	a := math.Tan(y1*rad) * math.Sin((x2-lon)*rad)
+	b := math.Tan(y2*rad) * math.Sin((lon-x1)*rad)
+
+	return math.Atan((a+b)/math.Sin((x2-x1)*rad)) / rad
+}
+
+// LocateGeodesic is Locate for a ring whose edges are great circle arcs. Prepared
+// rings are tested edge by edge like any other since their edge index assumes
+// straight edges.
+
+func (r *WOFCompactRing) LocateGeodesic(lat float64, lon float64, check_boundary bool) (bool, bool) {
+
+	if r.Count < 3 {
+		return false, false
+	}
+
+	min_lat, min_lon, max_lat, max_lon := GeodesicBounds(r.MinY, r.MinX, r.MaxY, r.MaxX)
+
+	if lon < min_lon || lon > max_lon || lat < min_lat || lat > max_lat {
+		return false, false
+	}
+
+	t := geodesicTest{
+		lat:            lat,
+		lon:            lon,
+		check_boundary: check_boundary,
+	}
+
+	if r.Encoding == CompactDelta {
+
+		var x, y int64
+		var first_x, first_y, prev_x, prev_y float64
+
+		offset := 0
+
+		for i := 0; i < r.Count; i++ {
+
+			dx, n := binary.Varint(r.delta[offset:])
+			offset += n
+
+			dy, n := binary.Varint(r.delta[offset:])
+			offset += n
+
+			x += dx
+			y += dy
+
+			cur_x := float64(x) / compactDeltaScale
+			cur_y := float64(y) / compactDeltaScale
+
+			if i == 0 {
+				first_x = cur_x
+				first_y = cur_y
+			} else {
+				t.edge(cur_x, cur_y, prev_x, prev_y)
+			}
+
+			prev_x = cur_x
+			prev_y = cur_y
+		}
+
+		t.edge(first_x, first_y, prev_x, prev_y)
+
+		return t.inside, t.boundary
+	}
+
+	j := r.Count - 1
+
+	for i := 0; i < r.Count; i++ {
+
+		x1, y1 := r.vertex(i)
+		x2, y2 := r.vertex(j)
+
+		t.edge(x1, y1, x2, y2)
+		j = i
+	}
+
+	return t.inside, t.boundary
+}
+
+// LocateWithEdges calls Locate or LocateGeodesic depending on the edge mode
+
+func (r *WOFCompactRing) LocateWithEdges(lat float64, lon float64, check_boundary bool, edges WOFEdgeMode) (bool, bool) {
+
+	if edges == EdgeGeodesic {
+		return r.LocateGeodesic(lat, lon, check_boundary)
+	}
+
+	return r.Locate(lat, lon, check_boundary)
+}
+
+// MightContain returns false if the point is outside the bounding box the polygon
+// has when its edges are the given shape, and so can't possibly be inside it
+
+func (p *WOFCompactPolygon) MightContain(lat float64, lon float64, edges WOFEdgeMode) bool {
+
+	r := p.OuterRing
+
+	min_lat, min_lon, max_lat, max_lon := r.MinY, r.MinX, r.MaxY, r.MaxX
+
+	if edges == EdgeGeodesic {
+		min_lat, min_lon, max_lat, max_lon = GeodesicBounds(min_lat, min_lon, max_lat, max_lon)
+	}
+
+	return lon >= min_lon && lon <= max_lon && lat >= min_lat && lat <= max_lat
+}
@@ -0,0 +1,410 @@
+package pip
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Points near some long borders that planar and geodesic edges disagree about (and
+// some that they don't), checked with every encoding and boundary rule.
+
+type edgesPolygon struct {
+	Name  string
+	Rings [][]float64
+}
+
+// a point that isn't on an edge, so every rule agrees about it
+
+type edgesCase struct {
+	Polygon  string
+	Lat      float64
+	Lon      float64
+	Planar   bool
+	Geodesic bool
+}
+
+var edgesPolygons = []edgesPolygon{
+	// either side of a single 28 degree edge along the 49th parallel, whose
+	// great circle reaches 49.85 degrees north at -109
+	{"south-49", [][]float64{testSquare(-123, 40, -95, 49)}},
+	{"north-49", [][]float64{testSquare(-123, 49, -95, 60)}},
+	// the same, walked the other way round
+	{"north-49-cw", [][]float64{testReverse(testSquare(-123, 49, -95, 60))}},
+	// the oblique edge between Lake Tahoe and the Colorado River, more or less
+	{"nevada-ish", [][]float64{{-120, 42, -114, 42, -114, 35, -114.6, 35, -120, 39, -120, 42}}},
+	// a big marine area in the southern hemisphere, whose edges bend south
+	{"ocean", [][]float64{testSquare(100, -40, 140, -20)}},
+	// the same but with a hole in it
+	{"ocean-hole", [][]float64{testSquare(100, -40, 140, -20), testSquare(110, -35, 130, -25)}},
+}
+
+var edgesCases = []edgesCase{
+	// north of the parallel but south of the great circle
+	{"south-49", 49.5, -109, false, true},
+	{"north-49", 49.5, -109, true, false},
+	{"north-49-cw", 49.5, -109, true, false},
+	// north of both
+	{"south-49", 49.9, -109, false, false},
+	{"north-49", 49.9, -109, true, true},
+	// the great circle is only 0.012 degrees north of the parallel near the end
+	{"south-49", 49.1, -122.9, false, false},
+	{"north-49", 49.1, -122.9, true, true},
+	{"south-49", 49.005, -122.9, false, true},
+	// meridians are great circles so the east and west edges are the same
+	{"south-49", 45, -95.0001, true, true},
+	{"south-49", 45, -94.9999, false, false},
+	{"south-49", 45, -122.9999, true, true},
+	{"south-49", 45, -123.0001, false, false},
+	// the planar edge is at 37 degrees at -117.3, the great circle at 37.083
+	{"nevada-ish", 37.05, -117.3, true, false},
+	{"nevada-ish", 36.95, -117.3, false, false},
+	{"nevada-ish", 37.1, -117.3, true, true},
+	// the great circle at 120 degrees east reaches 41.76 degrees south
+	{"ocean", -40.5, 120, false, true},
+	{"ocean", -41.9, 120, false, false},
+	{"ocean", -30, 120, true, true},
+	// the hole bends south too, by less
+	{"ocean-hole", -35.3, 120, true, false},
+	{"ocean-hole", -30, 120, false, false},
+}
+
+var edgesEncodings = []WOFCompactEncoding{
+	CompactFloat64,
+	CompactFloat32,
+	CompactDelta,
+}
+
+var edgesRules = []WOFBoundaryRule{
+	BoundaryHalfOpen,
+	BoundaryInclusive,
+	BoundaryExclusive,
+}
+
+func edgesLookup() map[string][][]float64 {
+
+	lookup := make(map[string][][]float64)
+
+	for _, p := range edgesPolygons {
+		lookup[p.Name] = p.Rings
+	}
+
+	return lookup
+}
+
+// testGreatCircle is the latitude of a great circle at a given longitude, worked out
+// a different way to the one edges.go uses: by interpolating between the two points
+// as 3D vectors
+
+func testGreatCircle(x1 float64, y1 float64, x2 float64, y2 float64, lon float64) float64 {
+
+	vector := func(x float64, y float64) [3]float64 {
+		return [3]float64{math.Cos(y*degToRad) * math.Cos(x*degToRad), math.Cos(y*degToRad) * math.Sin(x*degToRad), math.Sin(y * degToRad)}
+	}
+
+	a := vector(x1, y1)
+	b := vector(x2, y2)
+
+	// bisect along the arc until we get to the right longitude
+
+	lo := 0.0
+	hi := 1.0
+
+	var lat float64
+
+	for i := 0; i < 60; i++ {
+
+		f := (lo + hi) / 2
+
+		v := [3]float64{a[0] + (b[0]-a[0])*f, a[1] + (b[1]-a[1])*f, a[2] + (b[2]-a[2])*f}
+
+		x := math.Atan2(v[1], v[0]) / degToRad
+		lat = math.Atan2(v[2], math.Hypot(v[0], v[1])) / degToRad
+
+		if x < lon {
+			lo = f
+		} else {
+			hi = f
+		}
+	}
+
+	return lat
+}
+
+func TestContainsWithEdges(t *testing.T) {
+
+	lookup := edgesLookup()
+
+	for _, enc := range edgesEncodings {
+
+		t.Run(enc.String(), func(t *testing.T) {
+
+			for _, c := range edgesCases {
+
+				poly := NewCompactPolygon(lookup[c.Polygon], enc)
+
+				for _, rule := range edgesRules {
+
+					got := poly.ContainsWithEdges(c.Lat, c.Lon, rule, EdgePlanar)
+
+					if got != c.Planar {
+						t.Errorf("%f,%f in '%s' (%s, planar) is %t, expected %t", c.Lat, c.Lon, c.Polygon, rule, got, c.Planar)
+					}
+
+					got = poly.ContainsWithEdges(c.Lat, c.Lon, rule, EdgeGeodesic)
+
+					if got != c.Geodesic {
+						t.Errorf("%f,%f in '%s' (%s, geodesic) is %t, expected %t", c.Lat, c.Lon, c.Polygon, rule, got, c.Geodesic)
+					}
+				}
+			}
+		})
+	}
+}
+
+// every point in the two polygons either side of the 49th parallel, including their
+// corners and the ends of the shared edge, is in exactly one of them using the
+// half-open rule, whichever way round the northern one is walked
+
+func TestGeodesicSharedEdges(t *testing.T) {
+
+	lookup := edgesLookup()
+
+	south := NewCompactPolygon(lookup["south-49"], CompactFloat64)
+
+	for _, name := range []string{"north-49", "north-49-cw"} {
+
+		t.Run(name, func(t *testing.T) {
+
+			north := NewCompactPolygon(lookup[name], CompactFloat64)
+
+			rnd := rand.New(rand.NewSource(49))
+
+			test := func(lat float64, lon float64) {
+
+				s := south.ContainsWithEdges(lat, lon, BoundaryHalfOpen, EdgeGeodesic)
+				n := north.ContainsWithEdges(lat, lon, BoundaryHalfOpen, EdgeGeodesic)
+
+				if s && n {
+					t.Errorf("%f,%f is claimed by both sides of the 49th parallel", lat, lon)
+				}
+
+				// the only places neither should claim are outside both of
+				// them or on their outside edges, which bend north too
+
+				if !s && !n && lon > -123 && lon < -95 && lat > testGreatCircle(-123, 40, -95, 40, lon) && lat < testGreatCircle(-123, 60, -95, 60, lon) {
+					t.Errorf("%f,%f is claimed by neither side of the 49th parallel", lat, lon)
+				}
+			}
+
+			for i := 0; i < 20000; i++ {
+
+				lon := -123 + rnd.Float64()*28
+
+				// half of them right next to the shared edge
+
+				if i%2 == 0 {
+					test(testGreatCircle(-123, 49, -95, 49, lon)+(rnd.Float64()-0.5)*1e-9, lon)
+				} else {
+					test(40+rnd.Float64()*20, lon)
+				}
+			}
+
+			for _, lat := range []float64{40, 49, 60} {
+				for _, lon := range []float64{-123, -109, -95} {
+					test(lat, lon)
+				}
+			}
+		})
+	}
+}
+
+// meridians and the equator are great circles so a polygon's edges along them are
+// the same in both modes, and anything south of its northern edge (which bends
+// north) is too
+
+func TestGeodesicMeridianEdges(t *testing.T) {
+
+	poly := NewCompactPolygon([][]float64{{10, 0, 20, 0, 20, 50, 15, 70, 15, 50, 10, 50, 10, 0}}, CompactFloat64)
+	meridians := NewCompactPolygon([][]float64{testSquare(10, 0, 20, 30)}, CompactFloat64)
+
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 10000; i++ {
+
+		lat := -10 + rnd.Float64()*39.9
+		lon := 5 + rnd.Float64()*20
+
+		for _, rule := range edgesRules {
+
+			planar, _ := meridians.OuterRing.Locate(lat, lon, rule != BoundaryHalfOpen)
+			geodesic, _ := meridians.OuterRing.LocateGeodesic(lat, lon, rule != BoundaryHalfOpen)
+
+			if planar != geodesic {
+				t.Errorf("%f,%f is %t with planar edges but %t with geodesic ones", lat, lon, planar, geodesic)
+			}
+		}
+	}
+
+	// points on a meridian edge are on the boundary in both modes
+
+	for _, lat := range []float64{1, 25, 49.5} {
+
+		for _, lon := range []float64{10, 20} {
+
+			_, boundary := poly.OuterRing.LocateGeodesic(lat, lon, true)
+
+			if !boundary {
+				t.Errorf("%f,%f should be on the boundary", lat, lon)
+			}
+		}
+	}
+}
+
+func TestGreatCircleLatitude(t *testing.T) {
+
+	edges := [][4]float64{
+		{-123, 49, -95, 49},
+		{-115, 60, -105, 60},
+		{-120, 39, -114.6, 35},
+		{100, -40, 140, -40},
+		{-10, -20, 30, 45},
+	}
+
+	for _, e := range edges {
+
+		for i := 1; i < 100; i++ {
+
+			lon := e[0] + (e[2]-e[0])*float64(i)/100
+
+			got := greatCircleLatitude(e[0], e[1], e[2], e[3], lon)
+			expected := testGreatCircle(e[0], e[1], e[2], e[3], lon)
+
+			if math.Abs(got-expected) > 1e-9 {
+				t.Errorf("great circle %v at %f is at %f, expected %f", e, lon, got, expected)
+			}
+		}
+	}
+
+	// edges that span 180 degrees or more are treated as planar
+
+	got := greatCircleLatitude(-100, 10, 100, 30, 0)
+
+	if got != 20 {
+		t.Errorf("expected a 200 degree edge to be planar, got %f", got)
+	}
+}
+
+// the bounding box of a polygon with geodesic edges has to contain all of them,
+// and for an edge along a parallel the edge reaches the edge of the box
+
+func TestGeodesicBounds(t *testing.T) {
+
+	boxes := [][4]float64{
+		{40, -123, 60, -95},
+		{-40, 100, -20, 140},
+		{-10, 0, 10, 50},
+		{60, -30, 80, 30},
+	}
+
+	for _, b := range boxes {
+
+		min_lat, min_lon, max_lat, max_lon := GeodesicBounds(b[0], b[1], b[2], b[3])
+
+		if min_lon != b[1] || max_lon != b[3] || min_lat > b[0] || max_lat < b[2] {
+			t.Errorf("%v grew to %f,%f,%f,%f which doesn't contain it", b, min_lat, min_lon, max_lat, max_lon)
+		}
+
+		// edges along the top and bottom of the box and its diagonals
+
+		edges := [][4]float64{
+			{b[1], b[0], b[3], b[0]},
+			{b[1], b[2], b[3], b[2]},
+			{b[1], b[0], b[3], b[2]},
+			{b[1], b[2], b[3], b[0]},
+		}
+
+		top := math.Inf(-1)
+		bottom := math.Inf(1)
+
+		for _, e := range edges {
+
+			for i := 0; i <= 100; i++ {
+
+				lon := e[0] + (e[2]-e[0])*float64(i)/100
+				lat := testGreatCircle(e[0], e[1], e[2], e[3], lon)
+
+				if lat > max_lat+1e-9 || lat < min_lat-1e-9 {
+					t.Errorf("the great circle %v is at %f at %f, outside %f - %f", e, lat, lon, min_lat, max_lat)
+				}
+
+				top = math.Max(top, lat)
+				bottom = math.Min(bottom, lat)
+			}
+		}
+
+		// only the poleward side of the box grows, and only as far as it has to
+
+		if b[2] > 0 && math.Abs(top-max_lat) > 1e-3 {
+			t.Errorf("%v grew north to %f but its edges only reach %f", b, max_lat, top)
+		}
+
+		if b[2] <= 0 && max_lat != b[2] {
+			t.Errorf("%v grew north to %f but it's in the southern hemisphere", b, max_lat)
+		}
+
+		if b[0] < 0 && math.Abs(bottom-min_lat) > 1e-3 {
+			t.Errorf("%v grew south to %f but its edges only reach %f", b, min_lat, bottom)
+		}
+
+		if b[0] >= 0 && min_lat != b[0] {
+			t.Errorf("%v grew south to %f but it's in the northern hemisphere", b, min_lat)
+		}
+	}
+
+	// boxes 180 degrees or wider go all the way to the pole
+
+	min_lat, _, max_lat, _ := GeodesicBounds(-10, -100, 10, 100)
+
+	if min_lat != -90 || max_lat != 90 {
+		t.Errorf("expected a 200 degree wide box to reach both poles, got %f - %f", min_lat, max_lat)
+	}
+}
+
+func TestEdgePolicy(t *testing.T) {
+
+	var nil_policy *WOFEdgePolicy
+
+	if nil_policy.EdgeMode("country") != EdgePlanar {
+		t.Errorf("a nil policy should always be planar")
+	}
+
+	e := NewEdgePolicy(EdgePlanar)
+
+	err := e.SetPlacetypes("marinearea:geodesic, ocean : geodesic,country:planar")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]WOFEdgeMode{
+		"marinearea": EdgeGeodesic,
+		"ocean":      EdgeGeodesic,
+		"country":    EdgePlanar,
+		"locality":   EdgePlanar,
+	}
+
+	for pt, mode := range expected {
+
+		if e.EdgeMode(pt) != mode {
+			t.Errorf("%s is %s, expected %s", pt, e.EdgeMode(pt), mode)
+		}
+	}
+
+	for _, spec := range []string{"ocean", "ocean:curvy", "a:b:c"} {
+
+		if NewEdgePolicy(EdgePlanar).SetPlacetypes(spec) == nil {
+			t.Errorf("expected '%s' to be an error", spec)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package pip
+
+import (
+	"errors"
+	"fmt"
+	gabs "github.com/jeffail/gabs"
+	metrics "github.com/rcrowley/go-metrics"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"time"
+)
+
+// Most of the candidates the Rtree returns for an unfiltered lookup are there because
+// their bounding box overlaps the point, not because they contain it, and near a
+// border a lot of them are on the wrong side of it. WOFLookupStrategy says what to do
+// about that:
+//
+//	flat      - the default. Check every candidate.
+//	hierarchy - check the candidates at each of the HierarchyPlacetypes (countries
+//	            and then regions) first and then only check the rest if at least
+//	            one of their ancestors at that placetype (according to
+//	            wof:hierarchy) might contain the point.
+//
+// An ancestor might contain the point unless it is indexed and either its bounding
+// box doesn't contain the point or it has been checked and doesn't. Records without a
+// wof:hierarchy, or without any ancestors at a given placetype, are always checked,
+// as are records whose ancestors aren't indexed or were removed by a filter. That
+// includes everything indexed from meta files, which don't list ancestors.
+//
+// Note that a record whose polygon pokes out past its parent's won't be found in the
+// bit that pokes out, which is sort of the point. Lookups filtered by placetype
+// always use the flat strategy since checking countries to save checking a handful
+// of localities is a bad trade.
+
+type WOFLookupStrategy int
+
+const (
+	LookupFlat WOFLookupStrategy = iota
+	LookupHierarchy
+)
+
+func (s WOFLookupStrategy) String() string {
+
+	switch s {
+	case LookupHierarchy:
+		return "hierarchy"
+	default:
+		return "flat"
+	}
+}
+
+func LookupStrategyFromString(name string) (WOFLookupStrategy, error) {
+
+	switch name {
+	case "", "flat":
+		return LookupFlat, nil
+	case "hierarchy":
+		return LookupHierarchy, nil
+	default:
+		return LookupFlat, errors.New(fmt.Sprintf("unknown lookup strategy '%s', expected flat or hierarchy", name))
+	}
+}
+
+// HierarchyPlacetypes are the placetypes that are resolved first, in order, by the
+// hierarchy strategy
+
+var HierarchyPlacetypes = []string{
+	"country",
+	"region",
+}
+
+// WOFRecordAncestors maps a placetype to the IDs of a record's ancestors at that
+// placetype, from all of its hierarchies
+
+type WOFRecordAncestors map[string][]int
+
+// AncestorsFromFeature reads the ancestors at each of the HierarchyPlacetypes from
+// a feature's wof:hierarchy property. It returns nil if there aren't any.
+
+func AncestorsFromFeature(feature *geojson.WOFFeature) WOFRecordAncestors {
+
+	return ancestorsFromHierarchy(feature.Body().Path("properties.wof:hierarchy"))
+}
+
+func ancestorsFromHierarchy(hierarchy *gabs.Container) WOFRecordAncestors {
+
+	children, err := hierarchy.Children()
+
+	if err != nil {
+		return nil
+	}
+
+	ancestors := make(WOFRecordAncestors)
+
+	for _, h := range children {
+
+		for _, pt := range HierarchyPlacetypes {
+
+			// JSON numbers are float64s; -1 (and friends) mean "unknown"
+
+			f, ok := h.Path(pt + "_id").Data().(float64)
+
+			if !ok || f <= 0 {
+				continue
+			}
+
+			id := int(f)
+			seen := false
+
+			for _, other := range ancestors[pt] {
+
+				if other == id {
+					seen = true
+					break
+				}
+			}
+
+			if !seen {
+				ancestors[pt] = append(ancestors[pt], id)
+			}
+		}
+	}
+
+	if len(ancestors) == 0 {
+		return nil
+	}
+
+	return ancestors
+}
+
+func (p WOFPointInPolygon) GetAncestors(id int) (WOFRecordAncestors, bool) {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ancestors, ok := p.Ancestors[id]
+	return ancestors, ok
+}
+
+// EnsureContainedHierarchy is EnsureContained using the hierarchy strategy. 'known'
+// is a list of records that are already known to contain the point (which aren't
+// checked again or returned) and may be empty. It also returns the number of records
+// that were actually checked.
+
+func (p WOFPointInPolygon) EnsureContainedHierarchy(lat float64, lon float64, results []*geojson.WOFSpatial, known []*geojson.WOFSpatial) ([]*geojson.WOFSpatial, int, time.Duration) {
+
+	t := time.Now()
+
+	contained := make([]*geojson.WOFSpatial, 0)
+	count := 0
+
+	// the records we know do, or have checked and don't, contain the point
+
+	is_contained := make(map[int]bool)
+	is_checked := make(map[int]bool)
+
+	for _, wof := range known {
+		is_contained[wof.Id] = true
+		is_checked[wof.Id] = true
+	}
+
+	remaining := results
+
+	for _, pt := range HierarchyPlacetypes {
+
+		candidates := make([]*geojson.WOFSpatial, 0)
+		rest := make([]*geojson.WOFSpatial, 0)
+
+		for _, wof := range remaining {
+
+			if wof.Placetype == pt {
+				candidates = append(candidates, wof)
+			} else {
+				rest = append(rest, wof)
+			}
+		}
+
+		pruned := p.pruneByAncestors(lat, lon, candidates, is_contained, is_checked)
+
+		tier, _ := p.EnsureContained(lat, lon, pruned)
+		count += len(pruned)
+
+		// the ones that were pruned don't contain the point either
+
+		for _, wof := range candidates {
+			is_checked[wof.Id] = true
+		}
+
+		for _, wof := range tier {
+			is_contained[wof.Id] = true
+		}
+
+		contained = append(contained, tier...)
+		remaining = rest
+	}
+
+	remaining = p.pruneByAncestors(lat, lon, remaining, is_contained, is_checked)
+
+	rest, _ := p.EnsureContained(lat, lon, remaining)
+	count += len(remaining)
+
+	contained = append(contained, rest...)
+
+	return contained, count, time.Since(t)
+}
+
+// pruneByAncestors removes every record that has ancestors at one of the
+// HierarchyPlacetypes none of which might contain the point
+
+func (p WOFPointInPolygon) pruneByAncestors(lat float64, lon float64, results []*geojson.WOFSpatial, is_contained map[int]bool, is_checked map[int]bool) []*geojson.WOFSpatial {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	// whether an ancestor might contain the point, see above
+
+	might := func(id int) bool {
+
+		if is_contained[id] {
+			return true
+		}
+
+		if is_checked[id] {
+			return false
+		}
+
+		spatial, ok := p.Spatials[id]
+
+		if !ok {
+			return true
+		}
+
+		min_lat, min_lon, max_lat, max_lon := coverageBounds(spatial)
+
+		return lat >= min_lat && lat <= max_lat && lon >= min_lon && lon <= max_lon
+	}
+
+	pruned := make([]*geojson.WOFSpatial, 0, len(results))
+
+	for _, wof := range results {
+
+		ancestors, ok := p.Ancestors[wof.Id]
+		keep := true
+
+		if ok {
+
+			for pt, ids := range ancestors {
+
+				if pt == wof.Placetype || len(ids) == 0 {
+					continue
+				}
+
+				any := false
+
+				for _, id := range ids {
+
+					if might(id) {
+						any = true
+						break
+					}
+				}
+
+				if !any {
+					keep = false
+					break
+				}
+			}
+		}
+
+		if keep {
+			pruned = append(pruned, wof)
+		} else {
+			p.Logger.Debug("skipping %d (%s) because none of its ancestors contain %f, %f", wof.Id, wof.Placetype, lat, lon)
+		}
+	}
+
+	var c metrics.Counter
+	c = *p.Metrics.CountHierarchyPruned
+	go c.Inc(int64(len(results) - len(pruned)))
+
+	return pruned
+}
@@ -0,0 +1,322 @@
+package pip
+
+import (
+	"errors"
+	"fmt"
+	rtreego "github.com/dhconnelly/rtreego"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"math"
+	"sync"
+)
+
+// WOFSpatialIndex is anything that can find the records whose bounding box intersects
+// a rectangle. Implementations don't need to be safe for concurrent use, that's what
+// WOFPointInPolygon's lock is for, although SearchIntersect may be called from more
+// than one goroutine at once. A rectangle intersects a bounding box if they overlap
+// by more than just an edge, which is what rtreego does.
+//
+// There are two of them:
+//
+//	rtree - the default, an rtreego.Rtree
+//	grid  - a uniform grid of cells DefaultGridCellSize degrees on a side. Each
+//	        record is listed in every cell its bounding box overlaps, unless that
+//	        would be more than DefaultGridMaxCells cells in which case it goes in a
+//	        list that is checked for every search. Searching is faster than the
+//	        Rtree for small records like localities and neighbourhoods but big
+//	        ones (countries, regions) are all checked one after the other.
+//
+// The wof-pip-index-bench tool compares them for a set of meta files.
+
+type WOFSpatialIndex interface {
+	Insert(spatial *geojson.WOFSpatial)
+	Delete(spatial *geojson.WOFSpatial) bool
+	SearchIntersect(rect *rtreego.Rect) []rtreego.Spatial
+	Size() int
+}
+
+type WOFIndexBackend int
+
+const (
+	IndexRtree WOFIndexBackend = iota
+	IndexGrid
+)
+
+func (b WOFIndexBackend) String() string {
+
+	switch b {
+	case IndexGrid:
+		return "grid"
+	default:
+		return "rtree"
+	}
+}
+
+func IndexBackendFromString(name string) (WOFIndexBackend, error) {
+
+	switch name {
+	case "", "rtree":
+		return IndexRtree, nil
+	case "grid":
+		return IndexGrid, nil
+	default:
+		return IndexRtree, errors.New(fmt.Sprintf("unknown index backend '%s', expected rtree or grid", name))
+	}
+}
+
+func NewSpatialIndex(backend WOFIndexBackend) WOFSpatialIndex {
+
+	switch backend {
+	case IndexGrid:
+		return NewGridIndex(DefaultGridCellSize, DefaultGridMaxCells)
+	default:
+		return NewRtreeIndex()
+	}
+}
+
+type WOFRtreeIndex struct {
+	Rtree *rtreego.Rtree
+}
+
+func NewRtreeIndex() *WOFRtreeIndex {
+
+	i := WOFRtreeIndex{
+		Rtree: rtreego.NewTree(2, 25, 50),
+	}
+
+	return &i
+}
+
+func (i *WOFRtreeIndex) Insert(spatial *geojson.WOFSpatial) {
+	i.Rtree.Insert(spatial)
+}
+
+func (i *WOFRtreeIndex) Delete(spatial *geojson.WOFSpatial) bool {
+	return i.Rtree.Delete(spatial)
+}
+
+func (i *WOFRtreeIndex) SearchIntersect(rect *rtreego.Rect) []rtreego.Spatial {
+	return i.Rtree.SearchIntersect(rect)
+}
+
+func (i *WOFRtreeIndex) Size() int {
+	return i.Rtree.Size()
+}
+
+const DefaultGridCellSize = 0.25
+
+const DefaultGridMaxCells = 64
+
+type WOFGridIndex struct {
+	CellSize float64
+	MaxCells int
+	cells    map[uint64][]*geojson.WOFSpatial
+	big      []*geojson.WOFSpatial
+	count    int
+	pool     *sync.Pool
+}
+
+func NewGridIndex(cell_size float64, max_cells int) *WOFGridIndex {
+
+	i := WOFGridIndex{
+		CellSize: cell_size,
+		MaxCells: max_cells,
+		cells:    make(map[uint64][]*geojson.WOFSpatial),
+		big:      make([]*geojson.WOFSpatial, 0),
+		pool: &sync.Pool{
+			New: func() interface{} {
+				return make(map[int]bool)
+			},
+		},
+	}
+
+	return &i
+}
+
+func gridBounds(rect *rtreego.Rect) (float64, float64, float64, float64) {
+
+	min_x := rect.PointCoord(0)
+	min_y := rect.PointCoord(1)
+
+	return min_x, min_y, min_x + rect.LengthsCoord(0), min_y + rect.LengthsCoord(1)
+}
+
+// the range of cells a rectangle overlaps; since cells are keyed by uint32s the
+// world is shifted so that everything is positive
+
+func (i *WOFGridIndex) cellRange(rect *rtreego.Rect) (int64, int64, int64, int64) {
+
+	min_x, min_y, max_x, max_y := gridBounds(rect)
+
+	cell := func(v float64, origin float64) int64 {
+		return int64(math.Floor((v + origin) / i.CellSize))
+	}
+
+	return cell(min_x, 180.0), cell(min_y, 90.0), cell(max_x, 180.0), cell(max_y, 90.0)
+}
+
+func gridKey(cx int64, cy int64) uint64 {
+	return uint64(uint32(cy))<<32 | uint64(uint32(cx))
+}
+
+func (i *WOFGridIndex) Insert(spatial *geojson.WOFSpatial) {
+
+	i.count += 1
+
+	x0, y0, x1, y1 := i.cellRange(spatial.Bounds())
+
+	if (x1-x0+1)*(y1-y0+1) > int64(i.MaxCells) {
+		i.big = append(i.big, spatial)
+		return
+	}
+
+	for cy := y0; cy <= y1; cy++ {
+		for cx := x0; cx <= x1; cx++ {
+			key := gridKey(cx, cy)
+			i.cells[key] = append(i.cells[key], spatial)
+		}
+	}
+}
+
+func gridRemove(list []*geojson.WOFSpatial, spatial *geojson.WOFSpatial) ([]*geojson.WOFSpatial, bool) {
+
+	for idx, other := range list {
+
+		if other == spatial {
+			last := len(list) - 1
+			list[idx] = list[last]
+			list[last] = nil
+			return list[:last], true
+		}
+	}
+
+	return list, false
+}
+
+func (i *WOFGridIndex) Delete(spatial *geojson.WOFSpatial) bool {
+
+	x0, y0, x1, y1 := i.cellRange(spatial.Bounds())
+
+	removed := false
+
+	if (x1-x0+1)*(y1-y0+1) > int64(i.MaxCells) {
+
+		i.big, removed = gridRemove(i.big, spatial)
+
+	} else {
+
+		for cy := y0; cy <= y1; cy++ {
+
+			for cx := x0; cx <= x1; cx++ {
+
+				key := gridKey(cx, cy)
+
+				list, ok := gridRemove(i.cells[key], spatial)
+
+				if !ok {
+					continue
+				}
+
+				removed = true
+
+				if len(list) == 0 {
+					delete(i.cells, key)
+				} else {
+					i.cells[key] = list
+				}
+			}
+		}
+	}
+
+	if removed {
+		i.count -= 1
+	}
+
+	return removed
+}
+
+func (i *WOFGridIndex) SearchIntersect(rect *rtreego.Rect) []rtreego.Spatial {
+
+	results := make([]rtreego.Spatial, 0)
+
+	min_x, min_y, max_x, max_y := gridBounds(rect)
+
+	// same as rtreego, touching isn't intersecting
+
+	intersects := func(spatial *geojson.WOFSpatial) bool {
+
+		s_min_x, s_min_y, s_max_x, s_max_y := gridBounds(spatial.Bounds())
+		return !(s_max_x <= min_x || max_x <= s_min_x || s_max_y <= min_y || max_y <= s_min_y)
+	}
+
+	for _, spatial := range i.big {
+
+		if intersects(spatial) {
+			results = append(results, spatial)
+		}
+	}
+
+	x0, y0, x1, y1 := i.cellRange(rect)
+
+	// a record can be in more than one of the cells we're looking at
+
+	var seen map[int]bool
+
+	if x0 != x1 || y0 != y1 {
+		seen = i.pool.Get().(map[int]bool)
+		defer i.pool.Put(seen)
+		defer func() {
+			for id := range seen {
+				delete(seen, id)
+			}
+		}()
+	}
+
+	visit := func(list []*geojson.WOFSpatial) {
+
+		for _, spatial := range list {
+
+			if seen != nil {
+
+				if seen[spatial.Id] {
+					continue
+				}
+
+				seen[spatial.Id] = true
+			}
+
+			if intersects(spatial) {
+				results = append(results, spatial)
+			}
+		}
+	}
+
+	// for a really big rectangle it's quicker to look at the cells that have
+	// something in them than every cell that it overlaps
+
+	if (x1-x0+1)*(y1-y0+1) > int64(len(i.cells)) {
+
+		for key, list := range i.cells {
+
+			cx := int64(uint32(key))
+			cy := int64(key >> 32)
+
+			if cx >= x0 && cx <= x1 && cy >= y0 && cy <= y1 {
+				visit(list)
+			}
+		}
+
+		return results
+	}
+
+	for cy := y0; cy <= y1; cy++ {
+		for cx := x0; cx <= x1; cx++ {
+			visit(i.cells[gridKey(cx, cy)])
+		}
+	}
+
+	return results
+}
+
+func (i *WOFGridIndex) Size() int {
+	return i.count
+}
@@ -0,0 +1,360 @@
+package pip
+
+import (
+	"math"
+	"sort"
+	"unsafe"
+)
+
+// Most lookups land well inside a big polygon rather than anywhere near its edges
+// so when a polygon is prepared we also look for a few large rectangles that are
+// entirely inside it (and outside all of its holes). A point in one of those is
+// contained, whatever the boundary rule, without looking at a single edge.
+//
+// The rectangles are found by laying a coarse grid over the polygon, throwing out
+// every cell that an edge comes near and keeping the cells whose centre is inside
+// the polygon (or rather, whose centre the even-odd rule says is inside; like Locate
+// this assumes that holes are inside the outer ring). Since no edge passes through
+// what's left the whole of each of those cells is inside. Then we take the biggest
+// rectangles of cells we can find.
+
+// the grid is interiorGridSize x interiorGridSize cells
+
+const interiorGridSize = 64
+
+// the maximum number of rectangles per polygon
+
+const interiorMaxRects = 8
+
+// the minimum number of cells in a rectangle worth keeping
+
+const interiorMinCells = 4
+
+type wofInteriorRect struct {
+	MinX float64
+	MinY float64
+	MaxX float64
+	MaxY float64
+}
+
+func (r wofInteriorRect) contains(lat float64, lon float64) bool {
+	return lon >= r.MinX && lon <= r.MaxX && lat >= r.MinY && lat <= r.MaxY
+}
+
+// InInteriorRect returns true if the point is inside one of the polygon's interior
+// rectangles, in which case it is definitely inside the polygon. A false doesn't
+// mean anything.
+
+func (p *WOFCompactPolygon) InInteriorRect(lat float64, lon float64) bool {
+
+	for _, r := range p.interior {
+
+		if r.contains(lat, lon) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *WOFCompactPolygon) HasInteriorRects() bool {
+	return len(p.interior) > 0
+}
+
+func (p *WOFCompactPolygon) CountInteriorRects() int {
+	return len(p.interior)
+}
+
+func (p *WOFCompactPolygon) findInteriorRects() {
+
+	outer := p.OuterRing
+
+	if outer.Count < 3 || outer.MaxX <= outer.MinX || outer.MaxY <= outer.MinY {
+		return
+	}
+
+	n := interiorGridSize
+
+	x0 := outer.MinX
+	y0 := outer.MinY
+	w := (outer.MaxX - outer.MinX) / float64(n)
+	h := (outer.MaxY - outer.MinY) / float64(n)
+
+	inside, _ := classifyCells(p.Rings(), x0, y0, w, h, n, n)
+
+	any_inside := false
+
+	for _, in := range inside {
+
+		if in {
+			any_inside = true
+			break
+		}
+	}
+
+	if !any_inside {
+		return
+	}
+
+	rects := make([]wofInteriorRect, 0)
+
+	for len(rects) < interiorMaxRects {
+
+		min_cx, min_cy, max_cx, max_cy, cells := largestRect(inside, n)
+
+		if cells < interiorMinCells {
+			break
+		}
+
+		for cy := min_cy; cy <= max_cy; cy++ {
+			for cx := min_cx; cx <= max_cx; cx++ {
+				inside[cy*n+cx] = false
+			}
+		}
+
+		rect := wofInteriorRect{
+			MinX: x0 + float64(min_cx)*w,
+			MinY: y0 + float64(min_cy)*h,
+			MaxX: x0 + float64(max_cx+1)*w,
+			MaxY: y0 + float64(max_cy+1)*h,
+		}
+
+		// the original boundary of a simplified polygon can be anywhere
+		// within its tolerance of the simplified one (see simplify.go) so
+		// keep well clear of it
+
+		if p.tolerance > 0 {
+
+			margin := 2 * p.tolerance * simplifyBandSlack
+
+			rect.MinX += margin
+			rect.MinY += margin
+			rect.MaxX -= margin
+			rect.MaxY -= margin
+
+			if rect.MinX >= rect.MaxX || rect.MinY >= rect.MaxY {
+				continue
+			}
+		}
+
+		rects = append(rects, rect)
+	}
+
+	// biggest first, since that's the one most points will land in
+
+	sort.SliceStable(rects, func(i int, j int) bool {
+		return (rects[i].MaxX-rects[i].MinX)*(rects[i].MaxY-rects[i].MinY) > (rects[j].MaxX-rects[j].MinX)*(rects[j].MaxY-rects[j].MinY)
+	})
+
+	p.interior = rects
+}
+
+// classifyCells lays a grid of nx by ny cells, each w by h and starting at x0, y0,
+// over a polygon (a list of flat rings, the outer one first) and returns which of
+// the cells are inside it and which ones an edge comes near. Every cell that no
+// edge comes near is either entirely inside or entirely outside the polygon, and
+// no cell is both inside and near an edge.
+
+func classifyCells(rings [][]float64, x0 float64, y0 float64, w float64, h float64, nx int, ny int) ([]bool, []bool) {
+
+	cell := func(v float64, origin float64, size float64, n int) int {
+
+		i := int(math.Floor((v - origin) / size))
+
+		if i < 0 {
+			return 0
+		}
+
+		if i >= n {
+			return n - 1
+		}
+
+		return i
+	}
+
+	// rather than worry about edges that are exactly on (or rounding errors away
+	// from) the side of a cell we throw out the cells either side of anything the
+	// edge's bounding box touches
+
+	dirty := make([]bool, nx*ny)
+
+	for _, coords := range rings {
+
+		count := len(coords) / 2
+
+		for i := 0; i < count; i++ {
+
+			j := i - 1
+
+			if i == 0 {
+				j = count - 1
+			}
+
+			x1, y1 := coords[i*2], coords[i*2+1]
+			x2, y2 := coords[j*2], coords[j*2+1]
+
+			lo_x := cell(math.Min(x1, x2), x0, w, nx) - 1
+			hi_x := cell(math.Max(x1, x2), x0, w, nx) + 1
+			lo_y := cell(math.Min(y1, y2), y0, h, ny) - 1
+			hi_y := cell(math.Max(y1, y2), y0, h, ny) + 1
+
+			for cy := lo_y; cy <= hi_y; cy++ {
+
+				if cy < 0 || cy >= ny {
+					continue
+				}
+
+				for cx := lo_x; cx <= hi_x; cx++ {
+
+					if cx >= 0 && cx < nx {
+						dirty[cy*nx+cx] = true
+					}
+				}
+			}
+		}
+	}
+
+	// rather than test the centre of every cell, which is slow for rings that
+	// aren't prepared, work out where each row of centres crosses the rings
+	// and count crossings to the right of each centre, which is what the ray
+	// cast would have done
+
+	crossings := make([][]float64, ny)
+
+	for _, coords := range rings {
+
+		count := len(coords) / 2
+
+		for i := 0; i < count; i++ {
+
+			j := i - 1
+
+			if i == 0 {
+				j = count - 1
+			}
+
+			x1, y1 := coords[i*2], coords[i*2+1]
+			x2, y2 := coords[j*2], coords[j*2+1]
+
+			if y1 > y2 {
+				x1, y1, x2, y2 = x2, y2, x1, y1
+			}
+
+			for cy := cell(y1, y0, h, ny); cy <= cell(y2, y0, h, ny); cy++ {
+
+				lat := y0 + (float64(cy)+0.5)*h
+
+				if (y1 > lat) == (y2 > lat) {
+					continue
+				}
+
+				crossings[cy] = append(crossings[cy], (x2-x1)*(lat-y1)/(y2-y1)+x1)
+			}
+		}
+	}
+
+	inside := make([]bool, nx*ny)
+
+	for cy := 0; cy < ny; cy++ {
+
+		xs := crossings[cy]
+		sort.Float64s(xs)
+
+		k := 0
+
+		for cx := 0; cx < nx; cx++ {
+
+			lon := x0 + (float64(cx)+0.5)*w
+
+			for k < len(xs) && xs[k] <= lon {
+				k += 1
+			}
+
+			if !dirty[cy*nx+cx] && (len(xs)-k)%2 == 1 {
+				inside[cy*nx+cx] = true
+			}
+		}
+	}
+
+	return inside, dirty
+}
+
+// largestRect returns the largest rectangle of true cells in an n x n grid, using
+// the usual "largest rectangle in a histogram" trick for each row
+
+func largestRect(cells []bool, n int) (int, int, int, int, int) {
+
+	heights := make([]int, n)
+	best := 0
+
+	var min_cx, min_cy, max_cx, max_cy int
+
+	for cy := 0; cy < n; cy++ {
+
+		for cx := 0; cx < n; cx++ {
+
+			if cells[cy*n+cx] {
+				heights[cx] += 1
+			} else {
+				heights[cx] = 0
+			}
+		}
+
+		stack := make([]int, 0, n+1)
+
+		for cx := 0; cx <= n; cx++ {
+
+			cur := 0
+
+			if cx < n {
+				cur = heights[cx]
+			}
+
+			for len(stack) > 0 && heights[stack[len(stack)-1]] >= cur {
+
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+
+				height := heights[top]
+				left := 0
+
+				if len(stack) > 0 {
+					left = stack[len(stack)-1] + 1
+				}
+
+				area := height * (cx - left)
+
+				if height > 0 && area > best {
+					best = area
+					min_cx = left
+					max_cx = cx - 1
+					min_cy = cy - height + 1
+					max_cy = cy
+				}
+			}
+
+			stack = append(stack, cx)
+		}
+	}
+
+	return min_cx, min_cy, max_cx, max_cy, best
+}
+
+// Rings returns the polygon's rings as flat lists of (longitude, latitude) pairs,
+// the outer ring first
+
+func (p *WOFCompactPolygon) Rings() [][]float64 {
+
+	rings := make([][]float64, 0)
+	rings = append(rings, p.OuterRing.Coords())
+
+	for _, r := range p.InteriorRings {
+		rings = append(rings, r.Coords())
+	}
+
+	return rings
+}
+
+func (p *WOFCompactPolygon) interiorSize() int {
+	return cap(p.interior) * int(unsafe.Sizeof(wofInteriorRect{}))
+}
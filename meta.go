@@ -0,0 +1,180 @@
+package pip
+
+import (
+	"errors"
+	"fmt"
+	gabs "github.com/jeffail/gabs"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"strconv"
+	"strings"
+)
+
+// The meta files already have (nearly) everything EnSpatialize wants to know about a
+// record so when IndexFromMeta is true IndexMetaFile builds the index straight from
+// the CSV rows and doesn't open any GeoJSON files at all. Geometries are loaded the
+// first time a record is checked for containment, same as always. Rows that are
+// missing any of the columns below (or whose bounding box has no area, which usually
+// means a Point) are indexed by reading the GeoJSON file instead.
+
+var metaColumns = []string{
+	"name",
+	"placetype",
+	"deprecated",
+	"superseded",
+	"superseded_by",
+}
+
+var metaBboxColumns = []string{
+	"bbox",
+	"geom_bbox",
+}
+
+// SpatialFromMetaRow returns a geojson.WOFSpatial for a meta file row, or an error
+// if the row doesn't have enough information to make one.
+
+func SpatialFromMetaRow(row map[string]string) (*geojson.WOFSpatial, error) {
+
+	id, ok := IdFromMetaRow(row)
+
+	if !ok {
+		return nil, errors.New("unable to determine ID")
+	}
+
+	for _, col := range metaColumns {
+
+		_, ok := row[col]
+
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("missing '%s' column", col))
+		}
+	}
+
+	if row["placetype"] == "" {
+		return nil, errors.New("empty 'placetype' column")
+	}
+
+	bbox, err := bboxFromMetaRow(row)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Point records get skipped by IndexGeoJSONFeature; we can't tell what
+	// the geometry type is from here but a bounding box with no area is a
+	// pretty good hint (and rtreego won't accept it anyway)
+
+	if bbox[2] <= bbox[0] || bbox[3] <= bbox[1] {
+		return nil, errors.New("bounding box has no area")
+	}
+
+	superseded_by := make([]interface{}, 0)
+
+	for _, str_id := range strings.Split(row["superseded_by"], ",") {
+
+		str_id = strings.TrimSpace(str_id)
+
+		if str_id == "" {
+			continue
+		}
+
+		superseded_by = append(superseded_by, str_id)
+	}
+
+	// this is the same trick UnmarshalFeatureProperties uses so that we get
+	// exactly what EnSpatialize would have given us for the GeoJSON file
+
+	parsed := gabs.New()
+
+	parsed.Set([]interface{}{bbox[0], bbox[1], bbox[2], bbox[3]}, "bbox")
+	parsed.Set(float64(id), "properties", "wof:id")
+	parsed.Set(row["name"], "properties", "wof:name")
+	parsed.Set(row["placetype"], "properties", "wof:placetype")
+	parsed.Set(row["deprecated"], "properties", "edtf:deprecated")
+	parsed.Set(row["superseded"], "properties", "edtf:superseded")
+	parsed.Set(superseded_by, "properties", "wof:superseded_by")
+
+	feature := geojson.WOFFeature{
+		Parsed: parsed,
+	}
+
+	return feature.EnSpatialize()
+}
+
+func bboxFromMetaRow(row map[string]string) ([]float64, error) {
+
+	for _, col := range metaBboxColumns {
+
+		str_bbox, ok := row[col]
+
+		if !ok || str_bbox == "" {
+			continue
+		}
+
+		parts := strings.Split(str_bbox, ",")
+
+		if len(parts) != 4 {
+			return nil, errors.New(fmt.Sprintf("invalid '%s' column", col))
+		}
+
+		bbox := make([]float64, 4)
+
+		for i, str_coord := range parts {
+
+			coord, err := strconv.ParseFloat(strings.TrimSpace(str_coord), 64)
+
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid '%s' column, because %s", col, err))
+			}
+
+			bbox[i] = coord
+		}
+
+		return bbox, nil
+	}
+
+	return nil, errors.New("missing 'bbox' column")
+}
+
+// indexMetaRow indexes a meta file row without reading the GeoJSON file it points
+// to, returning false if it couldn't (in which case the caller should read it).
+
+func (p WOFPointInPolygon) indexMetaRow(rel_path string, row map[string]string) bool {
+
+	spatial, err := SpatialFromMetaRow(row)
+
+	if err != nil {
+		p.Logger.Debug("can not index '%s' from meta file, because %s, reading it instead", rel_path, err)
+		return false
+	}
+
+	err = p.indexSpatialFeature(spatial, nil, LabelFromMetaRow(row))
+
+	if err != nil {
+		p.Logger.Debug("can not index '%s' from meta file, because %s, reading it instead", rel_path, err)
+		return false
+	}
+
+	// there's no body to hash but the meta file lists the geometry hash (and
+	// maybe the last modified time) so a Reindex with the same meta file, or a
+	// saved cache, doesn't have to read the record to know it hasn't changed.
+	// There's no file size to guess how slow it will be to load either so only
+	// pinned records are pre-cached
+
+	if row["geom_hash"] != "" {
+
+		hashes, ok := HashesFromMetaRow(row)
+
+		if !ok {
+			hashes = &WOFRecordHashes{Geom: row["geom_hash"]}
+		}
+
+		p.setHashes(spatial.Id, hashes)
+	}
+
+	if p.CachePolicy.IsPinned(spatial.Placetype) {
+		p.Logger.Debug("scheduling %s for pre-caching because its placetype is pinned", rel_path)
+		p.Precache.Add(spatial.Id, PrecachePriorityPinned)
+	}
+
+	return true
+}
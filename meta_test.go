@@ -0,0 +1,92 @@
+package pip
+
+import (
+	"testing"
+)
+
+func testMetaRow() map[string]string {
+
+	return map[string]string{
+		"id":            "85922583",
+		"path":          "859/225/83/85922583.geojson",
+		"name":          "San Francisco",
+		"placetype":     "locality",
+		"bbox":          "-122.515,37.708,-122.357,37.833",
+		"deprecated":    "",
+		"superseded":    "",
+		"superseded_by": "",
+		"geom_hash":     "abc",
+		"lastmodified":  "1490000000",
+	}
+}
+
+func TestSpatialFromMetaRow(t *testing.T) {
+
+	spatial, err := SpatialFromMetaRow(testMetaRow())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spatial.Id != 85922583 || spatial.Name != "San Francisco" || spatial.Placetype != "locality" {
+		t.Errorf("got %d (%s, %s)", spatial.Id, spatial.Name, spatial.Placetype)
+	}
+
+	for _, col := range []string{"name", "placetype", "deprecated", "superseded", "superseded_by"} {
+
+		row := testMetaRow()
+		delete(row, col)
+
+		_, err := SpatialFromMetaRow(row)
+
+		if err == nil {
+			t.Errorf("expected a row without a '%s' column to be an error", col)
+		}
+	}
+
+	row := testMetaRow()
+	row["bbox"] = "-122.515,37.708,-122.515,37.708"
+
+	_, err = SpatialFromMetaRow(row)
+
+	if err == nil {
+		t.Errorf("expected a bounding box with no area to be an error")
+	}
+}
+
+func TestIndexMetaRowHashes(t *testing.T) {
+
+	p := newTestPointInPolygon(t, NewMemoryReader())
+
+	row := testMetaRow()
+
+	if !p.indexMetaRow(row["path"], row) {
+		t.Fatalf("failed to index meta row")
+	}
+
+	hashes, ok := p.GetHashes(85922583)
+
+	if !ok || hashes.Geom != "abc" || hashes.LastModified != 1490000000 {
+		t.Errorf("expected hashes from the meta row, got %v", hashes)
+	}
+
+	// a geometry hash on its own is still worth having
+
+	delete(row, "lastmodified")
+	p.indexMetaRow(row["path"], row)
+
+	hashes, ok = p.GetHashes(85922583)
+
+	if !ok || hashes.Geom != "abc" || hashes.LastModified != 0 {
+		t.Errorf("expected just the geometry hash, got %v", hashes)
+	}
+
+	delete(row, "geom_hash")
+	p.indexMetaRow(row["path"], row)
+
+	_, ok = p.GetHashes(85922583)
+
+	if ok {
+		t.Errorf("expected no hashes without a geom_hash column")
+	}
+}
@@ -0,0 +1,196 @@
+package pip
+
+import (
+	"errors"
+	gabs "github.com/jeffail/gabs"
+	"github.com/tidwall/gjson"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+)
+
+// Parsing a whole GeoJSON file with gabs (which is what geojson.UnmarshalFeature
+// does) means building a map[string]interface{} for every property and an
+// []interface{} for every coordinate. Most of the time we only want one half of
+// the document: the coordinates when we're loading polygons for a containment
+// check and a handful of properties when we're indexing. These use gjson to pluck
+// out just the bits we need without decoding anything else.
+
+// GeometryRingsFromGeoJSON returns the coordinates for a Polygon or MultiPolygon
+// feature as a list of polygons, each of which is a list of rings (the first one
+// being the outer ring) of flat (longitude, latitude) pairs. Other geometry types
+// return an empty list, same as GeomToPolygons.
+
+func GeometryRingsFromGeoJSON(body []byte) ([][][]float64, error) {
+
+	geom := gjson.GetBytes(body, "geometry")
+
+	if !geom.Exists() {
+		return nil, errors.New("feature is missing a geometry")
+	}
+
+	geom_type := geom.Get("type").String()
+	coords := geom.Get("coordinates")
+
+	rings := make([][][]float64, 0)
+
+	switch geom_type {
+
+	case "Polygon":
+
+		rings = append(rings, polygonFromResult(coords))
+
+	case "MultiPolygon":
+
+		coords.ForEach(func(_, poly gjson.Result) bool {
+			rings = append(rings, polygonFromResult(poly))
+			return true
+		})
+
+	default:
+		// pass
+	}
+
+	return rings, nil
+}
+
+func polygonFromResult(poly gjson.Result) [][]float64 {
+
+	rings := make([][]float64, 0)
+
+	poly.ForEach(func(_, ring gjson.Result) bool {
+
+		coords := make([]float64, 0)
+
+		ring.ForEach(func(_, pt gjson.Result) bool {
+
+			// this is what geojson.DumpCoords does: anything past the
+			// second value (like an elevation) is ignored
+
+			var xy [2]float64
+			i := 0
+
+			pt.ForEach(func(_, v gjson.Result) bool {
+				xy[i] = v.Float()
+				i += 1
+				return i < 2
+			})
+
+			if i == 2 {
+				coords = append(coords, xy[0], xy[1])
+			}
+
+			return true
+		})
+
+		rings = append(rings, coords)
+		return true
+	})
+
+	return rings
+}
+
+func CompactPolygonsFromGeoJSON(body []byte, encoding WOFCompactEncoding) ([]*WOFCompactPolygon, error) {
+
+	rings, err := GeometryRingsFromGeoJSON(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return CompactPolygonsFromRings(rings, encoding), nil
+}
+
+// these are the only things that geojson.WOFFeature.EnSpatialize (and Id, Name and
+// so on) look at, plus the hierarchy and label point which indexing keeps track of
+// itself; note that we don't include the geometry, only its type
+
+var indexProperties = []string{
+	"wof:id",
+	"id",
+	"wof:name",
+	"name",
+	"wof:placetype",
+	"placetype",
+	"edtf:deprecated",
+	"edtf:superseded",
+	"wof:superseded_by",
+	"wof:hierarchy",
+	"lbl:latitude",
+	"lbl:longitude",
+}
+
+// UnmarshalFeatureProperties returns a geojson.WOFFeature containing only what is
+// needed to index a record: its bounding box, geometry type and the properties
+// listed above. It is much faster than geojson.UnmarshalFeature for big geometries
+// but GeomToPolygons (and anything else that wants coordinates) won't work.
+
+func UnmarshalFeatureProperties(body []byte) (*geojson.WOFFeature, error) {
+
+	results := gjson.GetManyBytes(body, "bbox", "geometry.type", "id", "properties")
+
+	bbox := results[0]
+	geom_type := results[1]
+	top_id := results[2]
+	props := results[3]
+
+	if !props.Exists() || props.Type != gjson.JSON {
+		return nil, errors.New("feature is missing a properties dictionary")
+	}
+
+	parsed := gabs.New()
+
+	if bbox.Exists() {
+		parsed.Set(bbox.Value(), "bbox")
+	}
+
+	if geom_type.Exists() {
+		parsed.Set(geom_type.Value(), "geometry", "type")
+	}
+
+	if top_id.Exists() {
+		parsed.Set(top_id.Value(), "id")
+	}
+
+	parsed.Object("properties")
+
+	for _, key := range indexProperties {
+
+		value := props.Get(key)
+
+		if value.Exists() {
+			parsed.Set(value.Value(), "properties", key)
+		}
+	}
+
+	// geojson.WOFFeature.Superseded assumes this is always present and panics
+	// if it isn't
+
+	if !parsed.Exists("properties", "wof:superseded_by") {
+		parsed.Set(make([]interface{}, 0), "properties", "wof:superseded_by")
+	}
+
+	feature := geojson.WOFFeature{
+		Parsed: parsed,
+	}
+
+	return &feature, nil
+}
+
+// UnmarshalFeatureGeometry is the other half of UnmarshalFeatureProperties; it
+// returns the polygons for a feature without decoding any of its properties
+
+func UnmarshalFeatureGeometry(body []byte) ([]*geojson.WOFPolygon, error) {
+
+	rings, err := GeometryRingsFromGeoJSON(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	polygons := make([]*geojson.WOFPolygon, 0)
+
+	for _, compact := range CompactPolygonsFromRings(rings, CompactFloat64) {
+		polygons = append(polygons, compact.ToPolygon())
+	}
+
+	return polygons, nil
+}
@@ -0,0 +1,200 @@
+package pip
+
+import (
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The fast paths in parse.go have to give exactly the same answers as parsing the
+// whole feature with geojson.UnmarshalFeature, which is what they replaced.
+
+var parseFixtures = []string{
+	"polygon.geojson",
+	"multipolygon.geojson",
+	"point.geojson",
+	"no-bbox.geojson",
+	"no-superseded-by.geojson",
+}
+
+func readParseFixture(t *testing.T, name string) []byte {
+
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "parse", name))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+// parseFull is geojson.UnmarshalFeature except that it adds an empty
+// wof:superseded_by if there isn't one, since geojson.WOFFeature.Superseded
+// panics without it
+
+func parseFull(t *testing.T, body []byte) *geojson.WOFFeature {
+
+	feature, err := geojson.UnmarshalFeature(body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !feature.Body().Exists("properties", "wof:superseded_by") {
+		feature.Body().Set(make([]interface{}, 0), "properties", "wof:superseded_by")
+	}
+
+	return feature
+}
+
+func polygonPoints(polygons []*geojson.WOFPolygon) [][][][2]float64 {
+
+	points := make([][][][2]float64, 0)
+
+	for _, poly := range polygons {
+
+		rings := make([][][2]float64, 0)
+		outer := make([][2]float64, 0)
+
+		for _, pt := range poly.OuterRing.Points() {
+			outer = append(outer, [2]float64{pt.Lng(), pt.Lat()})
+		}
+
+		rings = append(rings, outer)
+
+		for _, ring := range poly.InteriorRings {
+
+			pts := make([][2]float64, 0)
+
+			for _, pt := range ring.Points() {
+				pts = append(pts, [2]float64{pt.Lng(), pt.Lat()})
+			}
+
+			rings = append(rings, pts)
+		}
+
+		points = append(points, rings)
+	}
+
+	return points
+}
+
+func TestUnmarshalFeatureGeometry(t *testing.T) {
+
+	expected_counts := map[string]int{
+		"polygon.geojson":          1,
+		"multipolygon.geojson":     3,
+		"point.geojson":            0,
+		"no-bbox.geojson":          1,
+		"no-superseded-by.geojson": 1,
+	}
+
+	for _, name := range parseFixtures {
+
+		t.Run(name, func(t *testing.T) {
+
+			body := readParseFixture(t, name)
+
+			expected := parseFull(t, body).GeomToPolygons()
+
+			got, err := UnmarshalFeatureGeometry(body)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != expected_counts[name] {
+				t.Errorf("got %d polygons, expected %d", len(got), expected_counts[name])
+			}
+
+			if !reflect.DeepEqual(polygonPoints(expected), polygonPoints(got)) {
+				t.Errorf("got %v, expected %v", polygonPoints(got), polygonPoints(expected))
+			}
+
+			// and the compact polygons made from the same rings
+
+			compact, err := CompactPolygonsFromGeoJSON(body, CompactFloat64)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			from_compact := make([]*geojson.WOFPolygon, 0)
+
+			for _, c := range compact {
+				from_compact = append(from_compact, c.ToPolygon())
+			}
+
+			if !reflect.DeepEqual(polygonPoints(expected), polygonPoints(from_compact)) {
+				t.Errorf("compact polygons are %v, expected %v", polygonPoints(from_compact), polygonPoints(expected))
+			}
+		})
+	}
+}
+
+func TestUnmarshalFeatureProperties(t *testing.T) {
+
+	for _, name := range parseFixtures {
+
+		t.Run(name, func(t *testing.T) {
+
+			body := readParseFixture(t, name)
+
+			full := parseFull(t, body)
+
+			props, err := UnmarshalFeatureProperties(body)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected, expected_err := full.EnSpatialize()
+			got, got_err := props.EnSpatialize()
+
+			if (expected_err == nil) != (got_err == nil) {
+				t.Fatalf("EnSpatialize returned '%v', expected '%v'", got_err, expected_err)
+			}
+
+			if expected_err != nil {
+				return
+			}
+
+			if got.Id != expected.Id || got.Name != expected.Name || got.Placetype != expected.Placetype {
+				t.Errorf("got %d (%s, %s), expected %d (%s, %s)", got.Id, got.Name, got.Placetype, expected.Id, expected.Name, expected.Placetype)
+			}
+
+			if got.Deprecated != expected.Deprecated || got.Superseded != expected.Superseded {
+				t.Errorf("got deprecated %t and superseded %t, expected %t and %t", got.Deprecated, got.Superseded, expected.Deprecated, expected.Superseded)
+			}
+
+			if got.Bounds().String() != expected.Bounds().String() {
+				t.Errorf("got bounds %s, expected %s", got.Bounds(), expected.Bounds())
+			}
+
+			if !reflect.DeepEqual(props.Hierarchy(), full.Hierarchy()) {
+				t.Errorf("got hierarchy %v, expected %v", props.Hierarchy(), full.Hierarchy())
+			}
+
+			if !reflect.DeepEqual(LabelFromFeature(props), LabelFromFeature(full)) {
+				t.Errorf("got label %v, expected %v", LabelFromFeature(props), LabelFromFeature(full))
+			}
+		})
+	}
+}
+
+func TestUnmarshalFeaturePropertiesErrors(t *testing.T) {
+
+	_, err := UnmarshalFeatureProperties([]byte(`{"type":"Feature","geometry":{"type":"Polygon","coordinates":[]}}`))
+
+	if err == nil {
+		t.Errorf("expected a feature without properties to be an error")
+	}
+
+	_, err = GeometryRingsFromGeoJSON([]byte(`{"type":"Feature","properties":{}}`))
+
+	if err == nil {
+		t.Errorf("expected a feature without a geometry to be an error")
+	}
+}
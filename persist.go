@@ -0,0 +1,218 @@
+package pip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	csv "github.com/whosonfirst/go-whosonfirst-csv"
+	"io"
+	"os"
+	"strconv"
+)
+
+// A cache snapshot is a CSV file listing the records that were in the cache when
+// it was saved, pinned records first and then the rest ordered by how many times
+// they were hit. It looks like this:
+//
+//	id,placetype,hits,geom_hash
+//	85633793,country,20471,b2a8a58e9a69...
+//
+// Since the first column is a WOF ID it can also be passed to WarmFromFile. The
+// polygons themselves can be saved as well, in which case they are written to a
+// geometry store called {path}.geometries and the geometry hash is used to make
+// sure that we don't restore polygons for a record that has changed since.
+
+func CacheSnapshotGeometriesPath(path string) string {
+	return path + ".geometries"
+}
+
+// SaveCache writes a snapshot of the cache to path, and the polygons for everything
+// in the cache if include_polygons is true. It returns the number of records saved.
+
+func (p WOFPointInPolygon) SaveCache(path string, include_polygons bool) (int, error) {
+
+	entries := p.Cache.Entries()
+
+	var buf bytes.Buffer
+	buf.WriteString("id,placetype,hits,geom_hash\n")
+
+	for _, e := range entries {
+
+		geom_hash := ""
+
+		hashes, ok := p.GetHashes(e.Id)
+
+		if ok {
+			geom_hash = hashes.Geom
+		}
+
+		buf.WriteString(fmt.Sprintf("%d,%s,%d,%s\n", e.Id, e.Placetype, e.Hits, geom_hash))
+	}
+
+	geom_path := CacheSnapshotGeometriesPath(path)
+
+	if include_polygons {
+
+		tmp_path := geom_path + ".tmp"
+
+		store, err := CreateGeometryStore(tmp_path)
+
+		if err != nil {
+			return 0, err
+		}
+
+		for _, e := range entries {
+
+			polygons, ok := p.Cache.Peek(e.Id)
+
+			// it may have been evicted since we asked for the list of entries
+			// and simplified polygons aren't the originals, so leave both of
+			// them to be read from the data source again when restoring
+
+			if !ok || AnySimplified(polygons) {
+				continue
+			}
+
+			rings := make([][][]float64, 0)
+
+			for _, poly := range polygons {
+
+				poly_rings := make([][]float64, 0)
+				poly_rings = append(poly_rings, poly.OuterRing.Coords())
+
+				for _, r := range poly.InteriorRings {
+					poly_rings = append(poly_rings, r.Coords())
+				}
+
+				rings = append(rings, poly_rings)
+			}
+
+			err = store.AddRings(e.Id, rings)
+
+			if err != nil {
+				store.Close()
+				os.Remove(tmp_path)
+				return 0, err
+			}
+		}
+
+		err = store.Close()
+
+		if err != nil {
+			os.Remove(tmp_path)
+			return 0, err
+		}
+
+		err = os.Rename(tmp_path, geom_path)
+
+		if err != nil {
+			return 0, err
+		}
+
+	} else {
+
+		// don't leave polygons from an older snapshot lying around to be restored
+
+		os.Remove(geom_path)
+	}
+
+	err := writeFileAtomic(path, buf.Bytes())
+
+	if err != nil {
+		return 0, err
+	}
+
+	p.Logger.Status("saved %d cached records to %s", len(entries), path)
+	return len(entries), nil
+}
+
+// RestoreCache schedules everything listed in a cache snapshot for pre-caching, in
+// the order it is listed, and returns the number of records that were scheduled. It
+// should be called after indexing since records that aren't indexed are skipped.
+
+func (p WOFPointInPolygon) RestoreCache(path string) (int, error) {
+
+	reader, err := csv.NewDictReaderFromPath(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var store *WOFGeometryStore
+	geom_path := CacheSnapshotGeometriesPath(path)
+
+	_, err = os.Stat(geom_path)
+
+	if err == nil {
+
+		// This never gets closed, which is fine because it's one filehandle and
+		// we don't know when the pre-cache queue will be done with it
+
+		store, err = OpenGeometryStore(geom_path)
+
+		if err != nil {
+			p.Logger.Warning("failed to open %s, polygons will be loaded normally, because %s", geom_path, err)
+			store = nil
+		}
+	}
+
+	scheduled := 0
+	from_store := 0
+
+	for {
+		row, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return scheduled, err
+		}
+
+		str_id, ok := row["id"]
+
+		if !ok {
+			return scheduled, errors.New(fmt.Sprintf("%s is missing an 'id' column", path))
+		}
+
+		id, err := strconv.Atoi(str_id)
+
+		if err != nil {
+			p.Logger.Warning("invalid ID '%s' in %s", str_id, path)
+			continue
+		}
+
+		// only use the saved polygons if the geometry hasn't changed since they
+		// were saved
+
+		use_store := false
+
+		if store != nil && store.Has(id) {
+
+			current, ok := p.GetHashes(id)
+
+			if ok && current.Geom != "" && current.Geom == row["geom_hash"] {
+				use_store = true
+			}
+		}
+
+		if use_store {
+			ok = p.Precache.AddFromStore(id, PrecachePriorityWarm, store)
+		} else {
+			ok = p.Precache.Add(id, PrecachePriorityWarm)
+		}
+
+		if ok {
+
+			scheduled += 1
+
+			if use_store {
+				from_store += 1
+			}
+		}
+	}
+
+	p.Logger.Status("scheduled %d records from %s for pre-caching (%d using saved polygons)", scheduled, path, from_store)
+	return scheduled, nil
+}
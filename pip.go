@@ -1,34 +1,46 @@
 package pip
 
 import (
-	_ "fmt"
+	"fmt"
 	rtreego "github.com/dhconnelly/rtreego"
-	lru "github.com/hashicorp/golang-lru"
 	metrics "github.com/rcrowley/go-metrics"
 	csv "github.com/whosonfirst/go-whosonfirst-csv"
 	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
 	log "github.com/whosonfirst/go-whosonfirst-log"
 	utils "github.com/whosonfirst/go-whosonfirst-utils"
 	"io"
+	"io/ioutil"
 	golog "log"
 	"os"
-	"path"
+	"runtime"
 	"sync"
 	"time"
 )
 
 type WOFPointInPolygonMetrics struct {
-	Registry        *metrics.Registry
-	CountUnmarshal  *metrics.Counter
-	CountCacheHit   *metrics.Counter
-	CountCacheMiss  *metrics.Counter
-	CountCacheSet   *metrics.Counter
-	CountLookups    *metrics.Counter
-	TimeToUnmarshal *metrics.Timer
-	TimeToIntersect *metrics.Timer
-	TimeToInflate   *metrics.Timer
-	TimeToContain   *metrics.Timer
-	TimeToProcess   *metrics.Timer
+	Registry             *metrics.Registry
+	CountUnmarshal       *metrics.Counter
+	CountCacheHit        *metrics.Counter
+	CountCacheMiss       *metrics.Counter
+	CountCacheSet        *metrics.Counter
+	CountLookups         *metrics.Counter
+	CountCacheBytes      *metrics.Counter
+	CountRectHit         *metrics.Counter
+	CountRectMiss        *metrics.Counter
+	CountCoverageHit     *metrics.Counter
+	CountCoverageMiss    *metrics.Counter
+	CountHierarchyPruned *metrics.Counter
+	CountResultHit       *metrics.Counter
+	CountResultMiss      *metrics.Counter
+	CountResultSkipped   *metrics.Counter
+	CountSimplifyFar     *metrics.Counter
+	CountSimplifyNear    *metrics.Counter
+	CacheRecordBytes     *metrics.Histogram
+	TimeToUnmarshal      *metrics.Timer
+	TimeToIntersect      *metrics.Timer
+	TimeToInflate        *metrics.Timer
+	TimeToContain        *metrics.Timer
+	TimeToProcess        *metrics.Timer
 }
 
 type WOFPointInPolygonFilters map[string]interface{} // these get expanded in func (p WOFPointInPolygon) Filter
@@ -42,6 +54,19 @@ func NewPointInPolygonMetrics() *WOFPointInPolygonMetrics {
 	cnt_cache_hit := metrics.NewCounter()
 	cnt_cache_miss := metrics.NewCounter()
 	cnt_cache_set := metrics.NewCounter()
+	cnt_cache_bytes := metrics.NewCounter()
+	cnt_rect_hit := metrics.NewCounter()
+	cnt_rect_miss := metrics.NewCounter()
+	cnt_coverage_hit := metrics.NewCounter()
+	cnt_coverage_miss := metrics.NewCounter()
+	cnt_hierarchy_pruned := metrics.NewCounter()
+	cnt_result_hit := metrics.NewCounter()
+	cnt_result_miss := metrics.NewCounter()
+	cnt_result_skipped := metrics.NewCounter()
+	cnt_simplify_far := metrics.NewCounter()
+	cnt_simplify_near := metrics.NewCounter()
+
+	hst_cache_bytes := metrics.NewHistogram(metrics.NewUniformSample(1028))
 
 	tm_unmarshal := metrics.NewTimer()
 	tm_intersect := metrics.NewTimer()
@@ -54,6 +79,18 @@ func NewPointInPolygonMetrics() *WOFPointInPolygonMetrics {
 	registry.Register("pip.cache.hit", cnt_cache_hit)
 	registry.Register("pip.cache.miss", cnt_cache_miss)
 	registry.Register("pip.cache.set", cnt_cache_set)
+	registry.Register("pip.cache.bytes", cnt_cache_bytes)
+	registry.Register("pip.cache.record.bytes", hst_cache_bytes)
+	registry.Register("pip.contains.rect.hit", cnt_rect_hit)
+	registry.Register("pip.contains.rect.miss", cnt_rect_miss)
+	registry.Register("pip.coverage.hit", cnt_coverage_hit)
+	registry.Register("pip.coverage.miss", cnt_coverage_miss)
+	registry.Register("pip.hierarchy.pruned", cnt_hierarchy_pruned)
+	registry.Register("pip.results.hit", cnt_result_hit)
+	registry.Register("pip.results.miss", cnt_result_miss)
+	registry.Register("pip.results.skipped", cnt_result_skipped)
+	registry.Register("pip.simplify.far", cnt_simplify_far)
+	registry.Register("pip.simplify.near", cnt_simplify_near)
 	registry.Register("pip.timer.reversegeo", tm_process)
 	registry.Register("pip.timer.unmarshal", tm_unmarshal)
 	// registry.Register("time-to-intersect", tm_intersect)
@@ -61,17 +98,29 @@ func NewPointInPolygonMetrics() *WOFPointInPolygonMetrics {
 	registry.Register("pip.timer.containment", tm_contain)
 
 	m := WOFPointInPolygonMetrics{
-		Registry:        &registry,
-		CountLookups:    &cnt_lookups,
-		CountUnmarshal:  &cnt_unmarshal,
-		CountCacheHit:   &cnt_cache_hit,
-		CountCacheMiss:  &cnt_cache_miss,
-		CountCacheSet:   &cnt_cache_set,
-		TimeToUnmarshal: &tm_unmarshal,
-		TimeToIntersect: &tm_intersect,
-		TimeToInflate:   &tm_inflate,
-		TimeToContain:   &tm_contain,
-		TimeToProcess:   &tm_process,
+		Registry:             &registry,
+		CountLookups:         &cnt_lookups,
+		CountUnmarshal:       &cnt_unmarshal,
+		CountCacheHit:        &cnt_cache_hit,
+		CountCacheMiss:       &cnt_cache_miss,
+		CountCacheSet:        &cnt_cache_set,
+		CountCacheBytes:      &cnt_cache_bytes,
+		CountRectHit:         &cnt_rect_hit,
+		CountRectMiss:        &cnt_rect_miss,
+		CountCoverageHit:     &cnt_coverage_hit,
+		CountCoverageMiss:    &cnt_coverage_miss,
+		CountHierarchyPruned: &cnt_hierarchy_pruned,
+		CountResultHit:       &cnt_result_hit,
+		CountResultMiss:      &cnt_result_miss,
+		CountResultSkipped:   &cnt_result_skipped,
+		CountSimplifyFar:     &cnt_simplify_far,
+		CountSimplifyNear:    &cnt_simplify_near,
+		CacheRecordBytes:     &hst_cache_bytes,
+		TimeToUnmarshal:      &tm_unmarshal,
+		TimeToIntersect:      &tm_intersect,
+		TimeToInflate:        &tm_inflate,
+		TimeToContain:        &tm_contain,
+		TimeToProcess:        &tm_process,
 	}
 
 	metrics.RegisterRuntimeMemStats(registry)
@@ -95,14 +144,37 @@ func NewWOFPointInPolygonTiming(event string, d time.Duration) *WOFPointInPolygo
 }
 
 type WOFPointInPolygon struct {
-	Rtree        *rtreego.Rtree
-	Cache        *lru.Cache
-	CacheSize    int
-	CacheTrigger int
-	Source       string
-	Placetypes   map[string]int
-	Metrics      *WOFPointInPolygonMetrics
-	Logger       *log.WOFLogger
+	Index             WOFSpatialIndex
+	IndexBackend      WOFIndexBackend
+	Cache             *WOFPolygonCache
+	Originals         *WOFPolygonCache
+	CacheSize         int
+	CachePolicy       *WOFCachePolicy
+	CacheEncoding     WOFCompactEncoding
+	PrepareThreshold  int
+	SimplifyTolerance float64
+	Boundary          WOFBoundaryRule
+	Edges             *WOFEdgePolicy
+	Strategy          WOFLookupStrategy
+	Source            string
+	Reader            WOFReader
+	Geometries        *WOFGeometryStore
+	Precache          *WOFPrecacheQueue
+	Coverage          *WOFCoverage
+	Results           *WOFResultCache
+	Containment       *WOFContainmentPool
+	IndexFromMeta     bool
+	PlacetypeIndexes  map[string]WOFSpatialIndex
+	Spatials          map[int]*geojson.WOFSpatial
+	Hashes            map[int]*WOFRecordHashes
+	Reindexed         map[int]bool
+	Ancestors         map[int]WOFRecordAncestors
+	Labels            map[int]*WOFLabelPoint
+	Shapes            map[int]*WOFRecordShape
+	Metrics           *WOFPointInPolygonMetrics
+	Logger            *log.WOFLogger
+	mu                *sync.RWMutex
+	reindex_mu        *sync.Mutex
 }
 
 func NewPointInPolygonSimple(source string) (*WOFPointInPolygon, error) {
@@ -118,29 +190,91 @@ func NewPointInPolygonSimple(source string) (*WOFPointInPolygon, error) {
 
 func NewPointInPolygon(source string, cache_size int, cache_trigger int, logger *log.WOFLogger) (*WOFPointInPolygon, error) {
 
-	rtree := rtreego.NewTree(2, 25, 50)
+	// source may be a directory, a .tar, .tar.gz or .zip bundle or
+	// the URL of a remote data host
 
-	cache, err := lru.New(cache_size)
+	reader, err := NewReader(source)
 
 	if err != nil {
 		return nil, err
 	}
 
+	return NewPointInPolygonWithReader(reader, cache_size, cache_trigger, logger)
+}
+
+func NewPointInPolygonWithReader(reader WOFReader, cache_size int, cache_trigger int, logger *log.WOFLogger) (*WOFPointInPolygon, error) {
+
+	bundle, ok := reader.(*WOFBundle)
+
+	if ok {
+
+		logger.Status("bundle %s contains %d records", bundle.Path, bundle.Count())
+
+		if bundle.Format == "tar.gz" {
+			logger.Warning("reading individual records from a compressed bundle is slow, consider using a .tar or .zip bundle or caching everything")
+		}
+	}
+
+	// to use a different spatial index set p.IndexBackend and p.Index (see index.go)
+	// before indexing anything
+
+	index := NewSpatialIndex(IndexRtree)
+
 	metrics := NewPointInPolygonMetrics()
 
-	placetypes := make(map[string]int)
+	// cache_size is the number of megabytes to use for caching polygons, if you want
+	// to count vertices instead replace p.Cache with your own WOFPolygonCache
+
+	cache, err := NewPolygonCache(CacheMeasureBytes, int64(cache_size)*1024*1024, metrics)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// this is only used if SimplifyTolerance is set (see simplify.go)
+
+	originals, err := NewPolygonCache(CacheMeasureBytes, DefaultSimplifyOriginalsSize, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	placetype_indexes := make(map[string]WOFSpatialIndex)
+	spatials := make(map[int]*geojson.WOFSpatial)
+	hashes := make(map[int]*WOFRecordHashes)
+	reindexed := make(map[int]bool)
+	ancestors := make(map[int]WOFRecordAncestors)
+	labels := make(map[int]*WOFLabelPoint)
+	shapes := make(map[int]*WOFRecordShape)
+
+	mu := new(sync.RWMutex)
 
 	pip := WOFPointInPolygon{
-		Rtree:        rtree,
-		Source:       source,
-		Cache:        cache,
-		CacheSize:    cache_size,
-		CacheTrigger: cache_trigger,
-		Placetypes:   placetypes,
-		Metrics:      metrics,
-		Logger:       logger,
+		Index:            index,
+		Source:           fmt.Sprintf("%v", reader),
+		Reader:           reader,
+		Cache:            cache,
+		Originals:        originals,
+		CacheSize:        cache_size,
+		CachePolicy:      NewCachePolicy(cache_trigger),
+		PrepareThreshold: DefaultPrepareThreshold,
+		Edges:            NewEdgePolicy(EdgePlanar),
+		PlacetypeIndexes: placetype_indexes,
+		Spatials:         spatials,
+		Hashes:           hashes,
+		Reindexed:        reindexed,
+		Ancestors:        ancestors,
+		Labels:           labels,
+		Shapes:           shapes,
+		Metrics:          metrics,
+		Logger:           logger,
+		mu:               mu,
+		reindex_mu:       new(sync.Mutex),
 	}
 
+	pip.Precache = NewPrecacheQueue(&pip, 4, 100000)
+	pip.Containment = NewContainmentPool(runtime.NumCPU())
+
 	return &pip, nil
 }
 
@@ -166,11 +300,22 @@ func (p WOFPointInPolygon) IndexGeoJSONFile(path string) error {
 
 	p.Logger.Debug("index %s", path)
 
-	t := time.Now()
+	body, read_err := ioutil.ReadFile(path)
 
-	feature, parse_err := p.LoadGeoJSON(path)
+	if read_err != nil {
+		p.Logger.Error("failed to read %s, because %s", path, read_err)
+		return read_err
+	}
 
-	d := time.Since(t)
+	return p.IndexGeoJSONBytes(path, body)
+}
+
+// IndexGeoJSONBytes indexes a GeoJSON document that has already been read from
+// somewhere; 'label' is only used for logging.
+
+func (p WOFPointInPolygon) IndexGeoJSONBytes(label string, body []byte) error {
+
+	feature, parse_err := p.UnmarshalGeoJSONProperties(label, body)
 
 	if parse_err != nil {
 		return parse_err
@@ -182,11 +327,24 @@ func (p WOFPointInPolygon) IndexGeoJSONFile(path string) error {
 		return index_err
 	}
 
-	ttl := float64(d) / 1e9
+	hashes, hash_err := HashFeature(body)
+
+	if hash_err != nil {
+		p.Logger.Warning("failed to hash %s, because %s", label, hash_err)
+	} else {
+		p.setHashes(feature.Id(), hashes)
+	}
+
+	// this used to be "anything that takes more than 0.01 seconds to parse" but
+	// we don't parse the geometry while indexing anymore so the size of the file
+	// is the best guess we've got for how slow it will be to load later
 
-	if ttl > 0.01 {
-		p.Logger.Debug("scheduling %s for pre-caching because its time to load exceeds 0.01 seconds: %f", path, ttl)
-		go p.LoadPolygonsForFeature(feature)
+	if p.CachePolicy.IsPinned(feature.Placetype()) {
+		p.Logger.Debug("scheduling %s for pre-caching because its placetype is pinned", label)
+		p.Precache.Add(feature.Id(), PrecachePriorityPinned)
+	} else if len(body) > PrecacheSlowBytes {
+		p.Logger.Debug("scheduling %s for pre-caching because it is bigger than %d bytes: %d", label, PrecacheSlowBytes, len(body))
+		p.Precache.Add(feature.Id(), PrecachePrioritySlow)
 	}
 
 	return nil
@@ -211,26 +369,162 @@ func (p WOFPointInPolygon) IndexGeoJSONFeature(feature *geojson.WOFFeature) erro
 		return spatial_err
 	}
 
-	return p.IndexSpatialFeature(spatial)
+	return p.indexSpatialFeature(spatial, AncestorsFromFeature(feature), LabelFromFeature(feature))
 }
 
 func (p WOFPointInPolygon) IndexSpatialFeature(spatial *geojson.WOFSpatial) error {
 
+	return p.indexSpatialFeature(spatial, nil, nil)
+}
+
+func (p WOFPointInPolygon) indexSpatialFeature(spatial *geojson.WOFSpatial, ancestors WOFRecordAncestors, label *WOFLabelPoint) error {
+
+	// Great circle edges can bend outside the bounding box of their vertices so
+	// records with them are indexed with a bounding box that's big enough for
+	// that (see edges.go)
+
+	if p.Edges.IsGeodesic(spatial.Placetype) {
+
+		geodesic, err := geodesicSpatial(spatial)
+
+		if err != nil {
+			return err
+		}
+
+		spatial = geodesic
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// If we are re-indexing a record (because it was updated on disk) then
+	// remove the old version first so that we don't end up with two copies
+	// of the same place in the Rtree, both of them answering lookups
+
+	_, exists := p.Spatials[spatial.Id]
+
+	if exists {
+		p.unindex(spatial.Id)
+	}
+
+	// Every record is in the global index and in the index for its placetype
+	// so that lookups filtered by placetype don't have to wade through (and
+	// then throw away) all the countries and regions and counties
+
 	pt := spatial.Placetype
 
-	_, ok := p.Placetypes[pt]
+	pt_index, ok := p.PlacetypeIndexes[pt]
 
-	if ok {
-		p.Placetypes[pt] += 1
-	} else {
-		p.Placetypes[pt] = 1
+	if !ok {
+		pt_index = NewSpatialIndex(p.IndexBackend)
+		p.PlacetypeIndexes[pt] = pt_index
 	}
 
-	p.Rtree.Insert(spatial)
+	p.Index.Insert(spatial)
+	pt_index.Insert(spatial)
+	p.Spatials[spatial.Id] = spatial
+
+	if ancestors != nil {
+		p.Ancestors[spatial.Id] = ancestors
+	}
+
+	if label != nil {
+		p.Labels[spatial.Id] = label
+	}
+
+	if p.Coverage != nil {
+		p.Coverage.Invalidate(spatial)
+	}
+
+	if p.Results != nil {
+		p.Results.Clear()
+	}
 
 	return nil
 }
 
+func (p WOFPointInPolygon) UnindexId(id int) bool {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.unindex(id)
+}
+
+// assumes that p.mu has already been locked by the caller
+
+func (p WOFPointInPolygon) unindex(id int) bool {
+
+	spatial, ok := p.Spatials[id]
+
+	if !ok {
+		return false
+	}
+
+	p.Index.Delete(spatial)
+	delete(p.Spatials, id)
+	delete(p.Hashes, id)
+
+	// the geometry store (if there is one) is never updated so whatever it
+	// has for a record that has been removed, or is about to be indexed again,
+	// may well be out of date
+
+	p.Reindexed[id] = true
+
+	delete(p.Ancestors, id)
+	delete(p.Labels, id)
+	delete(p.Shapes, id)
+
+	pt := spatial.Placetype
+
+	pt_index, ok := p.PlacetypeIndexes[pt]
+
+	if ok {
+
+		pt_index.Delete(spatial)
+
+		if pt_index.Size() == 0 {
+			delete(p.PlacetypeIndexes, pt)
+		}
+	}
+
+	// The geometry may have changed (or gone away entirely) so
+	// don't let a stale copy keep answering containment checks
+
+	p.Cache.Remove(id)
+
+	if p.Originals != nil {
+		p.Originals.Remove(id)
+	}
+
+	if p.Coverage != nil {
+		p.Coverage.Invalidate(spatial)
+	}
+
+	if p.Results != nil {
+		p.Results.Clear()
+	}
+
+	return true
+}
+
+func (p WOFPointInPolygon) GetById(id int) (*geojson.WOFSpatial, bool) {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	spatial, ok := p.Spatials[id]
+	return spatial, ok
+}
+
+func (p WOFPointInPolygon) Size() int {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.Index.Size()
+}
+
 func (p WOFPointInPolygon) IndexMetaFile(csv_file string) error {
 
 	reader, reader_err := csv.NewDictReaderFromPath(csv_file)
@@ -243,6 +537,12 @@ func (p WOFPointInPolygon) IndexMetaFile(csv_file string) error {
 	// It is tempting to think that we could fan this out and process each row/file
 	// concurrently but that will make the Rtree sad... (20151020/thisisaaronland)
 
+	seq, ok := p.Reader.(WOFSequentialReader)
+
+	if ok {
+		return p.indexMetaFileSequential(reader, seq)
+	}
+
 	for {
 		row, err := reader.Read()
 
@@ -262,21 +562,129 @@ func (p WOFPointInPolygon) IndexMetaFile(csv_file string) error {
 			continue
 		}
 
-		abs_path := path.Join(p.Source, rel_path)
+		// alternate geometries have the same ID as the record they belong
+		// to, which is listed in a row of its own
 
-		_, err = os.Stat(abs_path)
+		if IsAltGeometryPath(rel_path) {
+			p.Logger.Debug("skipping alternate geometry '%s'", rel_path)
+			continue
+		}
+
+		id, ok := IdFromMetaRow(row)
+
+		if !ok {
+			p.Logger.Warning("unable to determine ID for '%s'", rel_path)
+			continue
+		}
+
+		if p.IndexFromMeta && p.indexMetaRow(rel_path, row) {
+			continue
+		}
+
+		body, err := p.Reader.Read(id)
 
 		if os.IsNotExist(err) {
-			p.Logger.Error("'%s' does not exist", abs_path)
+			p.Logger.Error("'%s' does not exist", rel_path)
 			continue
 		}
 
-		index_err := p.IndexGeoJSONFile(abs_path)
+		if err != nil {
+			p.Logger.Error("failed to read '%s', because %s", rel_path, err)
+			return err
+		}
+
+		index_err := p.IndexGeoJSONBytes(rel_path, body)
+
+		if index_err != nil {
+			p.Logger.Error("failed to index '%s', because %s", rel_path, index_err)
+			return index_err
+		}
+	}
+
+	return nil
+}
+
+// Some readers (like compressed bundles) are very slow to read one record at a
+// time so instead gather up all the IDs and read everything in a single pass.
+
+func (p WOFPointInPolygon) indexMetaFileSequential(reader *csv.DictReader, seq WOFSequentialReader) error {
+
+	ids := make(map[int]string)
+
+	for {
+		row, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			p.Logger.Error("failed to parse CSV row , because %s", err)
+			return err
+		}
+
+		rel_path, ok := row["path"]
+
+		if ok != true {
+			p.Logger.Warning("CSV row is missing a 'path' column")
+			continue
+		}
+
+		// alternate geometries have the same ID as the record they belong
+		// to, which is listed in a row of its own
+
+		if IsAltGeometryPath(rel_path) {
+			p.Logger.Debug("skipping alternate geometry '%s'", rel_path)
+			continue
+		}
+
+		id, ok := IdFromMetaRow(row)
+
+		if !ok {
+			p.Logger.Warning("unable to determine ID for '%s'", rel_path)
+			continue
+		}
+
+		if p.IndexFromMeta && p.indexMetaRow(rel_path, row) {
+			continue
+		}
+
+		ids[id] = rel_path
+	}
+
+	// which is the whole point of IndexFromMeta when the reader is a big
+	// compressed bundle
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	err := seq.Walk(func(id int, body []byte) error {
+
+		rel_path, ok := ids[id]
+
+		if !ok {
+			return nil
+		}
+
+		delete(ids, id)
+
+		index_err := p.IndexGeoJSONBytes(rel_path, body)
 
 		if index_err != nil {
-			p.Logger.Error("failed to index '%s', because %s", abs_path, index_err)
+			p.Logger.Error("failed to index '%s', because %s", rel_path, index_err)
 			return index_err
 		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, rel_path := range ids {
+		p.Logger.Error("'%s' does not exist", rel_path)
 	}
 
 	return nil
@@ -309,7 +717,45 @@ func (p WOFPointInPolygon) GetIntersectsByRect(rect *rtreego.Rect) ([]rtreego.Sp
 
 	t := time.Now()
 
-	results := p.Rtree.SearchIntersect(rect)
+	p.mu.RLock()
+	results := p.Index.SearchIntersect(rect)
+	p.mu.RUnlock()
+
+	d := time.Since(t)
+
+	var tm metrics.Timer
+	tm = *p.Metrics.TimeToIntersect
+	go tm.Update(d)
+
+	return results, d
+}
+
+func (p WOFPointInPolygon) GetIntersectsByLatLonForPlacetype(lat float64, lon float64, placetype string) ([]rtreego.Spatial, time.Duration) {
+
+	pt := rtreego.Point{lon, lat}
+	rect, _ := rtreego.NewRect(pt, []float64{0.0001, 0.0001})
+
+	return p.GetIntersectsByRectForPlacetype(rect, placetype)
+}
+
+// GetIntersectsByRectForPlacetype is GetIntersectsByRect but only searches the
+// records for a single placetype
+
+func (p WOFPointInPolygon) GetIntersectsByRectForPlacetype(rect *rtreego.Rect, placetype string) ([]rtreego.Spatial, time.Duration) {
+
+	t := time.Now()
+
+	results := make([]rtreego.Spatial, 0)
+
+	p.mu.RLock()
+
+	pt_index, ok := p.PlacetypeIndexes[placetype]
+
+	if ok {
+		results = pt_index.SearchIntersect(rect)
+	}
+
+	p.mu.RUnlock()
 
 	d := time.Since(t)
 
@@ -345,6 +791,25 @@ func (p WOFPointInPolygon) InflateSpatialResults(results []rtreego.Spatial) ([]*
 	return inflated, d
 }
 
+// assumes that p.mu has already been (read) locked by the caller; IDs that aren't
+// indexed anymore are skipped
+
+func (p WOFPointInPolygon) inflateIds(ids []int) []*geojson.WOFSpatial {
+
+	inflated := make([]*geojson.WOFSpatial, 0, len(ids))
+
+	for _, id := range ids {
+
+		spatial, ok := p.Spatials[id]
+
+		if ok {
+			inflated = append(inflated, spatial)
+		}
+	}
+
+	return inflated
+}
+
 func (p WOFPointInPolygon) GetByLatLon(lat float64, lon float64) ([]*geojson.WOFSpatial, []*WOFPointInPolygonTiming) {
 
 	filters := WOFPointInPolygonFilters{}
@@ -373,21 +838,136 @@ func (p WOFPointInPolygon) GetByLatLonFiltered(lat float64, lon float64, filters
 
 	timings := make([]*WOFPointInPolygonTiming, 0)
 
-	intersects, duration := p.GetIntersectsByLatLon(lat, lon)
-	timings = append(timings, NewWOFPointInPolygonTiming("intersects", duration))
+	// see results.go
+
+	var result_key string
+	var result_generation uint64
+
+	if p.Results != nil {
+
+		result_key, result_generation = p.Results.Key(lat, lon, filters)
+
+		cached, ok := p.Results.Get(result_key)
+
+		if ok {
+
+			var rc metrics.Counter
+			rc = *p.Metrics.CountResultHit
+			go rc.Inc(1)
+
+			timings = append(timings, NewWOFPointInPolygonTiming("results", time.Since(t)))
+			return cached, timings
+		}
+
+		var rc metrics.Counter
+		rc = *p.Metrics.CountResultMiss
+		go rc.Inc(1)
+	}
+
+	var contained []*geojson.WOFSpatial
+	var duration time.Duration
+
+	covered := false
+
+	if p.Coverage != nil {
+
+		// see coverage.go - records that fully cover the point's cell don't
+		// need to be checked at all, the rest are checked as usual
+
+		full, partial, ok := p.Coverage.Lookup(lat, lon)
+
+		if ok {
 
-	inflated, duration := p.InflateSpatialResults(intersects)
-	timings = append(timings, NewWOFPointInPolygonTiming("inflate", duration))
+			var cv metrics.Counter
+			cv = *p.Metrics.CountCoverageHit
+			go cv.Inc(1)
 
-	// See what's going on here? We are filtering by placetype before
-	// do a final point-in-poly lookup so we don't try to load country
-	// records while only searching for localities
+			covered = true
 
-	filtered, duration := p.Filter(inflated, filters)
-	timings = append(timings, NewWOFPointInPolygonTiming("filter", duration))
+			t1 := time.Now()
 
-	contained, duration := p.EnsureContained(lat, lon, filtered)
-	timings = append(timings, NewWOFPointInPolygonTiming("contain", duration))
+			p.mu.RLock()
+			inflated_full := p.inflateIds(full)
+			inflated_partial := p.inflateIds(partial)
+			p.mu.RUnlock()
+
+			// a cell is usually bigger than the point so only check the
+			// partial records whose bounding box the point is actually in,
+			// like the Rtree would have done
+
+			nearby := make([]*geojson.WOFSpatial, 0, len(inflated_partial))
+
+			for _, wof := range inflated_partial {
+
+				min_lat, min_lon, max_lat, max_lon := coverageBounds(wof)
+
+				if lat >= min_lat && lat <= max_lat && lon >= min_lon && lon <= max_lon {
+					nearby = append(nearby, wof)
+				}
+			}
+
+			inflated_partial = nearby
+
+			timings = append(timings, NewWOFPointInPolygonTiming("coverage", time.Since(t1)))
+
+			filtered_full, d1 := p.Filter(inflated_full, filters)
+			filtered_partial, d2 := p.Filter(inflated_partial, filters)
+			timings = append(timings, NewWOFPointInPolygonTiming("filter", d1+d2))
+
+			contained, duration = p.ensureContainedWithStrategy(lat, lon, filtered_partial, inflated_full, filters)
+			timings = append(timings, NewWOFPointInPolygonTiming("contain", duration))
+
+			contained = append(filtered_full, contained...)
+
+		} else {
+
+			var cv metrics.Counter
+			cv = *p.Metrics.CountCoverageMiss
+			go cv.Inc(1)
+		}
+	}
+
+	if !covered {
+
+		var intersects []rtreego.Spatial
+
+		placetype, ok := filters["placetype"].(string)
+
+		if ok {
+			intersects, duration = p.GetIntersectsByLatLonForPlacetype(lat, lon, placetype)
+		} else {
+			intersects, duration = p.GetIntersectsByLatLon(lat, lon)
+		}
+
+		timings = append(timings, NewWOFPointInPolygonTiming("intersects", duration))
+
+		inflated, duration := p.InflateSpatialResults(intersects)
+		timings = append(timings, NewWOFPointInPolygonTiming("inflate", duration))
+
+		// See what's going on here? We are filtering by placetype before
+		// do a final point-in-poly lookup so we don't try to load country
+		// records while only searching for localities
+
+		filtered, duration := p.Filter(inflated, filters)
+		timings = append(timings, NewWOFPointInPolygonTiming("filter", duration))
+
+		contained, duration = p.ensureContainedWithStrategy(lat, lon, filtered, nil, filters)
+		timings = append(timings, NewWOFPointInPolygonTiming("contain", duration))
+	}
+
+	if p.Results != nil {
+
+		t1 := time.Now()
+
+		if !p.cacheResults(lat, lon, filters, result_key, result_generation, contained) {
+
+			var rc metrics.Counter
+			rc = *p.Metrics.CountResultSkipped
+			go rc.Inc(1)
+		}
+
+		timings = append(timings, NewWOFPointInPolygonTiming("cache results", time.Since(t1)))
+	}
 
 	d := time.Since(t)
 
@@ -408,6 +988,21 @@ func (p WOFPointInPolygon) GetByLatLonFiltered(lat float64, lon float64, filters
 	return contained, timings
 }
 
+// ensureContainedWithStrategy calls EnsureContained or EnsureContainedHierarchy
+// depending on p.Strategy and the filters, see hierarchy.go
+
+func (p WOFPointInPolygon) ensureContainedWithStrategy(lat float64, lon float64, results []*geojson.WOFSpatial, known []*geojson.WOFSpatial, filters WOFPointInPolygonFilters) ([]*geojson.WOFSpatial, time.Duration) {
+
+	_, filtered := filters["placetype"]
+
+	if p.Strategy != LookupHierarchy || filtered {
+		return p.EnsureContained(lat, lon, results)
+	}
+
+	contained, _, d := p.EnsureContainedHierarchy(lat, lon, results, known)
+	return contained, d
+}
+
 // deprecated - just use Filter (20160722/thisisaaronland)
 
 func (p WOFPointInPolygon) FilterByPlacetype(results []*geojson.WOFSpatial, placetype string) ([]*geojson.WOFSpatial, time.Duration) {
@@ -460,15 +1055,11 @@ func (p WOFPointInPolygon) Filter(results []*geojson.WOFSpatial, filters WOFPoin
 func (p WOFPointInPolygon) EnsureContained(lat float64, lon float64, results []*geojson.WOFSpatial) ([]*geojson.WOFSpatial, time.Duration) {
 
 	// Okay - this isn't super complicated but it might look a bit scary
-	// We're using a WaitGroup to process each possible result *and* we
-	// are using (n) sub WaitGroups to process every polygon for each result
-	// separately (20151020/thisisaaronland)
+	// This used to use a WaitGroup to process each possible result in its
+	// own goroutine (20151020/thisisaaronland) and now hands them to a pool
+	// of workers shared by every lookup (see containment.go)
 
 	// See also: https://talks.golang.org/2012/concurrency.slide#46
-	// This is not what we're doing but it's essentially what the WaitGroups
-	// implement but with a different syntax/pattern
-
-	wg := new(sync.WaitGroup)
 
 	/*
 		Matt Amos [11:57]
@@ -485,82 +1076,113 @@ func (p WOFPointInPolygon) EnsureContained(lat float64, lon float64, results []*
 		I guess maybe Go is starting 1M “things” in the background, maybe?
 	*/
 
-	mu := new(sync.Mutex)
+	var rect_hit metrics.Counter
+	rect_hit = *p.Metrics.CountRectHit
 
-	contained := make([]*geojson.WOFSpatial, 0)
-	// timings := make([]*WOFPointInPolygonTiming, 0)
+	var rect_miss metrics.Counter
+	rect_miss = *p.Metrics.CountRectMiss
+
+	var simplify_far metrics.Counter
+	simplify_far = *p.Metrics.CountSimplifyFar
+
+	var simplify_near metrics.Counter
+	simplify_near = *p.Metrics.CountSimplifyNear
 
 	t := time.Now()
 
-	for _, wof := range results {
+	order := p.orderCandidates(results)
 
-		wg.Add(1)
+	/*
 
-		wg_ensure := func(wof *geojson.WOFSpatial) {
+		See this? This is important. Results used to be appended to a shared
+		'contained' array and, the one time we forgot to lock it, hilarity
+		inevitably ensued. Now each candidate gets its own slot in 'is_contained'
+		that only one goroutine ever writes to and nothing reads until they're
+		all done. So you know, don't go back to appending (20160112/thisisaaronland)
 
-			defer wg.Done()
+		https://github.com/whosonfirst/go-whosonfirst-pip/commit/986e527dbe9e62915757489db7c70d5140c53629
+		https://github.com/whosonfirst/go-whosonfirst-pip/issues/15
+		https://github.com/whosonfirst/go-whosonfirst-pip/issues/18
+	*/
 
-			polygons, err := p.LoadPolygons(wof)
+	is_contained := make([]bool, len(results))
 
-			if err != nil {
-				p.Logger.Error("failed to load polygons for %d, because %v", wof.Id, err)
-				return
-			}
+	check := func(i int) {
 
-			is_contained := false
+		wof := results[order[i]]
 
-			wg2 := new(sync.WaitGroup)
+		polygons, err := p.LoadCompactPolygons(wof)
 
-			for _, poly := range polygons {
+		if err != nil {
+			p.Logger.Error("failed to load polygons for %d, because %v", wof.Id, err)
+			return
+		}
 
-				wg2.Add(1)
+		// the simplified polygons in the cache give the same answer as the
+		// original ones unless the point is close to their edges, in which
+		// case use the originals (see simplify.go)
 
-				wg_contains := func(p *geojson.WOFPolygon, lt float64, ln float64) {
+		if AnyNearBoundary(polygons, lat, lon) {
 
-					defer wg2.Done()
+			go simplify_near.Inc(1)
 
-					if p.Contains(lt, ln) {
-						is_contained = true
-					}
-				}
+			full, err := p.loadOriginalPolygons(wof)
 
-				go wg_contains(poly, lat, lon)
+			if err != nil {
+				p.Logger.Error("failed to load the original polygons for %d, because %v", wof.Id, err)
+				return
 			}
 
-			wg2.Wait()
+			polygons = full
 
-			// All done checking the polygons - are we contained?
+		} else if AnySimplified(polygons) {
+			go simplify_far.Inc(1)
+		}
+
+		// Records rarely have more than a handful of polygons and the big ones
+		// are prepared (see prepared.go) so check them in order, most likely
+		// first, and stop as soon as one of them contains the point.
 
-			// d2 := time.Since(t2)
-			// contain_event := fmt.Sprintf("contain %d (%d/%d iterations, %d points)", id, iters, count, points)
-			// timings = append(timings, NewWOFPointInPolygonTiming(contain_event, d2))
+		edges := p.Edges.EdgeMode(wof.Placetype)
 
-			/*
+		for _, poly := range orderPolygons(polygons, lat, lon, edges) {
 
-				See this? This is important. Specifically the part where we are locking
-				updates to the 'contained' array. Which makes total sense obviously except
-				for the part where I completely spaced on this (despite all the chatter and
-				error checking around the waitgroups aboves...) and hilarity inevitably
-				ensued. So you know, don't do what I did... (20160112/thisisaaronland)
+			// a point in one of the polygon's interior rectangles is
+			// nowhere near an edge so we don't need to look at them,
+			// unless the edges aren't the straight lines the rectangles
+			// were worked out from
 
-				https://github.com/whosonfirst/go-whosonfirst-pip/commit/986e527dbe9e62915757489db7c70d5140c53629
-				https://github.com/whosonfirst/go-whosonfirst-pip/issues/15
-				https://github.com/whosonfirst/go-whosonfirst-pip/issues/18
-			*/
+			if edges == EdgePlanar && poly.HasInteriorRects() {
+
+				if poly.InInteriorRect(lat, lon) {
+					go rect_hit.Inc(1)
+					is_contained[order[i]] = true
+					return
+				}
 
-			if is_contained {
-				mu.Lock()
-				contained = append(contained, wof)
-				mu.Unlock()
+				go rect_miss.Inc(1)
 			}
-		}
 
-		go wg_ensure(wof)
+			if poly.ContainsWithEdges(lat, lon, p.Boundary, edges) {
+				is_contained[order[i]] = true
+				return
+			}
+		}
 	}
 
-	wg.Wait()
+	p.Containment.Run(len(results), check)
+
+	// All done checking the results, which are returned in the order they
+	// were passed in
+
+	contained := make([]*geojson.WOFSpatial, 0)
+
+	for i, wof := range results {
 
-	// All done checking the results
+		if is_contained[i] {
+			contained = append(contained, wof)
+		}
+	}
 
 	d := time.Since(t)
 
@@ -573,9 +1195,67 @@ func (p WOFPointInPolygon) EnsureContained(lat float64, lon float64, results []*
 
 func (p WOFPointInPolygon) LoadGeoJSON(path string) (*geojson.WOFFeature, error) {
 
+	body, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		p.Logger.Error("failed to read %s, because %s", path, err)
+		return nil, err
+	}
+
+	return p.UnmarshalGeoJSON(path, body)
+}
+
+func (p WOFPointInPolygon) LoadGeoJSONById(id int) (*geojson.WOFFeature, error) {
+
+	label := utils.Id2RelPath(id)
+
+	body, err := p.Reader.Read(id)
+
+	if err != nil {
+		p.Logger.Error("failed to read %s, because %s", label, err)
+		return nil, err
+	}
+
+	return p.UnmarshalGeoJSON(label, body)
+}
+
+// UnmarshalGeoJSON parses a GeoJSON document and records the usual metrics; 'label'
+// is only used for logging errors.
+
+func (p WOFPointInPolygon) UnmarshalGeoJSON(label string, body []byte) (*geojson.WOFFeature, error) {
+
+	t := time.Now()
+
+	feature, err := geojson.UnmarshalFeature(body)
+
+	d := time.Since(t)
+
+	var tm metrics.Timer
+	tm = *p.Metrics.TimeToUnmarshal
+
+	go tm.Update(d)
+
+	if err != nil {
+		p.Logger.Error("failed to unmarshal %s, because %s", label, err)
+		return nil, err
+	}
+
+	var c metrics.Counter
+	c = *p.Metrics.CountUnmarshal
+	go c.Inc(1)
+
+	return feature, err
+}
+
+// UnmarshalGeoJSONProperties is the same as UnmarshalGeoJSON except that the feature
+// it returns only has what's needed to index it (see UnmarshalFeatureProperties) so
+// don't go asking it for its polygons.
+
+func (p WOFPointInPolygon) UnmarshalGeoJSONProperties(label string, body []byte) (*geojson.WOFFeature, error) {
+
 	t := time.Now()
 
-	feature, err := geojson.UnmarshalFile(path)
+	feature, err := UnmarshalFeatureProperties(body)
 
 	d := time.Since(t)
 
@@ -585,7 +1265,7 @@ func (p WOFPointInPolygon) LoadGeoJSON(path string) (*geojson.WOFFeature, error)
 	go tm.Update(d)
 
 	if err != nil {
-		p.Logger.Error("failed to unmarshal %s, because %s", path, err)
+		p.Logger.Error("failed to unmarshal %s, because %s", label, err)
 		return nil, err
 	}
 
@@ -596,11 +1276,73 @@ func (p WOFPointInPolygon) LoadGeoJSON(path string) (*geojson.WOFFeature, error)
 	return feature, err
 }
 
+// UnmarshalCompactPolygons plucks the coordinates out of a GeoJSON document without
+// parsing anything else and records the usual metrics; 'label' is only used for
+// logging errors.
+
+func (p WOFPointInPolygon) UnmarshalCompactPolygons(label string, body []byte) ([]*WOFCompactPolygon, error) {
+
+	t := time.Now()
+
+	polygons, err := CompactPolygonsFromGeoJSON(body, p.CacheEncoding)
+
+	d := time.Since(t)
+
+	var tm metrics.Timer
+	tm = *p.Metrics.TimeToUnmarshal
+
+	go tm.Update(d)
+
+	if err != nil {
+		p.Logger.Error("failed to unmarshal %s, because %s", label, err)
+		return nil, err
+	}
+
+	var c metrics.Counter
+	c = *p.Metrics.CountUnmarshal
+	go c.Inc(1)
+
+	return polygons, err
+}
+
+// LoadPolygons is here for backwards compatibility and things that want geo.Point
+// thingies; it decodes the cached compact polygons so unless CacheEncoding is float64
+// the coordinates may be (very slightly) different from the source
+
 func (p WOFPointInPolygon) LoadPolygons(wof *geojson.WOFSpatial) ([]*geojson.WOFPolygon, error) {
 
+	compact, err := p.LoadCompactPolygons(wof)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// things that want the polygons themselves want the original ones rather
+	// than the simplified ones in the cache (see simplify.go)
+
+	if AnySimplified(compact) {
+
+		compact, err = p.loadOriginalPolygons(wof)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	polygons := make([]*geojson.WOFPolygon, 0)
+
+	for _, c := range compact {
+		polygons = append(polygons, c.ToPolygon())
+	}
+
+	return polygons, nil
+}
+
+func (p WOFPointInPolygon) LoadCompactPolygons(wof *geojson.WOFSpatial) ([]*WOFCompactPolygon, error) {
+
 	id := wof.Id
 
-	cache, ok := p.Cache.Get(id)
+	cache, ok := p.Cache.Get(id, wof.Placetype)
 
 	if ok {
 
@@ -608,35 +1350,136 @@ func (p WOFPointInPolygon) LoadPolygons(wof *geojson.WOFSpatial) ([]*geojson.WOF
 		c = *p.Metrics.CountCacheHit
 		go c.Inc(1)
 
-		polygons := cache.([]*geojson.WOFPolygon)
-		return polygons, nil
+		return cache, nil
 	}
 
 	var c metrics.Counter
 	c = *p.Metrics.CountCacheMiss
 	go c.Inc(1)
 
-	abs_path := utils.Id2AbsPath(p.Source, id)
-	feature, err := p.LoadGeoJSON(abs_path)
+	return p.loadCompactPolygons(wof)
+}
+
+// loadCompactPolygons loads (and maybe caches) the polygons for a record without
+// looking in the cache first
+
+func (p WOFPointInPolygon) loadCompactPolygons(wof *geojson.WOFSpatial) ([]*WOFCompactPolygon, error) {
+
+	t := time.Now()
+
+	polygons, err := p.readCompactPolygons(wof.Id)
 
 	if err != nil {
 		return nil, err
 	}
 
-	polygons, poly_err := p.LoadPolygonsForFeature(feature)
+	return p.cachePolygons(wof.Id, wof.Placetype, polygons, time.Since(t)), nil
+}
+
+func (p WOFPointInPolygon) isReindexed(id int) bool {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.Reindexed[id]
+}
+
+// readCompactPolygons reads the polygons for a record without looking in, or
+// adding them to, the cache
+
+func (p WOFPointInPolygon) readCompactPolygons(id int) ([]*WOFCompactPolygon, error) {
+
+	// if there's a geometry store try that first since it's a single read and
+	// no JSON parsing; anything that isn't in the store falls through to the
+	// reader like always
+
+	if p.Geometries != nil && !p.isReindexed(id) {
+
+		polygons, err := p.Geometries.ReadCompactPolygons(id, p.CacheEncoding)
+
+		if err == nil {
+			return polygons, nil
+		}
+
+		if !os.IsNotExist(err) {
+			p.Logger.Warning("failed to read %d from geometry store, because %s", id, err)
+		}
+	}
+
+	// we only need the coordinates so there's no point in parsing the whole
+	// feature (properties and all) the way LoadGeoJSONById does
 
-	if poly_err != nil {
-		return nil, poly_err
+	label := utils.Id2RelPath(id)
+
+	body, err := p.Reader.Read(id)
+
+	if err != nil {
+		p.Logger.Error("failed to read %s, because %s", label, err)
+		return nil, err
 	}
 
-	return polygons, nil
+	return p.UnmarshalCompactPolygons(label, body)
 }
 
 func (p WOFPointInPolygon) LoadPolygonsForFeature(feature *geojson.WOFFeature) ([]*geojson.WOFPolygon, error) {
 
 	id := feature.Id()
 
+	t := time.Now()
+
 	polygons := feature.GeomToPolygons()
+	compact := CompactPolygons(polygons, p.CacheEncoding)
+
+	p.cachePolygons(id, feature.Placetype(), compact, time.Since(t))
+
+	return polygons, nil
+}
+
+// loadOriginalPolygons returns the original, prepared, polygons for a record whose
+// polygons in the cache have been simplified, from p.Originals if they're in there
+// and otherwise by reading them and adding them to it
+
+func (p WOFPointInPolygon) loadOriginalPolygons(wof *geojson.WOFSpatial) ([]*WOFCompactPolygon, error) {
+
+	if p.Originals != nil {
+
+		polygons, ok := p.Originals.Get(wof.Id, wof.Placetype)
+
+		if ok {
+			return polygons, nil
+		}
+	}
+
+	t := time.Now()
+
+	polygons, err := p.readCompactPolygons(wof.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Originals == nil {
+		return polygons, nil
+	}
+
+	if p.PrepareThreshold > 0 {
+		PrepareCompactPolygons(polygons, p.PrepareThreshold)
+	}
+
+	_, err = p.Originals.Add(wof.Id, wof.Placetype, polygons, time.Since(t))
+
+	if err != nil {
+		p.Logger.Debug("failed to keep the original polygons for %d, because %s", wof.Id, err)
+	}
+
+	return polygons, nil
+}
+
+// load_time is how long it took to get from a WOF ID to a list of compact polygons
+// and is used by the cache to decide what to evict first
+
+func (p WOFPointInPolygon) cachePolygons(id int, placetype string, polygons []*WOFCompactPolygon, load_time time.Duration) []*WOFCompactPolygon {
+
 	var points int
 
 	for _, pl := range polygons {
@@ -645,32 +1488,75 @@ func (p WOFPointInPolygon) LoadPolygonsForFeature(feature *geojson.WOFFeature) (
 
 	p.Logger.Debug("%d has %d points", id, points)
 
-	if points >= p.CacheTrigger {
+	decision := p.CachePolicy.Decide(placetype, points)
+
+	if decision == CacheNever {
+		return polygons
+	}
 
-		p.Logger.Debug("caching %d because it has E_EXCESSIVE_POINTS (%d)", id, points)
+	// simplify first so that the edge grids and interior rectangles are for the
+	// simplified polygons (see simplify.go)
 
-		var c metrics.Counter
-		c = *p.Metrics.CountCacheSet
+	if p.SimplifyTolerance > 0 && !p.Edges.IsGeodesic(placetype) {
+		polygons = SimplifyCompactPolygons(polygons, p.SimplifyTolerance)
+	}
+
+	// do this before working out how big the polygons are since the edge grids
+	// count against the cache budget too; a threshold of 0 disables it
 
-		evicted := p.Cache.Add(id, polygons)
+	if p.PrepareThreshold > 0 {
+		PrepareCompactPolygons(polygons, p.PrepareThreshold)
+	}
+
+	size := CompactPolygonsSize(polygons)
 
-		if evicted == true {
+	var h metrics.Histogram
+	h = *p.Metrics.CacheRecordBytes
+	h.Update(int64(size))
+
+	var c metrics.Counter
+	c = *p.Metrics.CountCacheSet
 
-			cache_size := p.CacheSize
-			cache_set := c.Count()
+	if decision == CachePinned {
 
-			p.Logger.Warning("starting to push thing out of the cache %d sets on a cache size of %d", cache_set, cache_size)
+		p.Logger.Debug("pinning %d because it is a %s (%d points, %d bytes)", id, placetype, points, size)
+
+		err := p.Cache.Pin(id, placetype, polygons)
+
+		if err == nil {
+			go c.Inc(1)
+			return polygons
 		}
 
-		go c.Inc(1)
+		// there's no room left for pinned records so cache it like anything
+		// else, where it might at least get evicted
+
+		p.Logger.Warning("failed to pin %d, caching it instead, because %s", id, err)
 	}
 
-	return polygons, nil
+	p.Logger.Debug("caching %d because it has E_EXCESSIVE_POINTS (%d, %d bytes)", id, points, size)
+
+	evicted, err := p.Cache.Add(id, placetype, polygons, load_time)
+
+	if err != nil {
+		p.Logger.Warning("failed to cache %d, because %s", id, err)
+		return polygons
+	}
+
+	if evicted > 0 {
+		p.Logger.Warning("pushed %d things out of the cache to make room for %d, after %d sets on a cache budget of %d %s", evicted, id, c.Count(), p.Cache.Budget, p.Cache.Measure)
+	}
+
+	go c.Inc(1)
+	return polygons
 }
 
 func (p WOFPointInPolygon) IsKnownPlacetype(pt string) bool {
 
-	_, ok := p.Placetypes[pt]
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	_, ok := p.PlacetypeIndexes[pt]
 
 	if ok {
 		return true
@@ -678,3 +1564,19 @@ func (p WOFPointInPolygon) IsKnownPlacetype(pt string) bool {
 		return false
 	}
 }
+
+// Placetypes returns the number of records indexed for each placetype
+
+func (p WOFPointInPolygon) Placetypes() map[string]int {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	counts := make(map[string]int)
+
+	for pt, pt_index := range p.PlacetypeIndexes {
+		counts[pt] = pt_index.Size()
+	}
+
+	return counts
+}
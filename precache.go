@@ -0,0 +1,430 @@
+package pip
+
+import (
+	"bufio"
+	"container/heap"
+	metrics "github.com/rcrowley/go-metrics"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WOFPrecacheQueue loads (and caches, subject to the cache policy) the polygons for
+// records in the background using a fixed number of workers, so that pre-caching
+// doesn't start a goroutine for every slow record during indexing or compete with
+// lookups for more than a few CPUs. Records are loaded highest priority first and
+// in the order they were added for records with the same priority. Only IDs are
+// queued so records are read again (from the geometry store if there is one) when
+// their turn comes.
+//
+// The queue is bounded; once there are MaxPending records waiting anything else
+// that isn't pinned is dropped, and counted as such.
+
+const (
+	PrecachePriorityWarm   = 1
+	PrecachePrioritySlow   = 2
+	PrecachePriorityPinned = 3
+)
+
+// records whose GeoJSON is bigger than this are pre-cached when they are indexed;
+// it's (very roughly) the size of a file that took 0.01 seconds to parse in full
+
+const PrecacheSlowBytes = 256 * 1024
+
+type WOFPrecacheStats struct {
+	Pending int
+	Queued  int64
+	Done    int64
+	Skipped int64
+	Failed  int64
+	Dropped int64
+}
+
+type WOFPrecacheQueue struct {
+	PIP        *WOFPointInPolygon
+	MaxPending int
+	workers    int
+	running    int
+	inflight   int
+	seq        int64
+	jobs       wofPrecacheJobs
+	pending    map[int]*wofPrecacheJob
+	stats      WOFPrecacheStats
+	closed     bool
+	mu         *sync.Mutex
+	cond       *sync.Cond
+	idle       *sync.Cond
+}
+
+type wofPrecacheJob struct {
+	id       int
+	priority int
+	seq      int64
+	store    *WOFGeometryStore
+	index    int
+}
+
+func NewPrecacheQueue(p *WOFPointInPolygon, workers int, max_pending int) *WOFPrecacheQueue {
+
+	mu := new(sync.Mutex)
+
+	q := WOFPrecacheQueue{
+		PIP:        p,
+		MaxPending: max_pending,
+		jobs:       make(wofPrecacheJobs, 0),
+		pending:    make(map[int]*wofPrecacheJob),
+		mu:         mu,
+		cond:       sync.NewCond(mu),
+		idle:       sync.NewCond(mu),
+	}
+
+	q.SetWorkers(workers)
+	return &q
+}
+
+// SetWorkers changes the number of workers, starting new ones or letting extra
+// ones finish whatever they are doing and exit
+
+func (q *WOFPrecacheQueue) SetWorkers(workers int) {
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.workers = workers
+
+	for q.running < q.workers {
+		q.running += 1
+		go q.work(q.running)
+	}
+
+	q.cond.Broadcast()
+}
+
+// Add schedules a record for pre-caching. If the record is already waiting its
+// priority is raised if necessary. It returns false if the record was dropped.
+
+func (q *WOFPrecacheQueue) Add(id int, priority int) bool {
+	return q.add(id, priority, nil)
+}
+
+// AddFromStore is the same as Add but the record is loaded from a geometry store,
+// for example one written by SaveCache, rather than wherever it normally would be.
+// If the record isn't in the store it is loaded normally.
+
+func (q *WOFPrecacheQueue) AddFromStore(id int, priority int, store *WOFGeometryStore) bool {
+	return q.add(id, priority, store)
+}
+
+func (q *WOFPrecacheQueue) add(id int, priority int, store *WOFGeometryStore) bool {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	job, ok := q.pending[id]
+
+	if ok {
+
+		if priority > job.priority {
+			job.priority = priority
+			heap.Fix(&q.jobs, job.index)
+		}
+
+		if store != nil {
+			job.store = store
+		}
+
+		return true
+	}
+
+	if len(q.jobs) >= q.MaxPending && priority < PrecachePriorityPinned {
+		q.stats.Dropped += 1
+		q.count("dropped")
+		return false
+	}
+
+	q.seq += 1
+
+	job = &wofPrecacheJob{
+		id:       id,
+		priority: priority,
+		seq:      q.seq,
+		store:    store,
+	}
+
+	heap.Push(&q.jobs, job)
+	q.pending[id] = job
+
+	q.stats.Queued += 1
+	q.count("queued")
+
+	q.cond.Signal()
+	return true
+}
+
+// Warm schedules a list of records, for example yesterday's most popular ones, in
+// the order they are listed
+
+func (q *WOFPrecacheQueue) Warm(ids []int) int {
+
+	added := 0
+
+	for _, id := range ids {
+
+		if q.Add(id, PrecachePriorityWarm) {
+			added += 1
+		}
+	}
+
+	return added
+}
+
+// WarmFromFile reads a list of IDs, one per line, and schedules them. Anything after
+// the first comma or whitespace on a line is ignored as are lines that don't start
+// with a number (like a CSV header)
+
+func (q *WOFPrecacheQueue) WarmFromFile(path string) (int, error) {
+
+	fh, err := os.Open(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer fh.Close()
+
+	ids := make([]int, 0)
+	scanner := bufio.NewScanner(fh)
+
+	for scanner.Scan() {
+
+		fields := strings.FieldsFunc(scanner.Text(), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		id, err := strconv.Atoi(fields[0])
+
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	err = scanner.Err()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Warm(ids), nil
+}
+
+func (q *WOFPrecacheQueue) Stats() WOFPrecacheStats {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := q.stats
+	stats.Pending = len(q.jobs)
+
+	return stats
+}
+
+// Wait blocks until there is nothing left to do
+
+func (q *WOFPrecacheQueue) Wait() {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.jobs) > 0 || q.busy() {
+		q.idle.Wait()
+	}
+}
+
+// Close stops the workers; anything that hasn't been loaded yet is forgotten
+
+func (q *WOFPrecacheQueue) Close() {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.jobs = make(wofPrecacheJobs, 0)
+	q.pending = make(map[int]*wofPrecacheJob)
+
+	q.cond.Broadcast()
+	q.idle.Broadcast()
+}
+
+func (q *WOFPrecacheQueue) work(worker int) {
+
+	q.mu.Lock()
+
+	for {
+
+		for len(q.jobs) == 0 && !q.closed && worker <= q.workers {
+			q.cond.Wait()
+		}
+
+		if q.closed || worker > q.workers {
+			q.running -= 1
+			q.mu.Unlock()
+			return
+		}
+
+		job := heap.Pop(&q.jobs).(*wofPrecacheJob)
+		delete(q.pending, job.id)
+
+		q.inflight += 1
+		q.mu.Unlock()
+
+		result := q.load(job.id, job.store)
+
+		q.mu.Lock()
+		q.inflight -= 1
+
+		switch result {
+		case "done":
+			q.stats.Done += 1
+		case "skipped":
+			q.stats.Skipped += 1
+		default:
+			q.stats.Failed += 1
+		}
+
+		q.count(result)
+		q.progress()
+
+		if len(q.jobs) == 0 && !q.busy() {
+			q.idle.Broadcast()
+		}
+	}
+}
+
+func (q *WOFPrecacheQueue) load(id int, store *WOFGeometryStore) string {
+
+	p := q.PIP
+
+	if p.Cache.Contains(id) {
+		return "skipped"
+	}
+
+	// the record may have been removed from the index since it was queued
+
+	spatial, ok := p.GetById(id)
+
+	if !ok {
+		return "skipped"
+	}
+
+	if store != nil {
+
+		t := time.Now()
+
+		polygons, err := store.ReadCompactPolygons(id, p.CacheEncoding)
+
+		if err == nil {
+			p.cachePolygons(id, spatial.Placetype, polygons, time.Since(t))
+			return "done"
+		}
+	}
+
+	_, err := p.loadCompactPolygons(spatial)
+
+	if err != nil {
+		p.Logger.Warning("failed to pre-cache %d, because %s", id, err)
+		return "failed"
+	}
+
+	return "done"
+}
+
+// these assume that q.mu has already been locked by the caller
+
+func (q *WOFPrecacheQueue) busy() bool {
+	return q.inflight > 0
+}
+
+func (q *WOFPrecacheQueue) progress() {
+
+	finished := q.stats.Done + q.stats.Skipped + q.stats.Failed
+
+	if finished%1000 == 0 {
+		q.PIP.Logger.Status("pre-cached %d records (%d skipped, %d failed), %d waiting", q.stats.Done, q.stats.Skipped, q.stats.Failed, len(q.jobs))
+	} else if len(q.jobs) == 0 && q.inflight == 0 {
+		q.PIP.Logger.Status("pre-cache queue is empty, %d records pre-cached (%d skipped, %d failed, %d dropped)", q.stats.Done, q.stats.Skipped, q.stats.Failed, q.stats.Dropped)
+	}
+
+	if q.PIP.Metrics != nil {
+		metrics.GetOrRegisterGauge("pip.precache.pending", *q.PIP.Metrics.Registry).Update(int64(len(q.jobs)))
+	}
+}
+
+func (q *WOFPrecacheQueue) count(event string) {
+
+	if q.PIP.Metrics == nil {
+		return
+	}
+
+	counter := metrics.GetOrRegisterCounter("pip.precache."+event, *q.PIP.Metrics.Registry)
+	counter.Inc(1)
+}
+
+// wofPrecacheJobs is a container/heap of jobs, highest priority (and then oldest) first
+
+type wofPrecacheJobs []*wofPrecacheJob
+
+func (j wofPrecacheJobs) Len() int {
+	return len(j)
+}
+
+func (j wofPrecacheJobs) Less(a, b int) bool {
+
+	if j[a].priority != j[b].priority {
+		return j[a].priority > j[b].priority
+	}
+
+	return j[a].seq < j[b].seq
+}
+
+func (j wofPrecacheJobs) Swap(a, b int) {
+	j[a], j[b] = j[b], j[a]
+	j[a].index = a
+	j[b].index = b
+}
+
+func (j *wofPrecacheJobs) Push(x interface{}) {
+
+	job := x.(*wofPrecacheJob)
+	job.index = len(*j)
+
+	*j = append(*j, job)
+}
+
+func (j *wofPrecacheJobs) Pop() interface{} {
+
+	old := *j
+	n := len(old)
+
+	job := old[n-1]
+	old[n-1] = nil
+	job.index = -1
+
+	*j = old[0 : n-1]
+	return job
+}
@@ -0,0 +1,202 @@
+package pip
+
+import (
+	"math"
+	"unsafe"
+)
+
+// Ray casting has to look at every edge in a ring which is fine for a neighbourhood
+// but not for a country with 100k+ vertices that gets tested on every lookup. When
+// a ring is prepared its edges are sorted in to a number of horizontal bands, by
+// latitude, and the ray cast only looks at the edges in the band the point falls in
+// since an edge that doesn't cross that latitude can't cross the ray either.
+//
+// Edges are listed in every band they overlap so long north-south edges are stored
+// more than once. The grid is counted by Size() and so against the cache budget.
+// Rings using the delta encoding can't be read out of order and are never prepared.
+
+// DefaultPrepareThreshold is the number of vertices a ring needs to have before it
+// is prepared when its polygon is cached.
+
+const DefaultPrepareThreshold = 1000
+
+// edges per band, on average, before counting edges that span more than one band
+
+const edgeGridDensity = 8
+
+const edgeGridMaxBands = 1 << 16
+
+type wofEdgeGrid struct {
+	minY    float64
+	height  float64
+	bands   int
+	offsets []uint32
+	edges   []uint32
+}
+
+// Prepare builds an edge grid for the ring if it has at least 'threshold' vertices.
+// It returns true if the ring is prepared (including if it already was).
+
+func (r *WOFCompactRing) Prepare(threshold int) bool {
+
+	if r.grid != nil {
+		return true
+	}
+
+	if r.Encoding == CompactDelta || r.Count < 3 || r.Count < threshold {
+		return false
+	}
+
+	bands := r.Count / edgeGridDensity
+
+	if bands < 1 {
+		bands = 1
+	}
+
+	if bands > edgeGridMaxBands {
+		bands = edgeGridMaxBands
+	}
+
+	if r.MaxY <= r.MinY {
+		bands = 1
+	}
+
+	height := (r.MaxY - r.MinY) / float64(bands)
+
+	g := wofEdgeGrid{
+		minY:    r.MinY,
+		height:  height,
+		bands:   bands,
+		offsets: make([]uint32, bands+1),
+	}
+
+	// edge i runs from vertex i-1 (or the last vertex for edge 0) to vertex i,
+	// which is the same order Contains walks them in
+
+	edgeBands := func(i int) (int, int) {
+
+		j := i - 1
+
+		if i == 0 {
+			j = r.Count - 1
+		}
+
+		_, y1 := r.vertex(i)
+		_, y2 := r.vertex(j)
+
+		return g.band(math.Min(y1, y2)), g.band(math.Max(y1, y2))
+	}
+
+	for i := 0; i < r.Count; i++ {
+
+		lo, hi := edgeBands(i)
+
+		for b := lo; b <= hi; b++ {
+			g.offsets[b+1] += 1
+		}
+	}
+
+	for b := 0; b < bands; b++ {
+		g.offsets[b+1] += g.offsets[b]
+	}
+
+	g.edges = make([]uint32, g.offsets[bands])
+	fill := make([]uint32, bands)
+
+	for i := 0; i < r.Count; i++ {
+
+		lo, hi := edgeBands(i)
+
+		for b := lo; b <= hi; b++ {
+			g.edges[g.offsets[b]+fill[b]] = uint32(i)
+			fill[b] += 1
+		}
+	}
+
+	r.grid = &g
+	return true
+}
+
+func (r *WOFCompactRing) IsPrepared() bool {
+	return r.grid != nil
+}
+
+func (r *WOFCompactRing) vertex(i int) (float64, float64) {
+
+	if r.Encoding == CompactFloat32 {
+		return float64(r.f32[i*2]), float64(r.f32[i*2+1])
+	}
+
+	return r.f64[i*2], r.f64[i*2+1]
+}
+
+func (g *wofEdgeGrid) band(y float64) int {
+
+	if g.bands == 1 {
+		return 0
+	}
+
+	b := int((y - g.minY) / g.height)
+
+	if b < 0 {
+		return 0
+	}
+
+	if b >= g.bands {
+		return g.bands - 1
+	}
+
+	return b
+}
+
+func (g *wofEdgeGrid) size() int {
+	return int(unsafe.Sizeof(*g)) + cap(g.offsets)*4 + cap(g.edges)*4
+}
+
+// locatePrepared is the same as Locate but only for the edges in the point's band;
+// any edge the point is on has to cross its latitude so it's in there too
+
+func (r *WOFCompactRing) locatePrepared(t *ringTest) {
+
+	g := r.grid
+	b := g.band(t.lat)
+
+	for _, e := range g.edges[g.offsets[b]:g.offsets[b+1]] {
+
+		i := int(e)
+		j := i - 1
+
+		if i == 0 {
+			j = r.Count - 1
+		}
+
+		x1, y1 := r.vertex(i)
+		x2, y2 := r.vertex(j)
+
+		t.edge(x1, y1, x2, y2)
+	}
+}
+
+// Prepare builds an edge grid for each of the polygon's rings with at least
+// 'threshold' vertices and, if the polygon as a whole has that many, looks for
+// rectangles that are entirely inside it (see interior.go).
+
+func (p *WOFCompactPolygon) Prepare(threshold int) {
+
+	p.OuterRing.Prepare(threshold)
+
+	for _, r := range p.InteriorRings {
+		r.Prepare(threshold)
+	}
+
+	if p.interior == nil && p.CountPoints() >= threshold {
+		p.findInteriorRects()
+	}
+}
+
+func PrepareCompactPolygons(polygons []*WOFCompactPolygon, threshold int) {
+
+	for _, p := range polygons {
+		p.Prepare(threshold)
+	}
+}
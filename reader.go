@@ -0,0 +1,222 @@
+package pip
+
+import (
+	"errors"
+	"fmt"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	utils "github.com/whosonfirst/go-whosonfirst-utils"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A WOFReader is anything that can return the raw GeoJSON body for a WOF ID. It
+// is used both to index records listed in meta files and to load polygons for the
+// final containment check. Readers should return an error for which os.IsNotExist
+// is true when they don't know about a given ID so that things like WOFMultiReader
+// know to try somewhere else.
+
+type WOFReader interface {
+	Read(id int) ([]byte, error)
+}
+
+// WOFSequentialReader is implemented by readers (like compressed bundles) where
+// reading everything in one go is much faster than reading records one at a time.
+
+type WOFSequentialReader interface {
+	WOFReader
+	Walk(cb func(id int, body []byte) error) error
+}
+
+func NewReader(source string) (WOFReader, error) {
+
+	if IsRemote(source) {
+		return NewRemoteReader(source, 30*time.Second, 3, nil)
+	}
+
+	if IsBundle(source) {
+		return OpenBundle(source)
+	}
+
+	info, err := os.Stat(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, errors.New(fmt.Sprintf("%s is neither a directory nor a bundle", source))
+	}
+
+	return NewFilesystemReader(source), nil
+}
+
+func notFound(id int) error {
+
+	return &os.PathError{
+		Op:   "read",
+		Path: utils.Id2RelPath(id),
+		Err:  os.ErrNotExist,
+	}
+}
+
+// Filesystem
+
+type WOFFilesystemReader struct {
+	Root string
+}
+
+func NewFilesystemReader(root string) *WOFFilesystemReader {
+
+	r := WOFFilesystemReader{
+		Root: root,
+	}
+
+	return &r
+}
+
+func (r *WOFFilesystemReader) Path(id int) string {
+	return utils.Id2AbsPath(r.Root, id)
+}
+
+func (r *WOFFilesystemReader) Read(id int) ([]byte, error) {
+	return ioutil.ReadFile(r.Path(id))
+}
+
+func (r *WOFFilesystemReader) String() string {
+	return r.Root
+}
+
+// Memory - this is mostly useful for tests
+
+type WOFMemoryReader struct {
+	records map[int][]byte
+	mu      *sync.RWMutex
+}
+
+func NewMemoryReader() *WOFMemoryReader {
+
+	r := WOFMemoryReader{
+		records: make(map[int][]byte),
+		mu:      new(sync.RWMutex),
+	}
+
+	return &r
+}
+
+func (r *WOFMemoryReader) Add(id int, body []byte) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records[id] = body
+}
+
+func (r *WOFMemoryReader) AddFeature(feature *geojson.WOFFeature) {
+	r.Add(feature.Id(), []byte(feature.Dumps()))
+}
+
+func (r *WOFMemoryReader) Remove(id int) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.records, id)
+}
+
+func (r *WOFMemoryReader) Read(id int) ([]byte, error) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	body, ok := r.records[id]
+
+	if !ok {
+		return nil, notFound(id)
+	}
+
+	return body, nil
+}
+
+func (r *WOFMemoryReader) String() string {
+	return "memory"
+}
+
+// Multi - try each reader in order, for example one or more admin repos
+// followed by a postalcode repo
+
+type WOFMultiReader struct {
+	Readers []WOFReader
+}
+
+func NewMultiReader(readers ...WOFReader) *WOFMultiReader {
+
+	r := WOFMultiReader{
+		Readers: readers,
+	}
+
+	return &r
+}
+
+func NewMultiReaderFromSources(sources ...string) (WOFReader, error) {
+
+	if len(sources) == 1 {
+		return NewReader(sources[0])
+	}
+
+	readers := make([]WOFReader, 0)
+
+	for _, source := range sources {
+
+		r, err := NewReader(source)
+
+		if err != nil {
+			return nil, err
+		}
+
+		readers = append(readers, r)
+	}
+
+	return NewMultiReader(readers...), nil
+}
+
+func (r *WOFMultiReader) Read(id int) ([]byte, error) {
+
+	var last_err error
+
+	for _, reader := range r.Readers {
+
+		body, err := reader.Read(id)
+
+		if err == nil {
+			return body, nil
+		}
+
+		// something other than "not here" went wrong; keep looking
+		// but remember it so that we don't report "not found" when
+		// that might not be the case
+
+		if !os.IsNotExist(err) {
+			last_err = err
+		}
+	}
+
+	if last_err != nil {
+		return nil, last_err
+	}
+
+	return nil, notFound(id)
+}
+
+func (r *WOFMultiReader) String() string {
+
+	sources := make([]string, 0)
+
+	for _, reader := range r.Readers {
+		sources = append(sources, fmt.Sprintf("%v", reader))
+	}
+
+	return strings.Join(sources, ",")
+}
@@ -0,0 +1,140 @@
+package pip
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryReader(t *testing.T) {
+
+	r := NewMemoryReader()
+
+	_, err := r.Read(1)
+
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a missing record to be a not exist error, not %v", err)
+	}
+
+	r.Add(1, []byte("one"))
+
+	body, err := r.Read(1)
+
+	if err != nil || string(body) != "one" {
+		t.Errorf("read '%s' (%v), expected 'one'", body, err)
+	}
+
+	r.Remove(1)
+
+	_, err = r.Read(1)
+
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a removed record to be a not exist error, not %v", err)
+	}
+}
+
+type testBrokenReader struct{}
+
+func (r *testBrokenReader) Read(id int) ([]byte, error) {
+	return nil, errors.New("broken")
+}
+
+func (r *testBrokenReader) String() string {
+	return "broken"
+}
+
+func TestMultiReader(t *testing.T) {
+
+	a := NewMemoryReader()
+	b := NewMemoryReader()
+
+	a.Add(1, []byte("a"))
+	b.Add(1, []byte("b"))
+	b.Add(2, []byte("b"))
+
+	r := NewMultiReader(a, b)
+
+	for id, expected := range map[int]string{1: "a", 2: "b"} {
+
+		body, err := r.Read(id)
+
+		if err != nil || string(body) != expected {
+			t.Errorf("read '%s' (%v) for %d, expected '%s'", body, err, id, expected)
+		}
+	}
+
+	_, err := r.Read(3)
+
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a record that isn't anywhere to be a not exist error, not %v", err)
+	}
+
+	// a reader that fails for some other reason means we can't say the
+	// record doesn't exist
+
+	r = NewMultiReader(&testBrokenReader{}, a)
+
+	_, err = r.Read(3)
+
+	if err == nil || os.IsNotExist(err) {
+		t.Errorf("expected an error other than not exist, not %v", err)
+	}
+
+	body, err := r.Read(1)
+
+	if err != nil || string(body) != "a" {
+		t.Errorf("read '%s' (%v), expected 'a'", body, err)
+	}
+}
+
+// alternate geometries are listed in the meta files alongside the records they
+// belong to, with the same ID, and shouldn't replace them in the index
+
+func TestIndexMetaFileAltGeometries(t *testing.T) {
+
+	body := readParseFixture(t, "polygon.geojson")
+
+	reader := NewMemoryReader()
+	reader.Add(85922583, body)
+
+	p := newTestPointInPolygon(t, reader)
+
+	meta := filepath.Join(t.TempDir(), "meta.csv")
+
+	rows := "id,path,name,placetype,bbox,deprecated,superseded,superseded_by\n"
+	rows += "85922583,859/225/83/85922583.geojson,San Francisco,locality,\"-122.515,37.708,-122.357,37.833\",,,\n"
+	rows += "85922583,859/225/83/85922583-alt-quattroshapes.geojson,San Francisco,locality,\"-100,-10,100,10\",,,\n"
+
+	err := ioutil.WriteFile(meta, []byte(rows), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, from_meta := range []bool{false, true} {
+
+		p.IndexFromMeta = from_meta
+
+		err = p.IndexMetaFile(meta)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spatial, ok := p.GetById(85922583)
+
+		if !ok {
+			t.Fatalf("expected 85922583 to be indexed")
+		}
+
+		if spatial.Bounds().PointCoord(0) != -122.515 {
+			t.Errorf("expected 85922583 to have its own bounding box, not %s (index from meta: %t)", spatial.Bounds(), from_meta)
+		}
+	}
+
+	if !IsAltGeometryPath("859/225/83/85922583-alt-quattroshapes.geojson") || IsAltGeometryPath("859/225/83/85922583.geojson") {
+		t.Errorf("IsAltGeometryPath is confused")
+	}
+}
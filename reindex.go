@@ -0,0 +1,433 @@
+package pip
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tidwall/gjson"
+	csv "github.com/whosonfirst/go-whosonfirst-csv"
+	utils "github.com/whosonfirst/go-whosonfirst-utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Geometry hashes are calculated the same way as go-whosonfirst-utils does it
+// (and as the geom_hash column in the meta files is) which means re-marshaling
+// the geometry. That's not free for big polygons but it means the hashes can be
+// compared with things that aren't this package.
+//
+// LastModified is the record's wof:lastmodified property which, along with the
+// geometry hash, is also listed in the meta files. Together they are enough to tell
+// whether a record has changed without reading it.
+
+type WOFRecordHashes struct {
+	Geom         string
+	Properties   string
+	LastModified int64
+}
+
+type WOFReindexReport struct {
+	Started   time.Time
+	Duration  float64
+	Added     []int
+	Changed   []int
+	Removed   []int
+	Unchanged int
+	Errors    int
+}
+
+func HashFeature(body []byte) (*WOFRecordHashes, error) {
+
+	geom_hash, err := utils.HashGeomFromFeature(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	props := gjson.GetBytes(body, "properties")
+
+	if !props.Exists() {
+		return nil, errors.New("feature is missing a properties dictionary")
+	}
+
+	enc, err := json.Marshal(props.Value())
+
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := WOFRecordHashes{
+		Geom:         geom_hash,
+		Properties:   utils.HashBytes(enc),
+		LastModified: props.Get("wof:lastmodified").Int(),
+	}
+
+	return &hashes, nil
+}
+
+// HashesFromMetaRow returns the geometry hash and last modified time listed in a
+// meta file row. It returns false if either of them is missing, in which case the
+// only way to know whether the record has changed is to read it.
+
+func HashesFromMetaRow(row map[string]string) (*WOFRecordHashes, bool) {
+
+	geom_hash := row["geom_hash"]
+
+	if geom_hash == "" {
+		return nil, false
+	}
+
+	lastmod, err := strconv.ParseInt(row["lastmodified"], 10, 64)
+
+	if err != nil || lastmod <= 0 {
+		return nil, false
+	}
+
+	hashes := WOFRecordHashes{
+		Geom:         geom_hash,
+		LastModified: lastmod,
+	}
+
+	return &hashes, true
+}
+
+// Equals returns true if the geometry and properties hashes are the same. Hashes taken
+// from a meta file (see HashesFromMetaRow) don't have a properties hash, so only the
+// geometry hashes are compared if either of them is one of those.
+
+func (h *WOFRecordHashes) Equals(other *WOFRecordHashes) bool {
+
+	if h.Properties == "" || other.Properties == "" {
+		return h.Geom == other.Geom
+	}
+
+	return h.Geom == other.Geom && h.Properties == other.Properties
+}
+
+// EqualsMeta returns true if the geometry hash and last modified time are the same
+// as the ones listed in a meta file (see HashesFromMetaRow). Records without a
+// wof:lastmodified property never are.
+
+func (h *WOFRecordHashes) EqualsMeta(meta *WOFRecordHashes) bool {
+	return h.LastModified > 0 && h.Geom == meta.Geom && h.LastModified == meta.LastModified
+}
+
+func (p WOFPointInPolygon) GetHashes(id int) (*WOFRecordHashes, bool) {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	hashes, ok := p.Hashes[id]
+	return hashes, ok
+}
+
+func (p WOFPointInPolygon) setHashes(id int, hashes *WOFRecordHashes) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// the record may have failed to index (or been a Point) in which case
+	// there's nothing to compare against later
+
+	_, ok := p.Spatials[id]
+
+	if ok {
+		p.Hashes[id] = hashes
+	}
+}
+
+// HasGeoJSONFileChanged returns true if the geometry or properties of a GeoJSON
+// file are different from the version that is currently indexed (or if it
+// isn't indexed at all).
+
+func (p WOFPointInPolygon) HasGeoJSONFileChanged(abs_path string) (bool, error) {
+
+	body, err := ioutil.ReadFile(abs_path)
+
+	if err != nil {
+		return false, err
+	}
+
+	id, ok := IdFromPath(abs_path)
+
+	if !ok {
+		return true, nil
+	}
+
+	_, changed, err := p.compareGeoJSON(id, body)
+	return changed, err
+}
+
+// ReindexGeoJSONFile (re) indexes a GeoJSON file but only if its geometry or
+// properties have changed since it was last indexed. It returns true if the
+// index was updated.
+
+func (p WOFPointInPolygon) ReindexGeoJSONFile(abs_path string) (bool, error) {
+
+	changed, removed, err := p.reindexGeoJSONFile(abs_path)
+	return changed || removed, err
+}
+
+func (p WOFPointInPolygon) reindexGeoJSONFile(abs_path string) (bool, bool, error) {
+
+	body, err := ioutil.ReadFile(abs_path)
+
+	if err != nil {
+		return false, false, err
+	}
+
+	id, ok := IdFromPath(abs_path)
+
+	if !ok {
+		id = -1
+	}
+
+	return p.reindexGeoJSONBytes(abs_path, id, body)
+}
+
+// ReindexGeoJSONBytes is the same as ReindexGeoJSONFile for a GeoJSON document that
+// has already been read from somewhere. If id is -1 the record is always reindexed.
+// If the new version of an indexed record can't be indexed itself (because it's a
+// Point, say) the old version is removed from the index.
+
+func (p WOFPointInPolygon) ReindexGeoJSONBytes(label string, id int, body []byte) (bool, error) {
+
+	changed, removed, err := p.reindexGeoJSONBytes(label, id, body)
+	return changed || removed, err
+}
+
+// reindexGeoJSONBytes returns whether the record was (re) indexed and whether it
+// was removed from the index instead
+
+func (p WOFPointInPolygon) reindexGeoJSONBytes(label string, id int, body []byte) (bool, bool, error) {
+
+	hashes, changed, err := p.compareGeoJSON(id, body)
+
+	if err != nil {
+		return false, false, err
+	}
+
+	if !changed {
+
+		// now that we've read the record we can swap hashes from a meta file
+		// for the real thing
+
+		current, ok := p.GetHashes(id)
+
+		if ok && current.Properties == "" {
+			p.setHashes(id, hashes)
+		}
+
+		p.Logger.Debug("%s is unchanged, skipping", label)
+		return false, false, nil
+	}
+
+	feature, err := p.UnmarshalGeoJSONProperties(label, body)
+
+	if err != nil {
+		return false, false, err
+	}
+
+	id = feature.Id()
+
+	previous, was_indexed := p.GetById(id)
+
+	err = p.IndexGeoJSONFeature(feature)
+
+	if err != nil {
+		return false, false, err
+	}
+
+	// things like Point geometries are skipped by IndexGeoJSONFeature, which
+	// leaves whatever was indexed before alone. If we kept it, and stored the
+	// new hashes for it, it would keep answering lookups and never be fixed
+	// because the hashes would match from now on
+
+	current, ok := p.GetById(id)
+
+	if !ok {
+		return false, false, nil
+	}
+
+	if was_indexed && current == previous {
+		p.Logger.Status("%s can no longer be indexed, removing %d", label, id)
+		return false, p.UnindexId(id), nil
+	}
+
+	p.setHashes(id, hashes)
+	return true, false, nil
+}
+
+func (p WOFPointInPolygon) compareGeoJSON(id int, body []byte) (*WOFRecordHashes, bool, error) {
+
+	hashes, err := HashFeature(body)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if id == -1 {
+		return hashes, true, nil
+	}
+
+	current, ok := p.GetHashes(id)
+
+	if ok && current.Equals(hashes) {
+		return hashes, false, nil
+	}
+
+	return hashes, true, nil
+}
+
+// Reindex compares every record listed in one or more meta files with what is
+// currently indexed, re-indexing only those records whose geometry or properties
+// hashes have changed. Records whose geom_hash and lastmodified columns match what
+// is indexed aren't read at all. Anything currently indexed that isn't listed in
+// the meta files (or that can no longer be read) is removed from the index.
+//
+// Only one reindex, or watcher sync, runs at a time; anything else waits for it to
+// finish.
+
+func (p WOFPointInPolygon) Reindex(meta_files ...string) (*WOFReindexReport, error) {
+
+	p.reindex_mu.Lock()
+	defer p.reindex_mu.Unlock()
+
+	t := time.Now()
+
+	report := WOFReindexReport{
+		Started: t,
+		Added:   make([]int, 0),
+		Changed: make([]int, 0),
+		Removed: make([]int, 0),
+	}
+
+	seen := make(map[int]bool)
+
+	for _, meta_file := range meta_files {
+
+		reader, err := csv.NewDictReaderFromPath(meta_file)
+
+		if err != nil {
+			p.Logger.Error("failed to create CSV reader , because %s", err)
+			return nil, err
+		}
+
+		for {
+			row, err := reader.Read()
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				p.Logger.Error("failed to parse CSV row , because %s", err)
+				return nil, err
+			}
+
+			rel_path, ok := row["path"]
+
+			if !ok {
+				p.Logger.Warning("CSV row is missing a 'path' column")
+				continue
+			}
+
+			if IsAltGeometryPath(rel_path) {
+				continue
+			}
+
+			id, ok := IdFromMetaRow(row)
+
+			if !ok {
+				p.Logger.Warning("unable to determine ID for '%s'", rel_path)
+				continue
+			}
+
+			if seen[id] {
+				continue
+			}
+
+			meta, ok := HashesFromMetaRow(row)
+
+			if ok {
+
+				current, indexed := p.GetHashes(id)
+
+				if indexed && current.EqualsMeta(meta) {
+					seen[id] = true
+					report.Unchanged += 1
+					continue
+				}
+			}
+
+			body, err := p.Reader.Read(id)
+
+			if os.IsNotExist(err) {
+
+				// this will get picked up below and removed from the index
+
+				p.Logger.Error("'%s' does not exist", rel_path)
+				continue
+			}
+
+			// We don't know whether this is still a valid record or not so
+			// leave whatever is currently indexed alone
+
+			seen[id] = true
+
+			if err != nil {
+				p.Logger.Error("failed to read '%s', because %s", rel_path, err)
+				report.Errors += 1
+				continue
+			}
+
+			_, indexed := p.GetById(id)
+
+			changed, removed, err := p.reindexGeoJSONBytes(rel_path, id, body)
+
+			if err != nil {
+				p.Logger.Error("failed to reindex '%s', because %s", rel_path, err)
+				report.Errors += 1
+				continue
+			}
+
+			if removed {
+				report.Removed = append(report.Removed, id)
+			} else if !changed {
+				report.Unchanged += 1
+			} else if indexed {
+				report.Changed = append(report.Changed, id)
+			} else {
+				report.Added = append(report.Added, id)
+			}
+		}
+	}
+
+	p.mu.RLock()
+
+	removed := make([]int, 0)
+
+	for id, _ := range p.Spatials {
+
+		if !seen[id] {
+			removed = append(removed, id)
+		}
+	}
+
+	p.mu.RUnlock()
+
+	for _, id := range removed {
+
+		if p.UnindexId(id) {
+			report.Removed = append(report.Removed, id)
+		}
+	}
+
+	report.Duration = float64(time.Since(t)) / 1e9
+
+	p.Logger.Status("reindexed in %.3f seconds: %d added, %d changed, %d removed, %d unchanged, %d errors", report.Duration, len(report.Added), len(report.Changed), len(report.Removed), report.Unchanged, report.Errors)
+
+	return &report, nil
+}
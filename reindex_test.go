@@ -0,0 +1,237 @@
+package pip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestMeta(t *testing.T, rows ...string) string {
+
+	path := filepath.Join(t.TempDir(), "meta.csv")
+
+	body := "id,path,geom_hash,lastmodified\n"
+
+	for _, row := range rows {
+		body += row + "\n"
+	}
+
+	err := ioutil.WriteFile(path, []byte(body), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// records whose geom_hash and lastmodified columns match what is indexed aren't
+// read at all, which we can tell because the reader doesn't have them anymore
+
+func TestReindexFromMetaHashes(t *testing.T) {
+
+	body := readParseFixture(t, "polygon.geojson")
+
+	hashes, err := HashFeature(body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hashes.LastModified != 1490000000 {
+		t.Fatalf("expected wof:lastmodified to be hashed, got %d", hashes.LastModified)
+	}
+
+	reader := NewMemoryReader()
+	reader.Add(85922583, body)
+
+	p := newTestPointInPolygon(t, reader)
+
+	err = p.IndexGeoJSONBytes("polygon.geojson", body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader.Remove(85922583)
+
+	row := fmt.Sprintf("85922583,859/225/83/85922583.geojson,%s,%d", hashes.Geom, hashes.LastModified)
+
+	report, err := p.Reindex(writeTestMeta(t, row))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Unchanged != 1 || len(report.Removed) != 0 {
+		t.Errorf("expected 85922583 to be unchanged, got %+v", report)
+	}
+
+	// a different last modified time means reading the record, which isn't
+	// there anymore
+
+	row = fmt.Sprintf("85922583,859/225/83/85922583.geojson,%s,%d", hashes.Geom, hashes.LastModified+1)
+
+	report, err = p.Reindex(writeTestMeta(t, row))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Removed) != 1 {
+		t.Errorf("expected 85922583 to be read and removed, got %+v", report)
+	}
+}
+
+func TestHashesFromMetaRow(t *testing.T) {
+
+	rows := []map[string]string{
+		{"geom_hash": "", "lastmodified": "1490000000"},
+		{"geom_hash": "abc", "lastmodified": ""},
+		{"geom_hash": "abc", "lastmodified": "0"},
+		{"geom_hash": "abc", "lastmodified": "yesterday"},
+		{"id": "85922583"},
+	}
+
+	for _, row := range rows {
+
+		_, ok := HashesFromMetaRow(row)
+
+		if ok {
+			t.Errorf("expected %v not to have any hashes", row)
+		}
+	}
+
+	meta, ok := HashesFromMetaRow(map[string]string{"geom_hash": "abc", "lastmodified": "1490000000"})
+
+	if !ok || meta.Geom != "abc" || meta.LastModified != 1490000000 {
+		t.Fatalf("got %v", meta)
+	}
+
+	// a record without a wof:lastmodified property never matches
+
+	current := &WOFRecordHashes{Geom: "abc"}
+
+	if current.EqualsMeta(meta) {
+		t.Errorf("expected a record without a last modified time not to match")
+	}
+}
+
+// a record that is edited into a Point can't be indexed anymore so the old
+// version has to be removed, rather than left answering lookups with the new
+// hashes stored against it
+
+func TestReindexPoint(t *testing.T) {
+
+	body := readParseFixture(t, "polygon.geojson")
+
+	point := strings.Replace(string(body), `"type": "Polygon"`, `"type": "Point"`, 1)
+
+	if point == string(body) {
+		t.Fatalf("failed to turn the fixture into a Point")
+	}
+
+	reader := NewMemoryReader()
+	reader.Add(85922583, body)
+
+	p := newTestPointInPolygon(t, reader)
+
+	err := p.IndexGeoJSONBytes("polygon.geojson", body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader.Add(85922583, []byte(point))
+
+	report, err := p.Reindex(writeTestMeta(t, "85922583,859/225/83/85922583.geojson,,"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Removed) != 1 || len(report.Changed) != 0 {
+		t.Errorf("expected 85922583 to be removed, got %+v", report)
+	}
+
+	_, ok := p.GetById(85922583)
+
+	if ok {
+		t.Fatalf("expected 85922583 not to be indexed")
+	}
+
+	results, _ := p.GetByLatLon(37.75, -122.45)
+
+	if len(results) != 0 {
+		t.Errorf("expected no results, got %v", results)
+	}
+
+	// and it stays that way
+
+	changed, err := p.ReindexGeoJSONBytes("point.geojson", 85922583, []byte(point))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed {
+		t.Errorf("expected a Point that isn't indexed not to change anything")
+	}
+}
+
+// hashes from a meta file without a lastmodified column don't have a properties hash,
+// so reading the record only compares geometries, and then keeps the real hashes
+
+func TestReindexMetaHashesWithoutLastModified(t *testing.T) {
+
+	body := readParseFixture(t, "polygon.geojson")
+
+	hashes, err := HashFeature(body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewMemoryReader()
+	reader.Add(85922583, body)
+
+	tests := []struct {
+		geom_hash string
+		changed   bool
+	}{
+		{hashes.Geom, false},
+		{"abc", true},
+	}
+
+	for _, test := range tests {
+
+		p := newTestPointInPolygon(t, reader)
+
+		row := testMetaRow()
+		row["geom_hash"] = test.geom_hash
+		delete(row, "lastmodified")
+
+		if !p.indexMetaRow(row["path"], row) {
+			t.Fatalf("failed to index meta row")
+		}
+
+		meta := fmt.Sprintf("85922583,859/225/83/85922583.geojson,%s,", test.geom_hash)
+		report, err := p.Reindex(writeTestMeta(t, meta))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (len(report.Changed) == 1) != test.changed || (report.Unchanged == 1) == test.changed {
+			t.Errorf("expected a geometry hash of %s to be changed (%t), got %+v", test.geom_hash, test.changed, report)
+		}
+
+		current, ok := p.GetHashes(85922583)
+
+		if !ok || !current.Equals(hashes) || current.Properties != hashes.Properties {
+			t.Errorf("expected the hashes to be the ones for the record, got %v", current)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package pip
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	utils "github.com/whosonfirst/go-whosonfirst-utils"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WOFRemoteReader fetches records from a WOF-style data host, where each record
+// lives at {root}/{Id2RelPath(id)}, for example:
+//
+//	https://whosonfirst.mapzen.com/data/101/736/545/101736545.geojson
+//
+// Responses may be cached on disk in which case they are revalidated using their
+// ETag (once they are older than MaxAge) rather than being fetched again. If the
+// remote host can't be reached but we have a cached copy we return that.
+
+type WOFRemoteReader struct {
+	Root    string
+	Client  *http.Client
+	Retries int
+	Backoff time.Duration
+	MaxAge  time.Duration
+	Cache   *WOFDiskCache
+}
+
+func IsRemote(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+func NewRemoteReader(root string, timeout time.Duration, retries int, cache *WOFDiskCache) (*WOFRemoteReader, error) {
+
+	if !IsRemote(root) {
+		return nil, errors.New("remote root must be an http:// or https:// URL")
+	}
+
+	if retries < 0 {
+		return nil, errors.New("retries can not be negative")
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+	}
+
+	r := WOFRemoteReader{
+		Root:    strings.TrimRight(root, "/"),
+		Client:  client,
+		Retries: retries,
+		Backoff: 250 * time.Millisecond,
+		MaxAge:  0,
+		Cache:   cache,
+	}
+
+	return &r, nil
+}
+
+func (r *WOFRemoteReader) URL(id int) string {
+	return r.Root + "/" + utils.Id2RelPath(id)
+}
+
+func (r *WOFRemoteReader) String() string {
+	return r.Root
+}
+
+func (r *WOFRemoteReader) Read(id int) ([]byte, error) {
+
+	var cached *WOFDiskCacheEntry
+
+	if r.Cache != nil {
+
+		entry, ok := r.Cache.Get(id)
+
+		if ok {
+
+			if r.MaxAge > 0 && time.Since(entry.Fetched) < r.MaxAge {
+				return entry.Body, nil
+			}
+
+			cached = entry
+		}
+	}
+
+	body, etag, err := r.fetch(id, cached)
+
+	if err != nil {
+
+		if os.IsNotExist(err) {
+
+			if r.Cache != nil {
+				r.Cache.Remove(id)
+			}
+
+			return nil, err
+		}
+
+		// better a stale copy than nothing at all
+
+		if cached != nil {
+			return cached.Body, nil
+		}
+
+		return nil, err
+	}
+
+	// the cached copy is still good
+
+	if body == nil {
+		r.Cache.Touch(id)
+		return cached.Body, nil
+	}
+
+	if r.Cache != nil {
+
+		// failing to cache something isn't a reason not to return it
+
+		r.Cache.Set(id, body, etag)
+	}
+
+	return body, nil
+}
+
+// fetch returns a nil body (and no error) if the cached copy is still valid
+
+func (r *WOFRemoteReader) fetch(id int, cached *WOFDiskCacheEntry) ([]byte, string, error) {
+
+	url := r.URL(id)
+
+	var last_err error
+
+	for attempt := 0; attempt <= r.Retries; attempt++ {
+
+		if attempt > 0 {
+			time.Sleep(r.Backoff * time.Duration(attempt))
+		}
+
+		req, err := http.NewRequest("GET", url, nil)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		if cached != nil && cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+
+		rsp, err := r.Client.Do(req)
+
+		if err != nil {
+			last_err = err
+			continue
+		}
+
+		switch {
+
+		case rsp.StatusCode == http.StatusNotModified && cached != nil:
+
+			rsp.Body.Close()
+			return nil, cached.ETag, nil
+
+		case rsp.StatusCode == http.StatusOK:
+
+			body, err := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+
+			if err != nil {
+				last_err = err
+				continue
+			}
+
+			return body, rsp.Header.Get("ETag"), nil
+
+		case rsp.StatusCode == http.StatusNotFound || rsp.StatusCode == http.StatusGone:
+
+			rsp.Body.Close()
+			return nil, "", notFound(id)
+
+		case rsp.StatusCode >= 500 || rsp.StatusCode == http.StatusTooManyRequests:
+
+			rsp.Body.Close()
+			last_err = errors.New(fmt.Sprintf("%s returned %s", url, rsp.Status))
+			continue
+
+		default:
+
+			rsp.Body.Close()
+			return nil, "", errors.New(fmt.Sprintf("%s returned %s", url, rsp.Status))
+		}
+	}
+
+	return nil, "", last_err
+}
+
+// WOFDiskCache stores records on disk, using the same layout as a data repository,
+// and removes the least recently used records once the total size of the cache
+// exceeds MaxBytes. ETags are stored in a sidecar file next to each record.
+
+type WOFDiskCacheEntry struct {
+	Body    []byte
+	ETag    string
+	Fetched time.Time
+}
+
+type wofDiskCacheItem struct {
+	id   int
+	size int64
+}
+
+type WOFDiskCache struct {
+	Root     string
+	MaxBytes int64
+	size     int64
+	lru      *list.List
+	items    map[int]*list.Element
+	mu       *sync.Mutex
+}
+
+func NewDiskCache(root string, max_bytes int64) (*WOFDiskCache, error) {
+
+	if max_bytes <= 0 {
+		return nil, errors.New("disk cache size must be greater than zero")
+	}
+
+	err := os.MkdirAll(root, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := WOFDiskCache{
+		Root:     root,
+		MaxBytes: max_bytes,
+		lru:      list.New(),
+		items:    make(map[int]*list.Element),
+		mu:       new(sync.Mutex),
+	}
+
+	// pick up anything left over from last time, most recently fetched first
+
+	type existing struct {
+		id    int
+		size  int64
+		mtime time.Time
+	}
+
+	found := make([]existing, 0)
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		id, ok := IdFromPath(path)
+
+		if ok {
+			found = append(found, existing{id, info.Size(), info.ModTime()})
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].mtime.Before(found[j].mtime)
+	})
+
+	for _, f := range found {
+		c.items[f.id] = c.lru.PushFront(&wofDiskCacheItem{f.id, f.size})
+		c.size += f.size
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return &c, nil
+}
+
+func (c *WOFDiskCache) Size() int64 {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+func (c *WOFDiskCache) Len() int {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *WOFDiskCache) path(id int) string {
+	return utils.Id2AbsPath(c.Root, id)
+}
+
+func (c *WOFDiskCache) Get(id int) (*WOFDiskCacheEntry, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[id]
+
+	if !ok {
+		return nil, false
+	}
+
+	abs_path := c.path(id)
+
+	body, err := ioutil.ReadFile(abs_path)
+
+	if err != nil {
+		c.remove(id)
+		return nil, false
+	}
+
+	info, err := os.Stat(abs_path)
+
+	if err != nil {
+		c.remove(id)
+		return nil, false
+	}
+
+	etag, _ := ioutil.ReadFile(abs_path + ".etag")
+
+	c.lru.MoveToFront(el)
+
+	entry := WOFDiskCacheEntry{
+		Body:    body,
+		ETag:    string(etag),
+		Fetched: info.ModTime(),
+	}
+
+	return &entry, true
+}
+
+// Touch marks a record as having just been (re) validated
+
+func (c *WOFDiskCache) Touch(id int) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[id]
+
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	os.Chtimes(c.path(id), now, now)
+
+	c.lru.MoveToFront(el)
+}
+
+func (c *WOFDiskCache) Set(id int, body []byte, etag string) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	abs_path := c.path(id)
+
+	err := os.MkdirAll(filepath.Dir(abs_path), 0755)
+
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(abs_path, body)
+
+	if err != nil {
+		return err
+	}
+
+	if etag != "" {
+		err = writeFileAtomic(abs_path+".etag", []byte(etag))
+	} else {
+		os.Remove(abs_path + ".etag")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	el, ok := c.items[id]
+
+	if ok {
+		item := el.Value.(*wofDiskCacheItem)
+		c.size -= item.size
+		item.size = int64(len(body))
+		c.lru.MoveToFront(el)
+	} else {
+		c.items[id] = c.lru.PushFront(&wofDiskCacheItem{id, int64(len(body))})
+	}
+
+	c.size += int64(len(body))
+	c.evict()
+
+	return nil
+}
+
+func (c *WOFDiskCache) Remove(id int) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(id)
+}
+
+// these assume that c.mu has already been locked by the caller
+
+func (c *WOFDiskCache) remove(id int) {
+
+	el, ok := c.items[id]
+
+	if !ok {
+		return
+	}
+
+	item := el.Value.(*wofDiskCacheItem)
+
+	c.lru.Remove(el)
+	delete(c.items, id)
+	c.size -= item.size
+
+	abs_path := c.path(id)
+	os.Remove(abs_path)
+	os.Remove(abs_path + ".etag")
+}
+
+func (c *WOFDiskCache) evict() {
+
+	for c.size > c.MaxBytes && c.lru.Len() > 0 {
+
+		el := c.lru.Back()
+		item := el.Value.(*wofDiskCacheItem)
+
+		c.remove(item.id)
+	}
+}
+
+func writeFileAtomic(abs_path string, body []byte) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(abs_path), ".wof-pip-")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(body)
+
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = tmp.Close()
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), abs_path)
+}
@@ -0,0 +1,369 @@
+package pip
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRemote is a stand-in for a WOF data host that serves the same body for every
+// record, with an ETag, and can be told to fail or be slow
+
+type testRemote struct {
+	body     string
+	etag     string
+	failures int
+	delay    time.Duration
+	requests []*http.Request
+	mu       sync.Mutex
+}
+
+func (s *testRemote) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
+
+	s.mu.Lock()
+
+	s.requests = append(s.requests, req)
+
+	failing := s.failures > 0
+
+	if failing {
+		s.failures -= 1
+	}
+
+	delay := s.delay
+	body := s.body
+	etag := s.etag
+
+	s.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	if failing {
+		http.Error(rsp, "try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	if req.URL.Path == "/data/404/404/404/404404404.geojson" {
+		http.NotFound(rsp, req)
+		return
+	}
+
+	if etag != "" && req.Header.Get("If-None-Match") == etag {
+		rsp.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rsp.Header().Set("ETag", etag)
+	rsp.Write([]byte(body))
+}
+
+func (s *testRemote) update(body string, etag string, failures int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.body = body
+	s.etag = etag
+	s.failures = failures
+}
+
+func (s *testRemote) count() int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.requests)
+}
+
+func (s *testRemote) last() *http.Request {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[len(s.requests)-1]
+}
+
+func newTestRemote(t *testing.T, remote *testRemote, timeout time.Duration, retries int, cache *WOFDiskCache) *WOFRemoteReader {
+
+	server := httptest.NewServer(remote)
+	t.Cleanup(server.Close)
+
+	r, err := NewRemoteReader(server.URL+"/data", timeout, retries, cache)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Backoff = 10 * time.Millisecond
+	return r
+}
+
+func newTestDiskCache(t *testing.T, max_bytes int64) *WOFDiskCache {
+
+	c, err := NewDiskCache(t.TempDir(), max_bytes)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestRemoteReaderRead(t *testing.T) {
+
+	remote := &testRemote{body: `{"id":101736545}`, etag: `"v1"`}
+	r := newTestRemote(t, remote, time.Second, 0, nil)
+
+	body, err := r.Read(101736545)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != remote.body {
+		t.Errorf("read '%s', expected '%s'", body, remote.body)
+	}
+
+	if remote.last().URL.Path != "/data/101/736/545/101736545.geojson" {
+		t.Errorf("requested %s", remote.last().URL.Path)
+	}
+}
+
+func TestRemoteReaderNotFound(t *testing.T) {
+
+	remote := &testRemote{body: "{}", etag: `"v1"`}
+	cache := newTestDiskCache(t, 1024)
+	r := newTestRemote(t, remote, time.Second, 0, cache)
+
+	cache.Set(404404404, []byte("{}"), `"v0"`)
+
+	_, err := r.Read(404404404)
+
+	if !os.IsNotExist(err) {
+		t.Errorf("a 404 should be a not exist error, not %v", err)
+	}
+
+	_, ok := cache.Get(404404404)
+
+	if ok {
+		t.Errorf("a 404 should remove the cached copy")
+	}
+}
+
+func TestRemoteReaderTimeout(t *testing.T) {
+
+	remote := &testRemote{body: "{}", etag: `"v1"`, delay: 200 * time.Millisecond}
+	r := newTestRemote(t, remote, 50*time.Millisecond, 0, nil)
+
+	_, err := r.Read(101736545)
+
+	if err == nil {
+		t.Fatalf("expected a slow response to time out")
+	}
+
+	// but a stale copy is better than nothing
+
+	cache := newTestDiskCache(t, 1024)
+	cache.Set(101736545, []byte("stale"), `"v0"`)
+
+	r.Cache = cache
+
+	body, err := r.Read(101736545)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "stale" {
+		t.Errorf("expected the stale copy, not '%s'", body)
+	}
+}
+
+func TestRemoteReaderRetries(t *testing.T) {
+
+	remote := &testRemote{body: "{}", etag: `"v1"`, failures: 2}
+	r := newTestRemote(t, remote, time.Second, 2, nil)
+
+	t0 := time.Now()
+
+	_, err := r.Read(101736545)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remote.count() != 3 {
+		t.Errorf("made %d requests, expected 3", remote.count())
+	}
+
+	// backing off 10ms and then 20ms
+
+	if time.Since(t0) < 30*time.Millisecond {
+		t.Errorf("retried after %v, which is too soon", time.Since(t0))
+	}
+
+	// and give up once there are no retries left
+
+	remote.update("{}", `"v1"`, 2)
+	r.Retries = 1
+
+	_, err = r.Read(101736545)
+
+	if err == nil {
+		t.Errorf("expected an error once the retries ran out")
+	}
+
+	if remote.count() != 5 {
+		t.Errorf("made %d requests, expected 5", remote.count())
+	}
+}
+
+func TestRemoteReaderNotModified(t *testing.T) {
+
+	remote := &testRemote{body: "v1", etag: `"v1"`}
+	cache := newTestDiskCache(t, 1024)
+	r := newTestRemote(t, remote, time.Second, 0, cache)
+
+	r.Read(101736545)
+
+	entry, ok := cache.Get(101736545)
+
+	if !ok || entry.ETag != `"v1"` {
+		t.Fatalf("expected the response and its ETag to be cached")
+	}
+
+	// the server says nothing has changed so the body must come from the cache
+
+	remote.update("not this", `"v1"`, 0)
+
+	body, err := r.Read(101736545)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "v1" {
+		t.Errorf("read '%s', expected the cached copy", body)
+	}
+
+	if remote.last().Header.Get("If-None-Match") != `"v1"` {
+		t.Errorf("expected the request to be conditional")
+	}
+
+	// and when it has, the cache is updated
+
+	remote.update("v2", `"v2"`, 0)
+
+	body, _ = r.Read(101736545)
+	entry, _ = cache.Get(101736545)
+
+	if string(body) != "v2" || string(entry.Body) != "v2" || entry.ETag != `"v2"` {
+		t.Errorf("read '%s' and cached '%s' (%s), expected v2", body, entry.Body, entry.ETag)
+	}
+}
+
+func TestRemoteReaderMaxAge(t *testing.T) {
+
+	remote := &testRemote{body: "v1", etag: `"v1"`}
+	cache := newTestDiskCache(t, 1024)
+	r := newTestRemote(t, remote, time.Second, 0, cache)
+
+	r.MaxAge = time.Hour
+
+	r.Read(101736545)
+	r.Read(101736545)
+
+	if remote.count() != 1 {
+		t.Errorf("made %d requests, expected a fresh cached copy not to be revalidated", remote.count())
+	}
+
+	// pretend it was fetched a long time ago
+
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(cache.path(101736545), old, old)
+
+	r.Read(101736545)
+
+	if remote.count() != 2 {
+		t.Fatalf("made %d requests, expected a stale cached copy to be revalidated", remote.count())
+	}
+
+	if remote.last().Header.Get("If-None-Match") != `"v1"` {
+		t.Errorf("expected the request to be conditional")
+	}
+
+	// a 304 counts as having just been fetched
+
+	r.Read(101736545)
+
+	if remote.count() != 2 {
+		t.Errorf("made %d requests, expected a revalidated copy to be fresh again", remote.count())
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+
+	c := newTestDiskCache(t, 100)
+
+	body := []byte(fmt.Sprintf("%040d", 0))
+
+	c.Set(1, body, "")
+	c.Set(2, body, "")
+
+	// 1 is now the most recently used so 2 is the one to go
+
+	c.Get(1)
+	c.Set(3, body, `"etag"`)
+
+	if c.Size() != 80 || c.Len() != 2 {
+		t.Errorf("cache has %d records using %d bytes, expected 2 using 80", c.Len(), c.Size())
+	}
+
+	_, ok := c.Get(2)
+
+	if ok {
+		t.Errorf("expected 2 to be evicted")
+	}
+
+	_, err := os.Stat(c.path(2))
+
+	if !os.IsNotExist(err) {
+		t.Errorf("expected 2 to be removed from disk")
+	}
+
+	for _, id := range []int{1, 3} {
+
+		_, ok := c.Get(id)
+
+		if !ok {
+			t.Errorf("expected %d to still be cached", id)
+		}
+	}
+
+	// replacing a record doesn't count it twice
+
+	c.Set(3, []byte("short"), "")
+
+	if c.Size() != 45 {
+		t.Errorf("cache is using %d bytes, expected 45", c.Size())
+	}
+
+	// and a new cache picks up where this one left off, evicting anything
+	// that doesn't fit
+
+	reopened, err := NewDiskCache(c.Root, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reopened.Len() != 1 || reopened.Size() != 5 {
+		t.Errorf("reopened cache has %d records using %d bytes, expected 1 using 5", reopened.Len(), reopened.Size())
+	}
+}
@@ -0,0 +1,253 @@
+package pip
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	rtreego "github.com/dhconnelly/rtreego"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// WOFResultCache is an optional cache of lookup results in front of
+// GetByLatLonFiltered. Points are snapped to a grid of cells Precision degrees on a
+// side (1e-5 degrees is about a metre) and the results for a cell are keyed by the
+// cell and a canonical form of the filters.
+//
+// Results are only cached if no edge of any polygon that might be a result comes
+// anywhere near the cell, in which case every point in the cell has the same answer
+// whatever the boundary rule. Points near a boundary, or near anything with great
+// circle edges, are always looked up properly.
+//
+// The whole cache is emptied whenever anything is indexed or unindexed. Lookups that
+// were already under way when that happened don't add their (possibly stale)
+// results to the cache afterwards. The least recently used results are evicted once
+// there are more than MaxEntries of them.
+
+const DefaultResultCachePrecision = 0.00001
+
+type WOFResultCache struct {
+	Precision  float64
+	MaxEntries int
+	entries    map[string]*list.Element
+	order      *list.List
+	generation uint64
+	mu         *sync.Mutex
+}
+
+type wofResultCacheEntry struct {
+	key     string
+	results []*geojson.WOFSpatial
+}
+
+func NewResultCache(precision float64, max_entries int) (*WOFResultCache, error) {
+
+	if precision <= 0 || precision > 1 {
+		return nil, errors.New(fmt.Sprintf("invalid result cache precision %f, expected a number of degrees greater than 0 and no more than 1", precision))
+	}
+
+	if max_entries <= 0 {
+		return nil, errors.New(fmt.Sprintf("invalid result cache size %d, expected a number greater than 0", max_entries))
+	}
+
+	c := WOFResultCache{
+		Precision:  precision,
+		MaxEntries: max_entries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		mu:         new(sync.Mutex),
+	}
+
+	return &c, nil
+}
+
+// Key returns the cache key for a point and a set of filters and the current
+// generation of the cache, which needs to be passed to Set
+
+func (c *WOFResultCache) Key(lat float64, lon float64, filters WOFPointInPolygonFilters) (string, uint64) {
+
+	names := make([]string, 0, len(filters))
+
+	for k := range filters {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+
+	for _, k := range names {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, filters[k]))
+	}
+
+	x, y := c.cell(lat, lon)
+	key := fmt.Sprintf("%d,%d|%s", x, y, strings.Join(parts, "&"))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return key, c.generation
+}
+
+func (c *WOFResultCache) cell(lat float64, lon float64) (int64, int64) {
+
+	x := int64(math.Floor(lon / c.Precision))
+	y := int64(math.Floor(lat / c.Precision))
+
+	return x, y
+}
+
+// Bounds returns the cell that a point is snapped to as (swlat, swlon, nelat, nelon)
+
+func (c *WOFResultCache) Bounds(lat float64, lon float64) (float64, float64, float64, float64) {
+
+	x, y := c.cell(lat, lon)
+
+	swlat := float64(y) * c.Precision
+	swlon := float64(x) * c.Precision
+
+	return swlat, swlon, float64(y+1) * c.Precision, float64(x+1) * c.Precision
+}
+
+// Get returns a copy of the cached results for a key
+
+func (c *WOFResultCache) Get(key string) ([]*geojson.WOFSpatial, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+
+	results := el.Value.(*wofResultCacheEntry).results
+
+	copied := make([]*geojson.WOFSpatial, len(results))
+	copy(copied, results)
+
+	return copied, true
+}
+
+// Set caches the results for a key unless the cache has been cleared since the
+// key was made. It returns true if the results were cached.
+
+func (c *WOFResultCache) Set(key string, generation uint64, results []*geojson.WOFSpatial) bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return false
+	}
+
+	copied := make([]*geojson.WOFSpatial, len(results))
+	copy(copied, results)
+
+	el, ok := c.entries[key]
+
+	if ok {
+		el.Value.(*wofResultCacheEntry).results = copied
+		c.order.MoveToFront(el)
+		return true
+	}
+
+	c.entries[key] = c.order.PushFront(&wofResultCacheEntry{key: key, results: copied})
+
+	for c.order.Len() > c.MaxEntries {
+
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*wofResultCacheEntry).key)
+	}
+
+	return true
+}
+
+func (c *WOFResultCache) Clear() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation += 1
+
+	if c.order.Len() == 0 {
+		return
+	}
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+func (c *WOFResultCache) Len() int {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// cacheResults adds the results of a lookup to p.Results if nothing that might be a
+// result has an edge in the point's cell. It returns true if they were cached.
+//
+// Only polygons that are already in the polygon cache are checked. Loading the rest
+// would mean reading them all over again on every miss, which costs more than the
+// result cache saves, so if any candidate for the cell isn't cached neither are the
+// results. Finding the candidates for the cell is an index search but that's cheap
+// next to loading polygons.
+
+func (p WOFPointInPolygon) cacheResults(lat float64, lon float64, filters WOFPointInPolygonFilters, key string, generation uint64, results []*geojson.WOFSpatial) bool {
+
+	swlat, swlon, nelat, nelon := p.Results.Bounds(lat, lon)
+
+	// the candidates for any point in the cell, not just this one
+
+	var intersects []rtreego.Spatial
+
+	placetype, ok := filters["placetype"].(string)
+
+	if ok {
+		rect, _ := rtreego.NewRect(rtreego.Point{swlon, swlat}, []float64{nelon - swlon, nelat - swlat})
+		intersects, _ = p.GetIntersectsByRectForPlacetype(rect, placetype)
+	} else {
+		intersects, _ = p.GetIntersectsByBoundingBox(swlat, swlon, nelat, nelon)
+	}
+
+	inflated, _ := p.InflateSpatialResults(intersects)
+	candidates, _ := p.Filter(inflated, filters)
+
+	for _, wof := range candidates {
+
+		// IntersectsBox assumes straight edges
+
+		if p.Edges.IsGeodesic(wof.Placetype) {
+			return false
+		}
+
+		polygons, ok := p.Cache.Peek(wof.Id)
+
+		if !ok {
+			return false
+		}
+
+		for _, poly := range polygons {
+
+			// the edges of the original polygon can be anywhere within
+			// the tolerance of a simplified one (see simplify.go)
+
+			band := poly.Tolerance() * simplifyBandSlack
+
+			if poly.IntersectsBox(swlat-band, swlon-band, nelat+band, nelon+band) {
+				return false
+			}
+		}
+	}
+
+	return p.Results.Set(key, generation, results)
+}
@@ -0,0 +1,74 @@
+package pip
+
+import (
+	"testing"
+)
+
+// results are only cached once the polygons for everything that might be a result
+// are in the polygon cache, so that a miss never means reading them again, and after
+// that points in the same cell are answered from the result cache
+
+func TestResultCache(t *testing.T) {
+
+	body := readParseFixture(t, "polygon.geojson")
+
+	tests := []struct {
+		name    string
+		exclude bool
+		cached  int
+	}{
+		{"cached polygons", false, 1},
+		{"excluded polygons", true, 0},
+	}
+
+	for _, test := range tests {
+
+		reader := NewMemoryReader()
+		reader.Add(85922583, body)
+
+		p := newTestPointInPolygon(t, reader)
+
+		if test.exclude {
+			p.CachePolicy.Exclude("locality")
+		}
+
+		results, err := NewResultCache(DefaultResultCachePrecision, 100)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p.Results = results
+
+		err = p.IndexGeoJSONBytes("polygon.geojson", body)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contained, _ := p.GetByLatLon(37.750005, -122.450005)
+
+		if len(contained) != 1 || contained[0].Id != 85922583 {
+			t.Fatalf("%s: expected 85922583, got %v", test.name, contained)
+		}
+
+		if p.Results.Len() != test.cached {
+			t.Errorf("%s: expected %d cached results, got %d", test.name, test.cached, p.Results.Len())
+		}
+
+		// looking up a point a little way off, in the same cell, is a hit if
+		// the results were cached and otherwise it's looked up properly
+
+		contained, timings := p.GetByLatLon(37.750006, -122.450004)
+
+		if len(contained) != 1 || contained[0].Id != 85922583 {
+			t.Fatalf("%s: expected 85922583 again, got %v", test.name, contained)
+		}
+
+		hit := len(timings) == 1 && timings[0].Event == "results"
+
+		if hit != (test.cached == 1) {
+			t.Errorf("%s: expected a hit (%t), got %d timings", test.name, test.cached == 1, len(timings))
+		}
+	}
+}
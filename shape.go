@@ -0,0 +1,501 @@
+package pip
+
+import (
+	"errors"
+	"fmt"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Ranking results, picking the "best" one and drawing labels all want to know how big
+// a record is and where to put a pin in it, and a WOFSpatial only has a bounding box.
+// WOFRecordShape is the rest:
+//
+//	Area     - the area of the record's polygons, in square metres, on a sphere
+//	           (with the authalic radius, so it comes out the same as on the
+//	           ellipsoid to within a fraction of a percent) whose edges are great
+//	           circle arcs. Holes don't count.
+//	Centroid - the centre of mass of that area, worked out on the sphere too. Like
+//	           any centroid it may well be outside the record (think of a crescent
+//	           or an archipelago).
+//	Label    - the record's lbl:latitude and lbl:longitude properties if it has them,
+//	           or else a point that is guaranteed to be inside its biggest polygon
+//	           (see PointOnSurface). LabelSource says which.
+//
+// Working out the area and centroid means reading the record's polygons, which
+// indexing doesn't do, so shapes are worked out the first time something asks for
+// them (see GetShape) and kept until the record is indexed again or removed. Label
+// points are read while indexing, from GeoJSON files or the lbl_latitude and
+// lbl_longitude columns of meta files. Like everything else, shapes assume polygons
+// don't contain a pole or cross the antimeridian.
+
+type WOFRecordShape struct {
+	Area              float64
+	CentroidLatitude  float64
+	CentroidLongitude float64
+	LabelLatitude     float64
+	LabelLongitude    float64
+	LabelSource       string
+}
+
+const (
+	LabelSourceProperties = "lbl"
+	LabelSourceSurface    = "surface"
+)
+
+// the radius of a sphere with the same surface area as the WGS84 ellipsoid
+
+const earthAuthalicRadius = 6371007.2
+
+type WOFLabelPoint struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// LabelFromFeature returns a feature's lbl:latitude and lbl:longitude properties, or
+// nil if it doesn't have them (or they don't make sense)
+
+func LabelFromFeature(feature *geojson.WOFFeature) *WOFLabelPoint {
+
+	body := feature.Body()
+
+	lat, lat_ok := body.Path("properties.lbl:latitude").Data().(float64)
+	lon, lon_ok := body.Path("properties.lbl:longitude").Data().(float64)
+
+	if !lat_ok || !lon_ok {
+		return nil
+	}
+
+	return newLabelPoint(lat, lon)
+}
+
+// LabelFromMetaRow returns the lbl_latitude and lbl_longitude columns of a meta file
+// row, or nil if it doesn't have them
+
+func LabelFromMetaRow(row map[string]string) *WOFLabelPoint {
+
+	str_lat := strings.TrimSpace(row["lbl_latitude"])
+	str_lon := strings.TrimSpace(row["lbl_longitude"])
+
+	if str_lat == "" || str_lon == "" {
+		return nil
+	}
+
+	lat, lat_err := strconv.ParseFloat(str_lat, 64)
+	lon, lon_err := strconv.ParseFloat(str_lon, 64)
+
+	if lat_err != nil || lon_err != nil {
+		return nil
+	}
+
+	return newLabelPoint(lat, lon)
+}
+
+func newLabelPoint(lat float64, lon float64) *WOFLabelPoint {
+
+	// a label at 0,0 is (nearly) always a placeholder rather than a label
+
+	if lat > 90.0 || lat < -90.0 || lon > 180.0 || lon < -180.0 || (lat == 0 && lon == 0) {
+		return nil
+	}
+
+	l := WOFLabelPoint{
+		Latitude:  lat,
+		Longitude: lon,
+	}
+
+	return &l
+}
+
+// ShapeFromPolygons works out the area, centroid and point on surface of a list of
+// polygons; the label is always the point on surface
+
+func ShapeFromPolygons(polygons []*WOFCompactPolygon) (*WOFRecordShape, error) {
+
+	if len(polygons) == 0 {
+		return nil, errors.New("record has no polygons")
+	}
+
+	var area float64
+	var centre [3]float64
+
+	for _, poly := range polygons {
+
+		a, v := polygonMoments(poly)
+
+		area += a
+
+		for i := range centre {
+			centre[i] += v[i]
+		}
+	}
+
+	lat, lon, ok := PointOnSurface(polygons)
+
+	if !ok {
+		return nil, errors.New("unable to find a point inside any of the record's polygons")
+	}
+
+	s := WOFRecordShape{
+		Area:           area * earthAuthalicRadius * earthAuthalicRadius,
+		LabelLatitude:  lat,
+		LabelLongitude: lon,
+		LabelSource:    LabelSourceSurface,
+	}
+
+	// something with no area (or, in theory, something shaped so that it
+	// balances on the centre of the Earth) doesn't have a centroid as such so
+	// use the middle of its bounding box instead
+
+	length := math.Sqrt(centre[0]*centre[0] + centre[1]*centre[1] + centre[2]*centre[2])
+
+	if length < 1e-15 {
+
+		r := polygons[0].OuterRing
+
+		s.CentroidLatitude = (r.MinY + r.MaxY) / 2
+		s.CentroidLongitude = (r.MinX + r.MaxX) / 2
+
+	} else {
+
+		s.CentroidLatitude = math.Atan2(centre[2], math.Hypot(centre[0], centre[1])) / degToRad
+		s.CentroidLongitude = math.Atan2(centre[1], centre[0]) / degToRad
+	}
+
+	return &s, nil
+}
+
+const degToRad = math.Pi / 180.0
+
+// polygonMoments returns the area of a polygon, in steradians, and the sum of the
+// positions (as unit vectors) of every bit of it multiplied by twice their area, which
+// points at its centroid. Holes are subtracted whichever way round their rings are.
+
+func polygonMoments(poly *WOFCompactPolygon) (float64, [3]float64) {
+
+	area, centre := ringMoments(poly.OuterRing.Coords())
+
+	for _, r := range poly.InteriorRings {
+
+		a, v := ringMoments(r.Coords())
+
+		area -= a
+
+		for i := range centre {
+			centre[i] -= v[i]
+		}
+	}
+
+	return area, centre
+}
+
+// ringMoments does the work for polygonMoments using the edges of a single ring. The
+// area between each edge and the equator comes from the spherical excess, which is
+// exact for great circle edges, and the centroid from the fact that the integral of
+// position over an area is half the integral of position x direction around its edge,
+// which for a great circle arc is the angle it covers times the normal to its plane.
+// Both are positive for rings that go anticlockwise, so both are flipped for rings
+// that go the other way.
+
+func ringMoments(coords []float64) (float64, [3]float64) {
+
+	var area float64
+	var centre [3]float64
+
+	count := len(coords) / 2
+
+	if count < 3 {
+		return 0, centre
+	}
+
+	vector := func(i int) [3]float64 {
+
+		lon := coords[i*2] * degToRad
+		lat := coords[i*2+1] * degToRad
+
+		return [3]float64{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+	}
+
+	j := count - 1
+	b := vector(j)
+
+	for i := 0; i < count; i++ {
+
+		a := b
+		b = vector(i)
+
+		x1, y1 := coords[j*2]*degToRad, coords[j*2+1]*degToRad
+		x2, y2 := coords[i*2]*degToRad, coords[i*2+1]*degToRad
+
+		j = i
+
+		if x1 == x2 && y1 == y2 {
+			continue
+		}
+
+		t1 := math.Tan(y1 / 2)
+		t2 := math.Tan(y2 / 2)
+
+		area -= 2 * math.Atan2(math.Tan((x2-x1)/2)*(t1+t2), 1+t1*t2)
+
+		n := [3]float64{
+			a[1]*b[2] - a[2]*b[1],
+			a[2]*b[0] - a[0]*b[2],
+			a[0]*b[1] - a[1]*b[0],
+		}
+
+		sin := math.Sqrt(n[0]*n[0] + n[1]*n[1] + n[2]*n[2])
+
+		if sin == 0 {
+			continue
+		}
+
+		angle := math.Atan2(sin, a[0]*b[0]+a[1]*b[1]+a[2]*b[2])
+
+		for k := range centre {
+			centre[k] += n[k] * angle / sin
+		}
+	}
+
+	if area < 0 {
+
+		area = -area
+
+		for k := range centre {
+			centre[k] = -centre[k]
+		}
+	}
+
+	return area, centre
+}
+
+// PointOnSurface returns a point inside the biggest of a list of polygons (and not
+// in any of its holes), which is what you want for a label when a record has no
+// lbl:latitude and lbl:longitude since its centroid may not be inside it at all. It
+// draws a line across the polygon, as close to the middle of its bounding box as it
+// can without going through a vertex, and returns the middle of the widest bit of
+// that line that is inside the polygon.
+
+func PointOnSurface(polygons []*WOFCompactPolygon) (float64, float64, bool) {
+
+	var biggest *WOFCompactPolygon
+	biggest_area := -1.0
+
+	for _, poly := range polygons {
+
+		area, _ := polygonMoments(poly)
+
+		if area > biggest_area {
+			biggest = poly
+			biggest_area = area
+		}
+	}
+
+	if biggest == nil {
+		return 0, 0, false
+	}
+
+	rings := biggest.Rings()
+	outer := biggest.OuterRing
+
+	// find the vertices closest to the middle, above and below it, and go
+	// halfway between them
+
+	middle := (outer.MinY + outer.MaxY) / 2
+
+	below := math.Inf(-1)
+	above := math.Inf(1)
+
+	for _, coords := range rings {
+
+		for i := 1; i < len(coords); i += 2 {
+
+			y := coords[i]
+
+			if y <= middle && y > below {
+				below = y
+			}
+
+			if y > middle && y < above {
+				above = y
+			}
+		}
+	}
+
+	if math.IsInf(below, 0) || math.IsInf(above, 0) {
+		return 0, 0, false
+	}
+
+	lat := (below + above) / 2
+
+	crossings := make([]float64, 0)
+
+	for _, coords := range rings {
+
+		count := len(coords) / 2
+		j := count - 1
+
+		for i := 0; i < count; i++ {
+
+			x1, y1 := coords[j*2], coords[j*2+1]
+			x2, y2 := coords[i*2], coords[i*2+1]
+
+			j = i
+
+			if (y1 > lat) == (y2 > lat) {
+				continue
+			}
+
+			crossings = append(crossings, (x2-x1)*(lat-y1)/(y2-y1)+x1)
+		}
+	}
+
+	sort.Float64s(crossings)
+
+	best := -1.0
+	var lon float64
+
+	for i := 0; i+1 < len(crossings); i += 2 {
+
+		width := crossings[i+1] - crossings[i]
+
+		if width > best {
+			best = width
+			lon = (crossings[i] + crossings[i+1]) / 2
+		}
+	}
+
+	if best < 0 {
+		return 0, 0, false
+	}
+
+	return lat, lon, true
+}
+
+// GetShape returns the shape of an indexed record, working it out (from its original
+// polygons, even if the cached ones are simplified) if nobody has asked for it since
+// it was indexed
+
+func (p WOFPointInPolygon) GetShape(id int) (*WOFRecordShape, error) {
+
+	p.mu.RLock()
+
+	spatial, indexed := p.Spatials[id]
+	shape, ok := p.Shapes[id]
+	label := p.Labels[id]
+
+	p.mu.RUnlock()
+
+	if !indexed {
+		return nil, errors.New(fmt.Sprintf("%d is not indexed", id))
+	}
+
+	if ok {
+		return shape, nil
+	}
+
+	polygons, ok := p.Cache.Peek(id)
+
+	if !ok || AnySimplified(polygons) {
+
+		var err error
+		polygons, err = p.readCompactPolygons(id)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shape, err := ShapeFromPolygons(polygons)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to work out the shape of %d, because %s", id, err))
+	}
+
+	if label != nil {
+		shape.LabelLatitude = label.Latitude
+		shape.LabelLongitude = label.Longitude
+		shape.LabelSource = LabelSourceProperties
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// don't keep it if the record was indexed again (or removed) while we were
+	// reading the old version
+
+	if p.Spatials[id] == spatial {
+		p.Shapes[id] = shape
+	}
+
+	return shape, nil
+}
+
+// GetShapes returns the shapes for a list of records, in the same order; the shape of
+// any record that can't be worked out is nil
+
+func (p WOFPointInPolygon) GetShapes(results []*geojson.WOFSpatial) []*WOFRecordShape {
+
+	shapes := make([]*WOFRecordShape, len(results))
+
+	for i, wof := range results {
+
+		shape, err := p.GetShape(wof.Id)
+
+		if err != nil {
+			p.Logger.Warning("%s", err)
+			continue
+		}
+
+		shapes[i] = shape
+	}
+
+	return shapes
+}
+
+// SortByArea sorts a list of records by area, smallest first (which is usually the
+// most specific match) or biggest first if 'descending' is true. Records whose shape
+// can't be worked out go last either way. It returns the shapes in the same order.
+
+func (p WOFPointInPolygon) SortByArea(results []*geojson.WOFSpatial, descending bool) ([]*geojson.WOFSpatial, []*WOFRecordShape) {
+
+	shapes := p.GetShapes(results)
+
+	sort.Stable(wofAreaSort{results, shapes, descending})
+
+	return results, shapes
+}
+
+type wofAreaSort struct {
+	results    []*geojson.WOFSpatial
+	shapes     []*WOFRecordShape
+	descending bool
+}
+
+func (s wofAreaSort) Len() int {
+	return len(s.results)
+}
+
+func (s wofAreaSort) Less(i int, j int) bool {
+
+	a := s.shapes[i]
+	b := s.shapes[j]
+
+	if a == nil || b == nil {
+		return a != nil
+	}
+
+	if s.descending {
+		return a.Area > b.Area
+	}
+
+	return a.Area < b.Area
+}
+
+func (s wofAreaSort) Swap(i int, j int) {
+	s.results[i], s.results[j] = s.results[j], s.results[i]
+	s.shapes[i], s.shapes[j] = s.shapes[j], s.shapes[i]
+}
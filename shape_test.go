@@ -0,0 +1,274 @@
+package pip
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func testShapePolygons(rings ...[]float64) []*WOFCompactPolygon {
+	return []*WOFCompactPolygon{NewCompactPolygon(rings, CompactFloat64)}
+}
+
+func testShapeFeature(id int, ring []float64) []byte {
+
+	r := NewCompactRing(ring, CompactFloat64)
+
+	coords := make([]string, 0)
+
+	for i := 0; i < len(ring); i += 2 {
+		coords = append(coords, fmt.Sprintf("[%f,%f]", ring[i], ring[i+1]))
+	}
+
+	return []byte(fmt.Sprintf(`{"id":%d,"type":"Feature","bbox":[%f,%f,%f,%f],"properties":{"wof:id":%d,"wof:name":"shape","wof:placetype":"locality","edtf:deprecated":"","edtf:superseded":"","wof:superseded_by":[]},"geometry":{"type":"Polygon","coordinates":[[%s]]}}`, id, r.MinX, r.MinY, r.MaxX, r.MaxY, id, strings.Join(coords, ",")))
+}
+
+// The expected areas of 1x1 degree cells (whose edges are great circle arcs, so not
+// quite the same as the area between two parallels) come from splitting each one into
+// two spherical triangles and adding up their spherical excess. The centroids come from
+// integrating over each cell numerically. Near the equator the top edge bulges north
+// more than the bottom one does, which is why that centroid is north of the middle.
+
+func TestShapeArea(t *testing.T) {
+
+	// lat is the southern edge of the cell
+
+	tests := []struct {
+		lat      float64
+		km2      float64
+		centroid float64
+	}{
+		{0, 12364.0257, 0.500006},
+		{45, 8666.0545, 45.499610},
+		{80, 2040.5794, 80.491664},
+		{-46, 8666.0545, -45.499610},
+	}
+
+	for _, test := range tests {
+
+		ring := testSquare(10, test.lat, 11, test.lat+1)
+
+		for _, coords := range [][]float64{ring, testReverse(ring)} {
+
+			shape, err := ShapeFromPolygons(testShapePolygons(coords))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			km2 := shape.Area / 1e6
+
+			if math.Abs(km2-test.km2) > 0.001 {
+				t.Errorf("expected a 1x1 degree cell at %f to be %f km2, got %f", test.lat, test.km2, km2)
+			}
+
+			if math.Abs(shape.CentroidLatitude-test.centroid) > 1e-5 || math.Abs(shape.CentroidLongitude-10.5) > 1e-9 {
+				t.Errorf("expected the centroid of the cell at %f to be %f, 10.5, got %f, %f", test.lat, test.centroid, shape.CentroidLatitude, shape.CentroidLongitude)
+			}
+		}
+	}
+}
+
+// holes are subtracted whichever way round either ring goes
+
+func TestShapeHole(t *testing.T) {
+
+	outer := testSquare(0, 0, 10, 10)
+	hole := testSquare(4, 4, 6, 6)
+
+	whole, err := ShapeFromPolygons(testShapePolygons(outer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filled, err := ShapeFromPolygons(testShapePolygons(hole))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := whole.Area - filled.Area
+
+	rings := [][][]float64{
+		{outer, hole},
+		{outer, testReverse(hole)},
+		{testReverse(outer), hole},
+		{testReverse(outer), testReverse(hole)},
+	}
+
+	for i, r := range rings {
+
+		polygons := testShapePolygons(r...)
+
+		shape, err := ShapeFromPolygons(polygons)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if math.Abs(shape.Area-expected) > 1 {
+			t.Errorf("%d: expected %f square metres, got %f", i, expected, shape.Area)
+		}
+
+		if !polygons[0].Contains(shape.LabelLatitude, shape.LabelLongitude) {
+			t.Errorf("%d: expected the label %f, %f to be outside the hole", i, shape.LabelLatitude, shape.LabelLongitude)
+		}
+	}
+}
+
+// the centroid of a crescent (well, a C) is in the gap, but its label isn't
+
+func TestShapeCrescent(t *testing.T) {
+
+	ring := []float64{0, 0, 10, 0, 10, 2, 2, 2, 2, 8, 10, 8, 10, 10, 0, 10, 0, 0}
+
+	for _, coords := range [][]float64{ring, testReverse(ring)} {
+
+		polygons := testShapePolygons(coords)
+
+		shape, err := ShapeFromPolygons(polygons)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if math.Abs(shape.CentroidLatitude-5) > 0.1 || shape.CentroidLongitude < 3.5 || shape.CentroidLongitude > 4.5 {
+			t.Errorf("expected the centroid to be near 5, 4.1, got %f, %f", shape.CentroidLatitude, shape.CentroidLongitude)
+		}
+
+		if polygons[0].Contains(shape.CentroidLatitude, shape.CentroidLongitude) {
+			t.Errorf("expected the centroid to be outside the crescent")
+		}
+
+		if shape.LabelSource != LabelSourceSurface {
+			t.Errorf("expected a label from the surface, got %s", shape.LabelSource)
+		}
+
+		if !polygons[0].Contains(shape.LabelLatitude, shape.LabelLongitude) {
+			t.Errorf("expected the label %f, %f to be inside the crescent", shape.LabelLatitude, shape.LabelLongitude)
+		}
+	}
+}
+
+// lbl:latitude and lbl:longitude win over the point on surface
+
+func TestShapeLabels(t *testing.T) {
+
+	body := readParseFixture(t, "polygon.geojson")
+
+	unlabelled := strings.Replace(string(body), `"lbl:latitude": 37.759715,`, "", 1)
+	unlabelled = strings.Replace(unlabelled, `"lbl:longitude": -122.432,`, "", 1)
+
+	if unlabelled == string(body) {
+		t.Fatalf("failed to remove the fixture's label")
+	}
+
+	tests := []struct {
+		body   []byte
+		source string
+	}{
+		{body, LabelSourceProperties},
+		{[]byte(unlabelled), LabelSourceSurface},
+	}
+
+	for _, test := range tests {
+
+		reader := NewMemoryReader()
+		reader.Add(85922583, test.body)
+
+		p := newTestPointInPolygon(t, reader)
+
+		err := p.IndexGeoJSONBytes("polygon.geojson", test.body)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shape, err := p.GetShape(85922583)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if shape.LabelSource != test.source {
+			t.Errorf("expected a label from %s, got %s", test.source, shape.LabelSource)
+		}
+
+		if test.source == LabelSourceProperties && (shape.LabelLatitude != 37.759715 || shape.LabelLongitude != -122.432) {
+			t.Errorf("expected the label from the fixture's properties, got %f, %f", shape.LabelLatitude, shape.LabelLongitude)
+		}
+
+		polygons, err := CompactPolygonsFromGeoJSON(test.body, CompactFloat64)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !polygons[0].Contains(shape.LabelLatitude, shape.LabelLongitude) {
+			t.Errorf("expected the label %f, %f to be inside the polygon", shape.LabelLatitude, shape.LabelLongitude)
+		}
+	}
+}
+
+// records whose shape can't be worked out go last, whichever way things are sorted
+
+func TestSortByArea(t *testing.T) {
+
+	reader := NewMemoryReader()
+	p := newTestPointInPolygon(t, reader)
+
+	rings := map[int][]float64{
+		1: testSquare(0, 0, 2, 2),
+		2: testSquare(0, 0, 1, 1),
+		3: testSquare(0, 0, 3, 3),
+		4: testSquare(0, 0, 4, 4),
+	}
+
+	for id := 1; id <= 4; id++ {
+
+		body := testShapeFeature(id, rings[id])
+		reader.Add(id, body)
+
+		err := p.IndexGeoJSONBytes(fmt.Sprintf("%d", id), body)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 4 is the biggest but can't be read anymore
+
+	reader.Remove(4)
+
+	tests := []struct {
+		descending bool
+		expected   []int
+	}{
+		{false, []int{2, 1, 3, 4}},
+		{true, []int{3, 1, 2, 4}},
+	}
+
+	for _, test := range tests {
+
+		results, _ := p.GetIntersectsByLatLon(0.5, 0.5)
+		candidates, _ := p.InflateSpatialResults(results)
+
+		sorted, shapes := p.SortByArea(candidates, test.descending)
+
+		ids := make([]int, 0)
+
+		for _, wof := range sorted {
+			ids = append(ids, wof.Id)
+		}
+
+		if fmt.Sprintf("%v", ids) != fmt.Sprintf("%v", test.expected) {
+			t.Errorf("expected %v (descending %t), got %v", test.expected, test.descending, ids)
+		}
+
+		if len(shapes) != 4 || shapes[3] != nil {
+			t.Errorf("expected the record without a shape to be last, got %v", shapes)
+		}
+	}
+}
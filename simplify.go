@@ -0,0 +1,342 @@
+package pip
+
+import (
+	"math"
+)
+
+// Coastlines have an awful lot of vertices, all of which cost memory in the cache
+// and time in every containment check, but they only make a difference to points
+// close to the coast. If the SimplifyTolerance property is greater than 0 then
+// polygons are simplified, using Douglas-Peucker, before they are cached.
+//
+// Douglas-Peucker only drops a vertex if it is within the tolerance of the edge that
+// replaces it so the original boundary is never further than that from the
+// simplified one. A point further than that from every edge of the simplified
+// polygon is inside the simplified polygon if and only if it is inside the original
+// (whatever the boundary rule, and even if simplifying made the polygon cross itself)
+// so only points close to the simplified boundary need the original. The originals
+// are kept, prepared, in a second, smaller, cache (the Originals property) so that
+// records that lots of points land near aren't read again every time. Answers are
+// the same as if nothing had been simplified.
+//
+// That's also why there's no need for a topology-preserving simplification (like
+// Visvalingam with an intersection check). Rings that end up crossing themselves, or
+// a neighbour, only do so within the tolerance of the original boundary, which is
+// exactly where the original is used instead.
+//
+// The tolerance is in metres and converted to degrees at the equator, where a degree
+// of longitude is longest, so away from it polygons are simplified a bit less than
+// asked for but never more. Rings that would end up with fewer than three vertices
+// are left alone, as are polygons with geodesic edges (see edges.go) since
+// simplification assumes straight ones.
+
+const metresPerDegree = 111319.49
+
+// simplifyBandSlack makes the band of points that are checked against the original
+// polygon a little wider than the tolerance so that rounding can't matter
+
+const simplifyBandSlack = 1.01
+
+// DefaultSimplifyOriginalsSize is the size, in bytes, of the cache of original polygons
+// for points near the edges of simplified ones
+
+const DefaultSimplifyOriginalsSize = 64 * 1024 * 1024
+
+func SimplifyToleranceDegrees(metres float64) float64 {
+	return metres / metresPerDegree
+}
+
+// SimplifyRing simplifies a flat list of (longitude, latitude) pairs with a tolerance
+// in degrees. The first and last vertices are always kept. It returns the original
+// list if that would leave fewer than 3 distinct vertices or not drop anything.
+
+func SimplifyRing(coords []float64, tolerance float64) []float64 {
+
+	count := len(coords) / 2
+
+	if count < 4 || tolerance <= 0 {
+		return coords
+	}
+
+	keep := make([]bool, count)
+	keep[0] = true
+	keep[count-1] = true
+
+	// a ring's first and last vertices are usually the same point so split it
+	// at the vertex furthest from the first one too, otherwise every vertex is
+	// measured against a zero length edge
+
+	far := 0
+	far_d := -1.0
+
+	for i := 1; i < count-1; i++ {
+
+		d := math.Hypot(coords[i*2]-coords[0], coords[i*2+1]-coords[1])
+
+		if d > far_d {
+			far = i
+			far_d = d
+		}
+	}
+
+	keep[far] = true
+
+	// do it with a stack rather than recursion since coastlines can have an
+	// awful lot of vertices
+
+	stack := [][2]int{{0, far}, {far, count - 1}}
+
+	for len(stack) > 0 {
+
+		span := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		first := span[0]
+		last := span[1]
+
+		if last-first < 2 {
+			continue
+		}
+
+		worst := -1
+		worst_d := tolerance
+
+		for i := first + 1; i < last; i++ {
+
+			d := segmentDistance(coords[i*2], coords[i*2+1], coords[first*2], coords[first*2+1], coords[last*2], coords[last*2+1])
+
+			if d > worst_d {
+				worst = i
+				worst_d = d
+			}
+		}
+
+		if worst == -1 {
+			continue
+		}
+
+		keep[worst] = true
+		stack = append(stack, [2]int{first, worst}, [2]int{worst, last})
+	}
+
+	simplified := make([]float64, 0)
+
+	for i := 0; i < count; i++ {
+
+		if keep[i] {
+			simplified = append(simplified, coords[i*2], coords[i*2+1])
+		}
+	}
+
+	kept := len(simplified) / 2
+
+	// the closing vertex (if there is one) doesn't count
+
+	distinct := kept
+
+	if coords[0] == coords[len(coords)-2] && coords[1] == coords[len(coords)-1] {
+		distinct -= 1
+	}
+
+	if distinct < 3 || kept == count {
+		return coords
+	}
+
+	return simplified
+}
+
+// segmentDistance returns the distance from (x, y) to the segment (x1, y1) - (x2, y2)
+// in degrees
+
+func segmentDistance(x float64, y float64, x1 float64, y1 float64, x2 float64, y2 float64) float64 {
+
+	dx := x2 - x1
+	dy := y2 - y1
+
+	if dx == 0 && dy == 0 {
+		return math.Hypot(x-x1, y-y1)
+	}
+
+	t := ((x-x1)*dx + (y-y1)*dy) / (dx*dx + dy*dy)
+
+	if t < 0 {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+
+	return math.Hypot(x-(x1+t*dx), y-(y1+t*dy))
+}
+
+// Simplify returns a simplified copy of the polygon, using the same encoding, with a
+// tolerance in degrees. If nothing can be simplified it returns the polygon itself.
+
+func (p *WOFCompactPolygon) Simplify(tolerance float64) *WOFCompactPolygon {
+
+	rings := p.Rings()
+	simplified := make([][]float64, len(rings))
+
+	changed := false
+
+	for i, coords := range rings {
+
+		simplified[i] = SimplifyRing(coords, tolerance)
+
+		if len(simplified[i]) != len(coords) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return p
+	}
+
+	s := NewCompactPolygon(simplified, p.OuterRing.Encoding)
+	s.tolerance = tolerance
+
+	return s
+}
+
+// SimplifyCompactPolygons simplifies a list of polygons with a tolerance in metres
+
+func SimplifyCompactPolygons(polygons []*WOFCompactPolygon, metres float64) []*WOFCompactPolygon {
+
+	tolerance := SimplifyToleranceDegrees(metres)
+	simplified := make([]*WOFCompactPolygon, len(polygons))
+
+	for i, poly := range polygons {
+		simplified[i] = poly.Simplify(tolerance)
+	}
+
+	return simplified
+}
+
+func (p *WOFCompactPolygon) IsSimplified() bool {
+	return p.tolerance > 0
+}
+
+// Tolerance returns the tolerance, in degrees, the polygon was simplified with or 0
+// if it wasn't
+
+func (p *WOFCompactPolygon) Tolerance() float64 {
+	return p.tolerance
+}
+
+// NearBoundary returns true if the polygon was simplified and the point is close
+// enough to one of its edges that the original polygon might not agree with it
+
+func (p *WOFCompactPolygon) NearBoundary(lat float64, lon float64) bool {
+
+	if p.tolerance <= 0 {
+		return false
+	}
+
+	band := p.tolerance * simplifyBandSlack
+
+	if p.OuterRing.near(lat, lon, band) {
+		return true
+	}
+
+	for _, r := range p.InteriorRings {
+
+		if r.near(lat, lon, band) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func AnySimplified(polygons []*WOFCompactPolygon) bool {
+
+	for _, poly := range polygons {
+
+		if poly.IsSimplified() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AnyNearBoundary is NearBoundary for a list of polygons
+
+func AnyNearBoundary(polygons []*WOFCompactPolygon, lat float64, lon float64) bool {
+
+	for _, poly := range polygons {
+
+		if poly.NearBoundary(lat, lon) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *WOFCompactRing) near(lat float64, lon float64, band float64) bool {
+
+	if lon < r.MinX-band || lon > r.MaxX+band || lat < r.MinY-band || lat > r.MaxY+band {
+		return false
+	}
+
+	edge := func(i int) bool {
+
+		j := i - 1
+
+		if i == 0 {
+			j = r.Count - 1
+		}
+
+		x1, y1 := r.vertex(i)
+		x2, y2 := r.vertex(j)
+
+		return segmentDistance(lon, lat, x1, y1, x2, y2) <= band
+	}
+
+	// a prepared ring only needs to look at the edges in the bands that are
+	// close enough
+
+	if r.grid != nil {
+
+		g := r.grid
+
+		for b := g.band(lat - band); b <= g.band(lat+band); b++ {
+
+			for _, e := range g.edges[g.offsets[b]:g.offsets[b+1]] {
+
+				if edge(int(e)) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	if r.Encoding == CompactDelta {
+
+		coords := r.Coords()
+
+		j := r.Count - 1
+
+		for i := 0; i < r.Count; i++ {
+
+			if segmentDistance(lon, lat, coords[i*2], coords[i*2+1], coords[j*2], coords[j*2+1]) <= band {
+				return true
+			}
+
+			j = i
+		}
+
+		return false
+	}
+
+	for i := 0; i < r.Count; i++ {
+
+		if edge(i) {
+			return true
+		}
+	}
+
+	return false
+}
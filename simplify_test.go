@@ -0,0 +1,101 @@
+package pip
+
+import (
+	"fmt"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"math"
+	"strings"
+	"testing"
+)
+
+// testWigglyFeature is a roughly circular locality, 1 degree across, whose edge
+// wiggles by about 50 metres so that there's plenty to simplify
+
+func testWigglyFeature(id int) []byte {
+
+	coords := make([]string, 0)
+
+	for i := 0; i <= 2000; i++ {
+
+		a := 2 * math.Pi * float64(i%2000) / 2000
+		r := 0.5 + 0.0005*math.Sin(float64(i))
+
+		coords = append(coords, fmt.Sprintf("[%f,%f]", r*math.Cos(a), r*math.Sin(a)))
+	}
+
+	return []byte(fmt.Sprintf(`{"id":%d,"type":"Feature","bbox":[-0.501,-0.501,0.501,0.501],"properties":{"wof:id":%d,"wof:name":"wiggly","wof:placetype":"locality","edtf:deprecated":"","edtf:superseded":"","wof:superseded_by":[]},"geometry":{"type":"Polygon","coordinates":[[%s]]}}`, id, id, strings.Join(coords, ",")))
+}
+
+func TestSimplifyOriginals(t *testing.T) {
+
+	body := testWigglyFeature(1)
+
+	reader := NewMemoryReader()
+	reader.Add(1, body)
+
+	p := newTestPointInPolygon(t, reader)
+	p.SimplifyTolerance = 200
+
+	err := p.IndexGeoJSONBytes("wiggly", body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spatial, _ := p.GetById(1)
+	candidates := []*geojson.WOFSpatial{spatial}
+
+	// far from the edge only the simplified polygons are needed
+
+	results, _ := p.EnsureContained(0, 0, candidates)
+
+	if len(results) != 1 {
+		t.Fatalf("expected 0,0 to be contained")
+	}
+
+	cached, ok := p.Cache.Peek(1)
+
+	if !ok || !AnySimplified(cached) {
+		t.Fatalf("expected the cached polygons to be simplified")
+	}
+
+	if p.Originals.Contains(1) {
+		t.Errorf("didn't expect the original polygons to be kept yet")
+	}
+
+	// near the edge the originals are read once and kept; after that the
+	// reader doesn't need to have them
+
+	original, err := CompactPolygonsFromGeoJSON(body, CompactFloat64)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, lon := range []float64{0.4995, 0.5, 0.5005} {
+
+		if i == 1 {
+			reader.Remove(1)
+		}
+
+		results, _ := p.EnsureContained(0, lon, candidates)
+
+		expected := original[0].ContainsWithRule(0, lon, p.Boundary)
+
+		if (len(results) == 1) != expected {
+			t.Errorf("0,%f is contained: %t, expected %t", lon, len(results) == 1, expected)
+		}
+
+		if !p.Originals.Contains(1) {
+			t.Errorf("expected the original polygons to be kept")
+		}
+	}
+
+	// and forgotten when the record is removed
+
+	p.UnindexId(1)
+
+	if p.Originals.Contains(1) {
+		t.Errorf("expected the original polygons to be removed along with the record")
+	}
+}
@@ -0,0 +1,555 @@
+package pip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	geo "github.com/kellydunn/golang-geo"
+	geojson "github.com/whosonfirst/go-whosonfirst-geojson"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A geometry store is a single file containing the rings for every record, packed
+// as little-endian float64 (longitude, latitude) pairs, followed by an index of
+// WOF IDs and the offset and length of each record. The index is read in to memory
+// when the store is opened and records are read with a single pread (ReadAt) so
+// a cache miss doesn't need to open, read and parse a GeoJSON file.
+//
+// The layout looks like this:
+//
+//	header:  magic (8 bytes) | index offset (uint64) | record count (uint64)
+//	record:  polygon count (uint32) then for each polygon:
+//	           ring count (uint32) then for each ring:
+//	             point count (uint32) | lon, lat (float64) * point count
+//	index:   id (int64) | offset (uint64) | length (uint32) * record count, sorted by id
+
+const geometryStoreMagic = "WOFGEOM1"
+const geometryStoreHeaderLength = 24
+const geometryStoreIndexEntryLength = 20
+
+type WOFGeometryStore struct {
+	Path    string
+	fh      *os.File
+	ids     []int64
+	offsets []uint64
+	lengths []uint32
+}
+
+type WOFGeometryStoreWriter struct {
+	Path    string
+	fh      *os.File
+	writer  *bufio.Writer
+	offset  uint64
+	entries map[int64][2]uint64
+	mu      *sync.Mutex
+}
+
+func OpenGeometryStore(path string) (*WOFGeometryStore, error) {
+
+	fh, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, geometryStoreHeaderLength)
+
+	_, err = fh.ReadAt(header, 0)
+
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	if string(header[0:8]) != geometryStoreMagic {
+		fh.Close()
+		return nil, errors.New(fmt.Sprintf("%s is not a geometry store", path))
+	}
+
+	index_offset := binary.LittleEndian.Uint64(header[8:16])
+	count := binary.LittleEndian.Uint64(header[16:24])
+
+	if index_offset == 0 {
+		fh.Close()
+		return nil, errors.New(fmt.Sprintf("%s was not closed properly", path))
+	}
+
+	// check the header against the size of the file before allocating
+	// anything, so that a truncated or corrupt store is an error rather than a
+	// request for a few gigabytes of memory
+
+	info, err := fh.Stat()
+
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	size := uint64(info.Size())
+
+	if index_offset < geometryStoreHeaderLength || index_offset > size || count > (size-index_offset)/geometryStoreIndexEntryLength {
+		fh.Close()
+		return nil, errors.New(fmt.Sprintf("%s is truncated or corrupt, its index doesn't fit in the file", path))
+	}
+
+	index := make([]byte, count*geometryStoreIndexEntryLength)
+
+	_, err = fh.ReadAt(index, int64(index_offset))
+
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	s := WOFGeometryStore{
+		Path:    path,
+		fh:      fh,
+		ids:     make([]int64, count),
+		offsets: make([]uint64, count),
+		lengths: make([]uint32, count),
+	}
+
+	for i := uint64(0); i < count; i++ {
+
+		entry := index[i*geometryStoreIndexEntryLength : (i+1)*geometryStoreIndexEntryLength]
+
+		s.ids[i] = int64(binary.LittleEndian.Uint64(entry[0:8]))
+		s.offsets[i] = binary.LittleEndian.Uint64(entry[8:16])
+		s.lengths[i] = binary.LittleEndian.Uint32(entry[16:20])
+
+		if s.offsets[i] < geometryStoreHeaderLength || s.offsets[i]+uint64(s.lengths[i]) > index_offset {
+			fh.Close()
+			return nil, errors.New(fmt.Sprintf("%s is corrupt, the record for %d is outside the data", path, s.ids[i]))
+		}
+	}
+
+	return &s, nil
+}
+
+func (s *WOFGeometryStore) Count() int {
+	return len(s.ids)
+}
+
+func (s *WOFGeometryStore) Close() error {
+	return s.fh.Close()
+}
+
+func (s *WOFGeometryStore) String() string {
+	return s.Path
+}
+
+func (s *WOFGeometryStore) find(id int) (int, bool) {
+
+	i := sort.Search(len(s.ids), func(i int) bool {
+		return s.ids[i] >= int64(id)
+	})
+
+	if i < len(s.ids) && s.ids[i] == int64(id) {
+		return i, true
+	}
+
+	return -1, false
+}
+
+func (s *WOFGeometryStore) Has(id int) bool {
+
+	_, ok := s.find(id)
+	return ok
+}
+
+// ReadRings returns the raw packed coordinates for a record, as a list of polygons
+// each of which is a list of rings (the first one being the outer ring)
+
+func (s *WOFGeometryStore) ReadRings(id int) ([][][]float64, error) {
+
+	i, ok := s.find(id)
+
+	if !ok {
+		return nil, notFound(id)
+	}
+
+	body := make([]byte, s.lengths[i])
+
+	_, err := s.fh.ReadAt(body, int64(s.offsets[i]))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRings(body)
+}
+
+func (s *WOFGeometryStore) ReadPolygons(id int) ([]*geojson.WOFPolygon, error) {
+
+	rings, err := s.ReadRings(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	polygons := make([]*geojson.WOFPolygon, 0)
+
+	for _, poly := range rings {
+
+		geo_rings := make([]geo.Polygon, 0)
+
+		for _, coords := range poly {
+
+			ring := geo.Polygon{}
+
+			for j := 0; j < len(coords); j += 2 {
+				ring.Add(geo.NewPoint(coords[j+1], coords[j]))
+			}
+
+			geo_rings = append(geo_rings, ring)
+		}
+
+		if len(geo_rings) == 0 {
+			continue
+		}
+
+		polygons = append(polygons, &geojson.WOFPolygon{
+			OuterRing:     geo_rings[0],
+			InteriorRings: geo_rings[1:],
+		})
+	}
+
+	return polygons, nil
+}
+
+func (s *WOFGeometryStore) ReadCompactPolygons(id int, encoding WOFCompactEncoding) ([]*WOFCompactPolygon, error) {
+
+	rings, err := s.ReadRings(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return CompactPolygonsFromRings(rings, encoding), nil
+}
+
+func CreateGeometryStore(path string) (*WOFGeometryStoreWriter, error) {
+
+	fh, err := os.Create(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriter(fh)
+
+	// the index offset and count get filled in by Close
+
+	header := make([]byte, geometryStoreHeaderLength)
+	copy(header[0:8], geometryStoreMagic)
+
+	_, err = writer.Write(header)
+
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	w := WOFGeometryStoreWriter{
+		Path:    path,
+		fh:      fh,
+		writer:  writer,
+		offset:  geometryStoreHeaderLength,
+		entries: make(map[int64][2]uint64),
+		mu:      new(sync.Mutex),
+	}
+
+	return &w, nil
+}
+
+func (w *WOFGeometryStoreWriter) Count() int {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.entries)
+}
+
+func (w *WOFGeometryStoreWriter) AddPolygons(id int, polygons []*geojson.WOFPolygon) error {
+
+	rings := make([][][]float64, 0)
+
+	for _, poly := range polygons {
+
+		poly_rings := make([][]float64, 0)
+		poly_rings = append(poly_rings, flattenRing(poly.OuterRing))
+
+		for _, r := range poly.InteriorRings {
+			poly_rings = append(poly_rings, flattenRing(r))
+		}
+
+		rings = append(rings, poly_rings)
+	}
+
+	return w.AddRings(id, rings)
+}
+
+// AddGeoJSON adds the geometry for a GeoJSON feature and returns its WOF ID. Records
+// without any polygons (like Points) are skipped, in which case the ID is -1.
+
+func (w *WOFGeometryStoreWriter) AddGeoJSON(body []byte) (int, error) {
+
+	rings, err := GeometryRingsFromGeoJSON(body)
+
+	if err != nil {
+		return -1, err
+	}
+
+	if len(rings) == 0 {
+		return -1, nil
+	}
+
+	feature, err := UnmarshalFeatureProperties(body)
+
+	if err != nil {
+		return -1, err
+	}
+
+	id := feature.Id()
+
+	err = w.AddRings(id, rings)
+
+	if err != nil {
+		return -1, err
+	}
+
+	return id, nil
+}
+
+func (w *WOFGeometryStoreWriter) AddRings(id int, rings [][][]float64) error {
+
+	body := encodeRings(rings)
+
+	if len(body) > math.MaxUint32 {
+		return errors.New(fmt.Sprintf("geometry for %d is too big", id))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, ok := w.entries[int64(id)]
+
+	if ok {
+		return errors.New(fmt.Sprintf("geometry for %d has already been added", id))
+	}
+
+	_, err := w.writer.Write(body)
+
+	if err != nil {
+		return err
+	}
+
+	w.entries[int64(id)] = [2]uint64{w.offset, uint64(len(body))}
+	w.offset += uint64(len(body))
+
+	return nil
+}
+
+func (w *WOFGeometryStoreWriter) Close() error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ids := make([]int64, 0)
+
+	for id, _ := range w.entries {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	index_offset := w.offset
+	entry := make([]byte, geometryStoreIndexEntryLength)
+
+	for _, id := range ids {
+
+		e := w.entries[id]
+
+		binary.LittleEndian.PutUint64(entry[0:8], uint64(id))
+		binary.LittleEndian.PutUint64(entry[8:16], e[0])
+		binary.LittleEndian.PutUint32(entry[16:20], uint32(e[1]))
+
+		_, err := w.writer.Write(entry)
+
+		if err != nil {
+			w.fh.Close()
+			return err
+		}
+	}
+
+	err := w.writer.Flush()
+
+	if err != nil {
+		w.fh.Close()
+		return err
+	}
+
+	header := make([]byte, geometryStoreHeaderLength-8)
+	binary.LittleEndian.PutUint64(header[0:8], index_offset)
+	binary.LittleEndian.PutUint64(header[8:16], uint64(len(ids)))
+
+	_, err = w.fh.WriteAt(header, 8)
+
+	if err != nil {
+		w.fh.Close()
+		return err
+	}
+
+	return w.fh.Close()
+}
+
+func flattenRing(ring geo.Polygon) []float64 {
+
+	points := ring.Points()
+	coords := make([]float64, len(points)*2)
+
+	for i, pt := range points {
+		coords[i*2] = pt.Lng()
+		coords[i*2+1] = pt.Lat()
+	}
+
+	return coords
+}
+
+func encodeRings(rings [][][]float64) []byte {
+
+	size := 4
+
+	for _, poly := range rings {
+
+		size += 4
+
+		for _, coords := range poly {
+			size += 4 + len(coords)*8
+		}
+	}
+
+	body := make([]byte, size)
+	offset := 0
+
+	binary.LittleEndian.PutUint32(body[offset:], uint32(len(rings)))
+	offset += 4
+
+	for _, poly := range rings {
+
+		binary.LittleEndian.PutUint32(body[offset:], uint32(len(poly)))
+		offset += 4
+
+		for _, coords := range poly {
+
+			binary.LittleEndian.PutUint32(body[offset:], uint32(len(coords)/2))
+			offset += 4
+
+			for _, c := range coords {
+				binary.LittleEndian.PutUint64(body[offset:], math.Float64bits(c))
+				offset += 8
+			}
+		}
+	}
+
+	return body
+}
+
+func decodeRings(body []byte) ([][][]float64, error) {
+
+	offset := 0
+
+	read_uint32 := func() (uint32, error) {
+
+		if offset+4 > len(body) {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		v := binary.LittleEndian.Uint32(body[offset:])
+		offset += 4
+
+		return v, nil
+	}
+
+	// every count comes straight from the file so check that what it says is
+	// there could be before allocating anything: a polygon takes at least 4
+	// bytes (its count of rings), a ring at least 4 (its count of points) and a
+	// point 16
+
+	check := func(count uint32, size int, what string) error {
+
+		if int64(count)*int64(size) > int64(len(body)-offset) {
+			return errors.New(fmt.Sprintf("corrupt geometry, %d %s don't fit in the %d bytes that are left", count, what, len(body)-offset))
+		}
+
+		return nil
+	}
+
+	count_polys, err := read_uint32()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = check(count_polys, 4, "polygons")
+
+	if err != nil {
+		return nil, err
+	}
+
+	rings := make([][][]float64, count_polys)
+
+	for i := uint32(0); i < count_polys; i++ {
+
+		count_rings, err := read_uint32()
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = check(count_rings, 4, "rings")
+
+		if err != nil {
+			return nil, err
+		}
+
+		poly := make([][]float64, count_rings)
+
+		for j := uint32(0); j < count_rings; j++ {
+
+			count_points, err := read_uint32()
+
+			if err != nil {
+				return nil, err
+			}
+
+			err = check(count_points, 16, "points")
+
+			if err != nil {
+				return nil, err
+			}
+
+			n := int(count_points) * 2
+
+			coords := make([]float64, n)
+
+			for k := 0; k < n; k++ {
+				coords[k] = math.Float64frombits(binary.LittleEndian.Uint64(body[offset:]))
+				offset += 8
+			}
+
+			poly[j] = coords
+		}
+
+		rings[i] = poly
+	}
+
+	return rings, nil
+}
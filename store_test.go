@@ -0,0 +1,197 @@
+package pip
+
+import (
+	"encoding/binary"
+	log "github.com/whosonfirst/go-whosonfirst-log"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestPointInPolygon(t *testing.T, reader WOFReader) *WOFPointInPolygon {
+
+	logger := log.NewWOFLogger("[test] ")
+	logger.AddLogger(ioutil.Discard, "debug")
+
+	p, err := NewPointInPolygonWithReader(reader, 1, 1, logger)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func newTestGeometryStore(t *testing.T, id int, rings [][][]float64) *WOFGeometryStore {
+
+	path := filepath.Join(t.TempDir(), "geometries.bin")
+
+	w, err := CreateGeometryStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.AddRings(id, rings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenGeometryStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func compactRings(polygons []*WOFCompactPolygon) [][]float64 {
+
+	rings := make([][]float64, 0)
+
+	for _, poly := range polygons {
+		rings = append(rings, poly.OuterRing.Coords())
+	}
+
+	return rings
+}
+
+// once a record has been indexed again the geometry store may be out of date so
+// its polygons have to come from the reader
+
+func TestGeometryStoreReindexed(t *testing.T) {
+
+	body := readParseFixture(t, "polygon.geojson")
+
+	reader := NewMemoryReader()
+	reader.Add(85922583, body)
+
+	p := newTestPointInPolygon(t, reader)
+
+	err := p.IndexGeoJSONBytes("polygon.geojson", body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := [][][]float64{{testSquare(-122.5, 37.7, -122.4, 37.8)}}
+	p.Geometries = newTestGeometryStore(t, 85922583, stored)
+
+	polygons, err := p.readCompactPolygons(85922583)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(compactRings(polygons), stored[0]) {
+		t.Fatalf("expected polygons from the geometry store, got %v", compactRings(polygons))
+	}
+
+	from_reader, err := CompactPolygonsFromGeoJSON(body, p.CacheEncoding)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.IndexGeoJSONBytes("polygon.geojson", body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	polygons, err = p.readCompactPolygons(85922583)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(compactRings(polygons), compactRings(from_reader)) {
+		t.Errorf("expected polygons from the reader once the record was indexed again, got %v", compactRings(polygons))
+	}
+
+	// the same goes for records that were removed and then added back
+
+	p.UnindexId(85922583)
+
+	_, ok := p.GetById(85922583)
+
+	if ok {
+		t.Fatalf("expected 85922583 to be removed")
+	}
+
+	if !p.isReindexed(85922583) {
+		t.Errorf("expected a removed record not to use the geometry store")
+	}
+}
+
+// counts in a corrupt or truncated store are errors rather than huge allocations
+
+func TestGeometryStoreCorrupt(t *testing.T) {
+
+	rings := [][][]float64{{testSquare(0, 0, 1, 1), testSquare(0.2, 0.2, 0.8, 0.8)}}
+	body := encodeRings(rings)
+
+	decoded, err := decodeRings(body)
+
+	if err != nil || !reflect.DeepEqual(decoded, rings) {
+		t.Fatalf("expected %v, got %v (%v)", rings, decoded, err)
+	}
+
+	// the offsets of the polygon, ring and point counts
+
+	for _, offset := range []int{0, 4, 8} {
+
+		corrupt := append([]byte{}, body...)
+		binary.LittleEndian.PutUint32(corrupt[offset:], 0xffffffff)
+
+		_, err := decodeRings(corrupt)
+
+		if err == nil {
+			t.Errorf("expected a huge count at %d to be an error", offset)
+		}
+	}
+
+	for _, length := range []int{0, 3, 6, len(body) - 1} {
+
+		_, err := decodeRings(body[:length])
+
+		if err == nil {
+			t.Errorf("expected %d of %d bytes to be an error", length, len(body))
+		}
+	}
+
+	store := newTestGeometryStore(t, 1, rings)
+
+	whole, err := ioutil.ReadFile(store.Path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, length := range []int{geometryStoreHeaderLength, len(whole) - 1} {
+
+		path := filepath.Join(t.TempDir(), "truncated.bin")
+
+		err := ioutil.WriteFile(path, whole[:length], 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = OpenGeometryStore(path)
+
+		if err == nil {
+			t.Errorf("expected a store truncated to %d of %d bytes to be an error", length, len(whole))
+		}
+	}
+}
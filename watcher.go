@@ -0,0 +1,512 @@
+package pip
+
+import (
+	"errors"
+	csv "github.com/whosonfirst/go-whosonfirst-csv"
+	log "github.com/whosonfirst/go-whosonfirst-log"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The watcher is a simple polling loop rather than something that listens for
+// filesystem events. The thing we're trying to account for is a cron job that
+// does a `git pull` in the data repo and that means thousands of files can change
+// at once, most of them in directories we've never been told about. Polling
+// the meta files and stat-ing the files they point to is boring but it works
+// everywhere and doesn't run out of inotify handles...
+
+type WOFSyncStatus struct {
+	Started  time.Time
+	Finished time.Time
+	Duration float64
+	DryRun   bool
+	Records  int
+	Added    []int
+	Updated  []int
+	Removed  []int
+	Touched  int
+	Errors   int
+	Error    string
+}
+
+type WOFWatchedFile struct {
+	Path    string
+	ModTime time.Time
+	Size    int64
+}
+
+type WOFWatchedMeta struct {
+	ModTime time.Time
+	Size    int64
+	Rows    map[int]string
+}
+
+type WOFPointInPolygonWatcher struct {
+	PIP      *WOFPointInPolygon
+	Root     string
+	Meta     []string
+	Interval time.Duration
+	DryRun   bool
+	Logger   *log.WOFLogger
+	meta     map[string]*WOFWatchedMeta
+	files    map[int]*WOFWatchedFile
+	status   *WOFSyncStatus
+	mu       *sync.Mutex
+	done     chan bool
+	stop     *sync.Once
+}
+
+func NewPointInPolygonWatcher(p *WOFPointInPolygon, meta []string, interval time.Duration, dryrun bool) (*WOFPointInPolygonWatcher, error) {
+
+	if interval <= 0 {
+		return nil, errors.New("watch interval must be greater than zero")
+	}
+
+	// we need modification times so this only works for records on disk
+
+	fs, ok := p.Reader.(*WOFFilesystemReader)
+
+	if !ok {
+		return nil, errors.New("watching for changes is only supported for records stored in a single directory")
+	}
+
+	w := WOFPointInPolygonWatcher{
+		PIP:      p,
+		Root:     fs.Root,
+		Meta:     meta,
+		Interval: interval,
+		DryRun:   dryrun,
+		Logger:   p.Logger,
+		meta:     make(map[string]*WOFWatchedMeta),
+		files:    make(map[int]*WOFWatchedFile),
+		status:   nil,
+		mu:       new(sync.Mutex),
+		done:     make(chan bool),
+		stop:     new(sync.Once),
+	}
+
+	return &w, nil
+}
+
+// Prime records the current state of the meta files and the files they point to
+// without changing the index. It should be called *before* the meta files are
+// indexed so that anything that changes while indexing is caught by the first sync.
+
+func (w *WOFPointInPolygonWatcher) Prime() error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, meta_file := range w.Meta {
+
+		m, err := w.readMeta(meta_file)
+
+		if err != nil {
+			return err
+		}
+
+		w.meta[meta_file] = m
+
+		for id, abs_path := range m.Rows {
+
+			info, err := os.Stat(abs_path)
+
+			if err != nil {
+				continue
+			}
+
+			w.files[id] = &WOFWatchedFile{Path: abs_path, ModTime: info.ModTime(), Size: info.Size()}
+		}
+	}
+
+	w.Logger.Status("watcher primed with %d meta files and %d records", len(w.meta), len(w.files))
+	return nil
+}
+
+func (w *WOFPointInPolygonWatcher) Start() {
+
+	ticker := time.NewTicker(w.Interval)
+
+	go func() {
+
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+				w.Sync()
+			}
+		}
+	}()
+
+	w.Logger.Status("watching %d meta files every %v (dry run: %t)", len(w.Meta), w.Interval, w.DryRun)
+}
+
+// Stop stops the polling loop started by Start. It never blocks, so it is safe to
+// call more than once or without calling Start first, but once a watcher has been
+// stopped it can't be started again.
+
+func (w *WOFPointInPolygonWatcher) Stop() {
+
+	w.stop.Do(func() {
+		close(w.done)
+	})
+}
+
+// Status returns a copy of the results of the last sync or nil if we haven't
+// finished one yet.
+
+func (w *WOFPointInPolygonWatcher) Status() *WOFSyncStatus {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.status == nil {
+		return nil
+	}
+
+	status := *w.status
+	return &status
+}
+
+func (w *WOFPointInPolygonWatcher) Sync() (*WOFSyncStatus, error) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// don't fight with Reindex over the same records
+
+	w.PIP.reindex_mu.Lock()
+	defer w.PIP.reindex_mu.Unlock()
+
+	t := time.Now()
+
+	status := WOFSyncStatus{
+		Started: t,
+		DryRun:  w.DryRun,
+		Added:   make([]int, 0),
+		Updated: make([]int, 0),
+		Removed: make([]int, 0),
+	}
+
+	// First figure out which meta files have changed and re-read those.
+	// Unchanged meta files keep the rows we read last time around.
+
+	meta := make(map[string]*WOFWatchedMeta)
+
+	for _, meta_file := range w.Meta {
+
+		prev, ok := w.meta[meta_file]
+
+		info, err := os.Stat(meta_file)
+
+		if err != nil {
+
+			// If a meta file disappears entirely it is much more likely that
+			// something has gone wrong with the pull than that every record
+			// in it has been removed so hold on to what we've got
+
+			w.Logger.Error("failed to stat meta file %s, because %s", meta_file, err)
+			status.Errors += 1
+
+			if ok {
+				meta[meta_file] = prev
+			}
+
+			continue
+		}
+
+		if ok && info.ModTime().Equal(prev.ModTime) && info.Size() == prev.Size {
+			meta[meta_file] = prev
+			continue
+		}
+
+		w.Logger.Info("meta file %s has changed, re-reading", meta_file)
+
+		m, err := w.readMeta(meta_file)
+
+		if err != nil {
+			w.Logger.Error("failed to read meta file %s, because %s", meta_file, err)
+			status.Errors += 1
+
+			if ok {
+				meta[meta_file] = prev
+			}
+
+			continue
+		}
+
+		meta[meta_file] = m
+	}
+
+	// Now compare every record we've been told about with what we saw last time
+
+	files := make(map[int]*WOFWatchedFile)
+
+	for _, m := range meta {
+
+		for id, abs_path := range m.Rows {
+
+			_, seen := files[id]
+
+			if seen {
+				continue
+			}
+
+			info, err := os.Stat(abs_path)
+
+			if err != nil {
+				w.Logger.Warning("'%s' is listed in a meta file but can not be read, because %s", abs_path, err)
+				continue
+			}
+
+			current := &WOFWatchedFile{Path: abs_path, ModTime: info.ModTime(), Size: info.Size()}
+			files[id] = current
+
+			prev, ok := w.files[id]
+
+			if !ok {
+				status.Added = append(status.Added, id)
+				continue
+			}
+
+			if prev.Path != current.Path || !prev.ModTime.Equal(current.ModTime) || prev.Size != current.Size {
+				status.Updated = append(status.Updated, id)
+			}
+		}
+	}
+
+	for id, _ := range w.files {
+
+		_, ok := files[id]
+
+		if !ok {
+			status.Removed = append(status.Removed, id)
+		}
+	}
+
+	status.Records = len(files)
+
+	// A file whose modification time has changed hasn't necessarily changed
+	// (think `git checkout`) so compare hashes before doing anything else
+
+	updated := make([]int, 0)
+	failed := make(map[int]bool)
+
+	for _, id := range status.Updated {
+
+		abs_path := files[id].Path
+
+		var changed bool
+		var removed bool
+		var err error
+
+		if w.DryRun {
+			changed, err = w.PIP.HasGeoJSONFileChanged(abs_path)
+		} else {
+			changed, removed, err = w.PIP.reindexGeoJSONFile(abs_path)
+		}
+
+		if err != nil {
+			w.Logger.Error("failed to reindex '%s', because %s", abs_path, err)
+			status.Errors += 1
+			failed[id] = true
+			continue
+		}
+
+		if removed {
+			status.Removed = append(status.Removed, id)
+		} else if changed {
+			updated = append(updated, id)
+		} else {
+			status.Touched += 1
+		}
+	}
+
+	status.Updated = updated
+
+	if !w.DryRun {
+
+		for _, id := range status.Added {
+
+			abs_path := files[id].Path
+			err := w.PIP.IndexGeoJSONFile(abs_path)
+
+			if err != nil {
+				w.Logger.Error("failed to index '%s', because %s", abs_path, err)
+				status.Errors += 1
+				failed[id] = true
+			}
+		}
+
+		for _, id := range status.Removed {
+			w.PIP.UnindexId(id)
+		}
+
+		// Forget about anything that failed to index so that we try
+		// again on the next sync
+
+		for id, _ := range failed {
+			delete(files, id)
+		}
+
+		w.meta = meta
+		w.files = files
+	}
+
+	d := time.Since(t)
+
+	status.Finished = time.Now()
+	status.Duration = float64(d) / 1e9
+
+	if status.Errors > 0 {
+		status.Error = "one or more records failed to sync, check the logs for details"
+	}
+
+	w.status = &status
+
+	prefix := "sync complete"
+
+	if w.DryRun {
+		prefix = "sync complete (dry run, nothing changed)"
+	}
+
+	w.Logger.Status("%s: %d added, %d updated, %d removed, %d touched but unchanged, %d errors, %d records in %.3f seconds", prefix, len(status.Added), len(status.Updated), len(status.Removed), status.Touched, status.Errors, status.Records, status.Duration)
+
+	for _, id := range status.Added {
+		w.Logger.Info("sync added %d", id)
+	}
+
+	for _, id := range status.Updated {
+		w.Logger.Info("sync updated %d", id)
+	}
+
+	for _, id := range status.Removed {
+		w.Logger.Info("sync removed %d", id)
+	}
+
+	rsp := status
+	return &rsp, nil
+}
+
+func (w *WOFPointInPolygonWatcher) readMeta(meta_file string) (*WOFWatchedMeta, error) {
+
+	info, err := os.Stat(meta_file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := csv.NewDictReaderFromPath(meta_file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make(map[int]string)
+
+	for {
+		row, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		rel_path, ok := row["path"]
+
+		if !ok || IsAltGeometryPath(rel_path) {
+			continue
+		}
+
+		id, ok := IdFromMetaRow(row)
+
+		if !ok {
+			w.Logger.Warning("unable to determine ID for '%s' in %s", rel_path, meta_file)
+			continue
+		}
+
+		rows[id] = path.Join(w.Root, rel_path)
+	}
+
+	m := WOFWatchedMeta{
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+		Rows:    rows,
+	}
+
+	return &m, nil
+}
+
+// IdFromMetaRow returns the WOF ID for a meta file row, preferring the 'id' column
+// and falling back to the filename in the 'path' column
+
+func IdFromMetaRow(row map[string]string) (int, bool) {
+
+	str_id, ok := row["id"]
+
+	if ok {
+
+		id, err := strconv.Atoi(str_id)
+
+		if err == nil {
+			return id, true
+		}
+	}
+
+	rel_path, ok := row["path"]
+
+	if !ok {
+		return -1, false
+	}
+
+	return IdFromPath(rel_path)
+}
+
+// IsAltGeometryPath returns true for the path to an alternate geometry, like
+// 101/736/545/101736545-alt-quattroshapes.geojson
+
+func IsAltGeometryPath(abs_path string) bool {
+
+	fname := filepath.Base(abs_path)
+
+	if !strings.HasSuffix(fname, ".geojson") {
+		return false
+	}
+
+	return strings.Contains(fname, "-alt-")
+}
+
+// IdFromPath returns the WOF ID for a path like 101/736/545/101736545.geojson
+// Alternate geometries (101736545-alt-example.geojson) are not considered to
+// have an ID of their own.
+
+func IdFromPath(abs_path string) (int, bool) {
+
+	fname := filepath.Base(abs_path)
+
+	if !strings.HasSuffix(fname, ".geojson") {
+		return -1, false
+	}
+
+	str_id := strings.TrimSuffix(fname, ".geojson")
+
+	id, err := strconv.Atoi(str_id)
+
+	if err != nil {
+		return -1, false
+	}
+
+	return id, true
+}
@@ -0,0 +1,49 @@
+package pip
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestWatcher(t *testing.T) *WOFPointInPolygonWatcher {
+
+	p := newTestPointInPolygon(t, NewFilesystemReader(t.TempDir()))
+
+	w, err := NewPointInPolygonWatcher(p, []string{}, time.Millisecond, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+func TestWatcherStop(t *testing.T) {
+
+	stopped := make(chan bool)
+
+	go func() {
+
+		// without being started
+		w := newTestWatcher(t)
+		w.Stop()
+		w.Stop()
+
+		// after being started, and after a few syncs
+		w = newTestWatcher(t)
+		w.Start()
+
+		time.Sleep(10 * time.Millisecond)
+
+		w.Stop()
+		w.Stop()
+
+		stopped <- true
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stop blocked")
+	}
+}